@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
 
 	"github.com/AhmadWaleed/eventsource/command"
 )
@@ -35,60 +36,248 @@ type AggregateHandler interface {
 	command.Handler
 }
 
+// BusOption configures the aggregate command bus
+type BusOption func(b *commandBus)
+
+// WithMiddlewares registers middlewares executed before each command
+func WithMiddlewares(middlewares ...command.Middleware) BusOption {
+	return func(b *commandBus) {
+		for _, m := range middlewares {
+			b.interceptors = append(b.interceptors, command.Before(m))
+		}
+	}
+}
+
+// WithInterceptors wraps the handling of each command, retries included, with
+// interceptors. They run after the middlewares registered before them.
+func WithInterceptors(interceptors ...command.Interceptor) BusOption {
+	return func(b *commandBus) {
+		b.interceptors = append(b.interceptors, interceptors...)
+	}
+}
+
+// WithRetryPolicy retries commands that fail with ErrConcurrencyConflict
+// by reloading the aggregate and handling the command again.
+func WithRetryPolicy(p RetryPolicy) BusOption {
+	return func(b *commandBus) {
+		b.retry = p
+	}
+}
+
+// WithEventPublisher publishes the events of an aggregate after it is saved
+func WithEventPublisher(p command.EventPublisher) BusOption {
+	return func(b *commandBus) {
+		b.publisher = p
+	}
+}
+
+// WithPublishRetryPolicy retries publishing an event which failed
+func WithPublishRetryPolicy(p RetryPolicy) BusOption {
+	return func(b *commandBus) {
+		b.publishRetry = p
+	}
+}
+
+// WithPublishErrorHandler sets what happens when an event can not be
+// published, by default the command fails with FailOnPublishError.
+func WithPublishErrorHandler(h PublishErrorHandler) BusOption {
+	return func(b *commandBus) {
+		b.onPublishError = h
+	}
+}
+
+// PublishErrorHandler is called when publishing a committed event failed,
+// returning an error fails the command and skips the remaining events.
+// The events are already saved at that point.
+type PublishErrorHandler func(ctx context.Context, e Event, err error) error
+
+// PublishError is returned by Send when a committed event could not be
+// published. It does not unwrap to Err, the command succeeded and must not
+// be mistaken for a failure such as ErrConcurrencyConflict and retried.
+type PublishError struct {
+	Event Event
+	Err   error
+}
+
+func (e *PublishError) Error() string {
+	return fmt.Sprintf("could not publish event %T of aggregate %s: %v", e.Event, e.Event.AggregateID(), e.Err)
+}
+
+// FailOnPublishError fails the command with the publish error
+func FailOnPublishError(_ context.Context, _ Event, err error) error {
+	return err
+}
+
+// LogOnPublishError logs the publish error and keeps publishing the remaining events
+func LogOnPublishError(_ context.Context, e Event, err error) error {
+	log.Printf("could not publish event %T of aggregate %s: %v", e, e.AggregateID(), err)
+	return nil
+}
+
 func NewCommandBus(repo AggregateRootRepository, middlewares ...command.Middleware) command.CommandSender {
-	return &commandBus{
-		repo:        repo,
-		middlewares: middlewares,
+	return NewCommandBusWithOptions(repo, WithMiddlewares(middlewares...))
+}
+
+// NewCommandBusWithOptions creates a command bus configured with opts, e.g.
+// a retry policy or an event publisher.
+func NewCommandBusWithOptions(repo AggregateRootRepository, opts ...BusOption) command.CommandSender {
+	bus := &commandBus{
+		repo:           repo,
+		retry:          RetryPolicy{MaxAttempts: 1},
+		publishRetry:   RetryPolicy{MaxAttempts: 1},
+		onPublishError: FailOnPublishError,
+	}
+
+	for _, opt := range opts {
+		opt(bus)
 	}
+
+	return bus
 }
 
 // commandBus default command bus which can be used to syncronously
 // process aggregate commands. Its an implmentation of command.CommandSender inferface.
 type commandBus struct {
-	repo        AggregateRootRepository
-	middlewares []command.Middleware
+	repo           AggregateRootRepository
+	interceptors   []command.Interceptor
+	retry          RetryPolicy
+	publisher      command.EventPublisher
+	publishRetry   RetryPolicy
+	onPublishError PublishErrorHandler
 }
 
 // Send process aggregate command, publishes the relevant
 // events and save the aggreate state/events into event store.
 func (b *commandBus) Send(ctx context.Context, cmd interface{}) error {
-	for _, m := range b.middlewares {
-		if err := m.Before(ctx, cmd); err != nil {
-			return err
-		}
-	}
+	_, err := b.send(ctx, cmd)
+	return err
+}
 
+// send is Send returning the aggregate the command was applied to
+func (b *commandBus) send(ctx context.Context, cmd interface{}) (AggregateRoot, error) {
+	var aggregate AggregateRoot
+	err := command.Chain(b.interceptors...)(func(ctx context.Context, cmd interface{}) error {
+		var err error
+		aggregate, err = b.dispatch(ctx, cmd)
+		return err
+	})(ctx, cmd)
+
+	return aggregate, err
+}
+
+// dispatch applies cmd to its aggregate, retrying on concurrency conflicts
+func (b *commandBus) dispatch(ctx context.Context, cmd interface{}) (AggregateRoot, error) {
 	agrCmd, ok := cmd.(AggregateCommand)
 	if !ok {
-		return errors.New("command must be a AggregateCommand")
+		return nil, errors.New("command must be a AggregateCommand")
 	}
 
+	ctx = withCommandMetadata(ctx, cmd)
+
+	isNew := false
+	if v, ok := agrCmd.(Constructor); ok {
+		isNew = v.New()
+	}
+
+	var (
+		aggregate AggregateRoot
+		events    []Event
+	)
+	err := b.retry.do(ctx, func() error {
+		var err error
+		aggregate, events, err = b.handle(ctx, agrCmd)
+		return err
+	}, func(err error) bool {
+		// a constructor conflicts only when the stream already exists,
+		// handling it again would conflict again.
+		var conflict *ErrConcurrencyConflict
+		return !isNew && errors.As(err, &conflict)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// events are published once they are committed, outside of the retries
+	// so a failing publisher never causes the command to be handled again.
+	return aggregate, b.publish(ctx, events)
+}
+
+// handle applies cmd to its aggregate and saves it, it returns the saved events
+func (b *commandBus) handle(ctx context.Context, cmd AggregateCommand) (AggregateRoot, []Event, error) {
 	var aggregate AggregateRoot
-	if v, ok := agrCmd.(Constructor); ok && v.New() {
+	if v, ok := cmd.(Constructor); ok && v.New() {
 		aggregate = b.repo.New().(AggregateRoot)
 	} else {
-		aggregateID := agrCmd.AggregateID()
+		aggregateID := cmd.AggregateID()
 		v, err := b.repo.GetByID(ctx, aggregateID)
 		if err != nil {
-			return fmt.Errorf("unable to get aggregate by ID: %v", err)
+			return nil, nil, fmt.Errorf("unable to get aggregate by ID: %v", err)
 		}
 		aggregate = v
 	}
 
 	handler, ok := aggregate.(AggregateHandler)
 	if !ok {
-		return fmt.Errorf("%T do not implement CommandHandler", aggregate)
+		return nil, nil, fmt.Errorf("%T do not implement CommandHandler", aggregate)
 	}
 
-	err := handler.Handle(ctx, agrCmd)
+	err := handler.Handle(ctx, cmd)
 	if err != nil {
-		return fmt.Errorf("could not apply command, %T, to aggregate, %T", cmd, aggregate)
+		return nil, nil, fmt.Errorf("could not apply command, %T, to aggregate, %T", cmd, aggregate)
 	}
 
+	// Save commits the aggregate, grab the events to publish beforehand
+	events := aggregate.GetUncommitedEvents()
+
 	err = b.repo.Save(ctx, aggregate)
 	if err != nil {
-		return fmt.Errorf("could not save aggregate %T %v", aggregate, err)
+		return nil, nil, fmt.Errorf("could not save aggregate %T: %w", aggregate, err)
+	}
+
+	return aggregate, events, nil
+}
+
+// publish dispatches committed events to the event publisher, failures
+// are passed to the PublishErrorHandler once retries are exhausted.
+func (b *commandBus) publish(ctx context.Context, events []Event) error {
+	if b.publisher == nil {
+		return nil
+	}
+
+	for _, e := range events {
+		err := b.publishRetry.do(ctx, func() error {
+			return b.publisher.Publish(ctx, e)
+		}, func(error) bool { return true })
+		if err == nil {
+			continue
+		}
+
+		if err := b.onPublishError(ctx, e, err); err != nil {
+			return &PublishError{Event: e, Err: err}
+		}
 	}
 
 	return nil
 }
+
+// withCommandMetadata sets the command as causation of the events it produces,
+// the correlation id is inherited from ctx or starts with this command.
+func withCommandMetadata(ctx context.Context, cmd interface{}) context.Context {
+	var cmdID string
+	if v, ok := cmd.(IdentifiedCommand); ok {
+		cmdID = v.CommandID()
+	}
+	if cmdID == "" {
+		cmdID = NewEventID()
+	}
+
+	correlationID := MetadataFromContext(ctx)[MetadataCorrelationID]
+	if correlationID == "" {
+		correlationID = cmdID
+	}
+
+	return WithMetadata(ctx, Metadata{
+		MetadataCausationID:   cmdID,
+		MetadataCorrelationID: correlationID,
+	})
+}
@@ -0,0 +1,240 @@
+package eventsource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AhmadWaleed/eventsource/command"
+)
+
+// racingRepository lets a competing writer save the aggregate right before
+// the first n saves, simulating concurrent commands on the same aggregate.
+type racingRepository struct {
+	AggregateRootRepository
+	races int
+}
+
+func (r *racingRepository) Save(ctx context.Context, aggr AggregateRoot) error {
+	if r.races > 0 {
+		r.races--
+
+		other, err := r.AggregateRootRepository.GetByID(ctx, aggr.AggregateRootID())
+		if err != nil {
+			return err
+		}
+
+		other.(*Shipment).Handle(ctx, PickupShipment{Command{ID: aggr.AggregateRootID()}})
+		if err := r.AggregateRootRepository.Save(ctx, other); err != nil {
+			return err
+		}
+	}
+
+	return r.AggregateRootRepository.Save(ctx, aggr)
+}
+
+func TestCommandBusRetriesConflicts(t *testing.T) {
+	marshaler := new(JsonEventMarshaler)
+	marshaler.Bind(ShipmentPacked{}, ShipmentPickedUp{}, ShipmentShipped{})
+
+	ctx := context.Background()
+	repo := &racingRepository{AggregateRootRepository: NewRepository(&Shipment{}, WithMarshaler(marshaler))}
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	if err := NewCommandBus(repo).Send(ctx, PackShipment{Command{ID: "abc123"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	repo.races = 1
+	var conflict *ErrConcurrencyConflict
+	if err := NewCommandBus(repo).Send(ctx, ShipShipment{Command{ID: "abc123"}}); !errors.As(err, &conflict) {
+		t.Fatalf("expected concurrency conflict without retry policy, got %v", err)
+	}
+
+	repo.races = 2
+	if err := NewCommandBusWithOptions(repo, WithRetryPolicy(policy)).Send(ctx, ShipShipment{Command{ID: "abc123"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	aggregate, _ := repo.GetByID(ctx, "abc123")
+	shipment := aggregate.(*Shipment)
+	if shipment.Status != Shipped || shipment.GetVersion() != 4 {
+		t.Errorf("expected shipped at version 4, got %s at version %d", shipment.Status, shipment.GetVersion())
+	}
+
+	repo.races = 3
+	if err := NewCommandBusWithOptions(repo, WithRetryPolicy(policy)).Send(ctx, ShipShipment{Command{ID: "abc123"}}); !errors.As(err, &conflict) {
+		t.Fatalf("expected concurrency conflict after max attempts, got %v", err)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+
+	for attempt, want := range []time.Duration{10, 20, 40, 50, 50} {
+		if got := p.Backoff(attempt + 1); got != want*time.Millisecond {
+			t.Errorf("attempt %d: expected %v, got %v", attempt+1, want*time.Millisecond, got)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := p.Backoff(1); got < 5*time.Millisecond || got > 10*time.Millisecond {
+			t.Fatalf("expected jittered backoff within [5ms, 10ms], got %v", got)
+		}
+	}
+}
+
+type recordingPublisher struct {
+	events []interface{}
+	fails  int
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, v interface{}) error {
+	if p.fails > 0 {
+		p.fails--
+		return errors.New("broker unavailable")
+	}
+
+	p.events = append(p.events, v)
+
+	return nil
+}
+
+func TestCommandBusPublishesCommittedEvents(t *testing.T) {
+	marshaler := new(JsonEventMarshaler)
+	marshaler.Bind(ShipmentPacked{}, ShipmentPickedUp{}, ShipmentShipped{})
+
+	ctx := context.Background()
+	repo := NewRepository(&Shipment{}, WithMarshaler(marshaler))
+	publisher := &recordingPublisher{}
+
+	bus := NewCommandBusWithOptions(repo, WithEventPublisher(publisher))
+	if err := bus.Send(ctx, PackShipment{Command{ID: "abc123"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(publisher.events) != 1 {
+		t.Fatalf("expected 1 published event, got %d", len(publisher.events))
+	}
+	if _, ok := publisher.events[0].(*ShipmentPacked); !ok {
+		t.Errorf("expected *ShipmentPacked to be published, got %T", publisher.events[0])
+	}
+
+	publisher.fails = 1
+	if err := bus.Send(ctx, PickupShipment{Command{ID: "abc123"}}); err == nil {
+		t.Fatal("expected publish error to fail the command")
+	}
+
+	publisher.fails = 1
+	bus = NewCommandBusWithOptions(repo, WithEventPublisher(publisher), WithPublishRetryPolicy(RetryPolicy{MaxAttempts: 2}))
+	if err := bus.Send(ctx, ShipShipment{Command{ID: "abc123"}}); err != nil {
+		t.Fatalf("expected publish to succeed on retry, got %v", err)
+	}
+
+	publisher.fails = 1
+	bus = NewCommandBusWithOptions(repo, WithEventPublisher(publisher), WithPublishErrorHandler(LogOnPublishError))
+	if err := bus.Send(ctx, ShipShipment{Command{ID: "abc123"}}); err != nil {
+		t.Fatalf("expected publish error to be logged, got %v", err)
+	}
+
+	if len(publisher.events) != 2 {
+		t.Errorf("expected 2 published events, got %d", len(publisher.events))
+	}
+}
+
+// conflictingPublisher fails like a subscriber which hit a concurrency conflict
+type conflictingPublisher struct {
+	calls int
+}
+
+func (p *conflictingPublisher) Publish(ctx context.Context, v interface{}) error {
+	p.calls++
+	return fmt.Errorf("subscriber failed: %w", &ErrConcurrencyConflict{AggregateID: "other"})
+}
+
+func TestCommandBusPublishesOutsideRetries(t *testing.T) {
+	marshaler := new(JsonEventMarshaler)
+	marshaler.Bind(ShipmentPacked{}, ShipmentPickedUp{}, ShipmentShipped{})
+
+	ctx := context.Background()
+	repo := NewRepository(&Shipment{}, WithMarshaler(marshaler))
+	publisher := &conflictingPublisher{}
+
+	if err := NewCommandBus(repo).Send(ctx, PackShipment{Command{ID: "abc123"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	bus := NewCommandBusWithOptions(repo, WithEventPublisher(publisher), WithRetryPolicy(RetryPolicy{MaxAttempts: 3}))
+	err := bus.Send(ctx, PickupShipment{Command{ID: "abc123"}})
+
+	var (
+		publishErr *PublishError
+		conflict   *ErrConcurrencyConflict
+	)
+	if !errors.As(err, &publishErr) || errors.As(err, &conflict) {
+		t.Fatalf("expected a PublishError not matching ErrConcurrencyConflict, got %v", err)
+	}
+
+	if publisher.calls != 1 {
+		t.Errorf("expected the event to be published once, got %d calls", publisher.calls)
+	}
+
+	aggregate, err := repo.GetByID(ctx, "abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if aggregate.GetVersion() != 1 {
+		t.Errorf("expected the command to be handled once, got version %d", aggregate.GetVersion())
+	}
+}
+
+func TestCommandBusInterceptors(t *testing.T) {
+	marshaler := new(JsonEventMarshaler)
+	marshaler.Bind(ShipmentPacked{}, ShipmentPickedUp{}, ShipmentShipped{})
+
+	ctx := context.Background()
+	repo := NewRepository(&Shipment{}, WithMarshaler(marshaler))
+
+	var (
+		calls    []string
+		observed error
+	)
+	trace := func(name string) command.Interceptor {
+		return func(next command.HandlerFunc) command.HandlerFunc {
+			return func(ctx context.Context, v interface{}) error {
+				calls = append(calls, "before "+name)
+				err := next(ctx, v)
+				calls = append(calls, "after "+name)
+				return err
+			}
+		}
+	}
+
+	bus := NewCommandBusWithOptions(repo, WithInterceptors(
+		command.Timing(func(_ interface{}, _ time.Duration, err error) { observed = err }),
+		trace("outer"),
+		trace("inner"),
+	))
+
+	if err := bus.Send(ctx, PackShipment{Command{ID: "abc123"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"before outer", "before inner", "after inner", "after outer"}
+	if len(calls) != len(want) {
+		t.Fatalf("expected calls %v, got %v", want, calls)
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Fatalf("expected calls %v, got %v", want, calls)
+		}
+	}
+
+	if err := bus.Send(ctx, PackShipment{Command{ID: "abc123"}}); err == nil || observed != err {
+		t.Errorf("expected interceptors to see the result of the command, got %v and %v", err, observed)
+	}
+}
@@ -0,0 +1,304 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/AhmadWaleed/eventsource/command"
+)
+
+var (
+	// ErrBusClosed is returned when sending to a bus which is shut down
+	ErrBusClosed = errors.New("bus closed")
+
+	// ErrQueueFull is returned by a non blocking bus when the queue of the
+	// worker of a message is full.
+	ErrQueueFull = errors.New("bus queue full")
+)
+
+type AsyncOption func(b *AsyncBus)
+
+// WithWorkers sets the number of workers, 4 by default and at least 1
+func WithWorkers(n int) AsyncOption {
+	return func(b *AsyncBus) {
+		b.workers = n
+	}
+}
+
+// WithQueueSize sets the number of messages queued per worker, 64 by default
+func WithQueueSize(n int) AsyncOption {
+	return func(b *AsyncBus) {
+		b.queueSize = n
+	}
+}
+
+// WithNonBlocking fails with ErrQueueFull instead of waiting for a full queue
+func WithNonBlocking() AsyncOption {
+	return func(b *AsyncBus) {
+		b.nonBlocking = true
+	}
+}
+
+// NewAsyncBus processes the commands and events of bus on a pool of workers.
+// Messages having an AggregateID are always processed by the same worker, so
+// messages of an aggregate are processed in the order they were sent.
+func NewAsyncBus(bus Bus, opts ...AsyncOption) *AsyncBus {
+	b := &AsyncBus{
+		bus:       bus,
+		workers:   4,
+		queueSize: 64,
+		quit:      make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	if b.workers < 1 {
+		b.workers = 1
+	}
+
+	if b.queueSize < 0 {
+		b.queueSize = 0
+	}
+
+	b.queues = make([]chan message, b.workers)
+	for i := range b.queues {
+		b.queues[i] = make(chan message, b.queueSize)
+
+		b.wg.Add(1)
+		go b.work(i)
+	}
+
+	return b
+}
+
+// AsyncBus is a Bus processing messages on a worker pool, Send and Publish
+// wait for the message to be processed while SendAsync and PublishAsync
+// return once it is queued.
+//
+// Send and Publish called by handlers would deadlock when the message goes
+// to the worker processing the handler, or to a worker waiting for it up the
+// call chain, e.g. a handler on worker 1 sending to worker 2 whose handler
+// sends back to worker 1. Such messages are handled inline, which needs
+// handlers to pass their ctx on. SendAsync and PublishAsync always queue, so
+// messages of an aggregate keep their order, and fail with ErrQueueFull
+// instead of blocking when the queue of such a worker is full. Waiting on
+// the Result of SendAsync or PublishAsync in a handler is not detected and
+// may deadlock.
+type AsyncBus struct {
+	bus         Bus
+	workers     int
+	queueSize   int
+	nonBlocking bool
+
+	queues []chan message
+	next   uint32
+	wg     sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+	quit   chan struct{}
+	once   sync.Once
+}
+
+type message struct {
+	ctx     context.Context
+	v       interface{}
+	publish bool
+	wait    bool
+	result  *Result
+}
+
+// Result is the outcome of a queued message
+type Result struct {
+	done chan struct{}
+	err  error
+}
+
+// Done is closed once the message is processed
+func (r *Result) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err returns the error of the handlers, nil until the message is processed
+func (r *Result) Err() error {
+	select {
+	case <-r.done:
+		return r.err
+	default:
+		return nil
+	}
+}
+
+// Wait waits for the message to be processed and returns the error of its handlers
+func (r *Result) Wait(ctx context.Context) error {
+	select {
+	case <-r.done:
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Result) complete(err error) {
+	r.err = err
+	close(r.done)
+}
+
+func (b *AsyncBus) Bind(v interface{}, handlers []command.Handler) error {
+	return b.bus.Bind(v, handlers)
+}
+
+func (b *AsyncBus) Send(ctx context.Context, cmd interface{}) error {
+	r, err := b.enqueue(message{ctx: ctx, v: cmd, wait: true})
+	if err != nil {
+		return err
+	}
+
+	return r.Wait(ctx)
+}
+
+func (b *AsyncBus) Publish(ctx context.Context, event interface{}) error {
+	r, err := b.enqueue(message{ctx: ctx, v: event, publish: true, wait: true})
+	if err != nil {
+		return err
+	}
+
+	return r.Wait(ctx)
+}
+
+// SendAsync queues cmd, it blocks while the queue is full unless the bus is non blocking
+func (b *AsyncBus) SendAsync(ctx context.Context, cmd interface{}) (*Result, error) {
+	return b.enqueue(message{ctx: ctx, v: cmd})
+}
+
+// PublishAsync queues event, it blocks while the queue is full unless the bus is non blocking
+func (b *AsyncBus) PublishAsync(ctx context.Context, event interface{}) (*Result, error) {
+	return b.enqueue(message{ctx: ctx, v: event, publish: true})
+}
+
+// Shutdown stops accepting messages and waits for the queued ones to be
+// processed, ctx errors are returned when they are not processed in time.
+func (b *AsyncBus) Shutdown(ctx context.Context) error {
+	b.once.Do(func() {
+		close(b.quit)
+
+		b.mu.Lock()
+		b.closed = true
+		for _, q := range b.queues {
+			close(q)
+		}
+		b.mu.Unlock()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *AsyncBus) enqueue(msg message) (*Result, error) {
+	msg.result = &Result{done: make(chan struct{})}
+	worker := b.partition(msg.v)
+
+	// the worker is busy with the handler sending msg, or waits for it
+	// further up the call chain
+	var busy bool
+	for _, w := range b.chain(msg.ctx) {
+		busy = busy || w == worker
+	}
+
+	// waiting for a queued message would deadlock
+	if busy && msg.wait {
+		msg.result.complete(b.dispatch(msg))
+		return msg.result, nil
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return nil, ErrBusClosed
+	}
+
+	// a busy worker can not make room in its queue
+	if b.nonBlocking || busy {
+		select {
+		case b.queues[worker] <- msg:
+			return msg.result, nil
+		default:
+			return nil, ErrQueueFull
+		}
+	}
+
+	select {
+	case b.queues[worker] <- msg:
+		return msg.result, nil
+	case <-msg.ctx.Done():
+		return nil, msg.ctx.Err()
+	case <-b.quit:
+		return nil, ErrBusClosed
+	}
+}
+
+// partition returns the worker of v, messages without aggregate are spread round robin
+func (b *AsyncBus) partition(v interface{}) int {
+	if a, ok := v.(interface{ AggregateID() string }); ok {
+		h := fnv.New32a()
+		h.Write([]byte(a.AggregateID()))
+		return int(h.Sum32() % uint32(b.workers))
+	}
+
+	return int(atomic.AddUint32(&b.next, 1) % uint32(b.workers))
+}
+
+type workerKey struct{ b *AsyncBus }
+
+// chain returns the workers of the handlers waiting for each other up the
+// call chain of ctx, the last one processes the handler ctx was passed to.
+func (b *AsyncBus) chain(ctx context.Context) []int {
+	chain, _ := ctx.Value(workerKey{b}).([]int)
+	return chain
+}
+
+func (b *AsyncBus) work(worker int) {
+	defer b.wg.Done()
+
+	for msg := range b.queues[worker] {
+		// only Send and Publish keep the worker of the sender waiting
+		chain := []int{worker}
+		if msg.wait {
+			chain = append(append([]int(nil), b.chain(msg.ctx)...), worker)
+		}
+
+		msg.ctx = context.WithValue(msg.ctx, workerKey{b}, chain)
+		msg.result.complete(b.dispatch(msg))
+	}
+}
+
+func (b *AsyncBus) dispatch(msg message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panic processing %T: %v", msg.v, r)
+		}
+	}()
+
+	if msg.publish {
+		return b.bus.Publish(msg.ctx, msg.v)
+	}
+
+	return b.bus.Send(msg.ctx, msg.v)
+}
@@ -0,0 +1,257 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AhmadWaleed/eventsource/command"
+)
+
+type deposit struct {
+	Account string
+	N       int
+}
+
+func (d deposit) AggregateID() string { return d.Account }
+
+type deposited struct{ deposit }
+
+type handlerFunc func(ctx context.Context, v interface{}) error
+
+func (f handlerFunc) Handle(ctx context.Context, v interface{}) error { return f(ctx, v) }
+
+func TestAsyncBusOrdersPerAggregate(t *testing.T) {
+	ctx := context.Background()
+	b := NewAsyncBus(NewSyncBus(), WithWorkers(4), WithQueueSize(8))
+
+	var (
+		mu   sync.Mutex
+		seen = make(map[string][]int)
+	)
+
+	b.Bind(deposit{}, []command.Handler{handlerFunc(func(ctx context.Context, v interface{}) error {
+		// events published by handlers are processed inline by the same worker
+		return b.Publish(ctx, deposited{v.(deposit)})
+	})})
+	b.Bind(deposited{}, []command.Handler{handlerFunc(func(ctx context.Context, v interface{}) error {
+		d := v.(deposited)
+		mu.Lock()
+		defer mu.Unlock()
+		seen[d.Account] = append(seen[d.Account], d.N)
+		return nil
+	})})
+
+	var results []*Result
+	for n := 0; n < 50; n++ {
+		for _, account := range []string{"a", "b", "c"} {
+			r, err := b.SendAsync(ctx, deposit{account, n})
+			if err != nil {
+				t.Fatal(err)
+			}
+			results = append(results, r)
+		}
+	}
+
+	for _, r := range results {
+		if err := r.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for account, ns := range seen {
+		for i, n := range ns {
+			if n != i {
+				t.Fatalf("expected deposits of %s in order, got %v", account, ns)
+			}
+		}
+	}
+
+	if err := b.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Send(ctx, deposit{"a", 50}); !errors.Is(err, ErrBusClosed) {
+		t.Errorf("expected ErrBusClosed after shutdown, got %v", err)
+	}
+}
+
+func TestAsyncBusBackpressureAndShutdown(t *testing.T) {
+	ctx := context.Background()
+	b := NewAsyncBus(NewSyncBus(), WithWorkers(1), WithQueueSize(1), WithNonBlocking())
+
+	release := make(chan struct{})
+	var handled int
+	b.Bind(deposit{}, []command.Handler{handlerFunc(func(ctx context.Context, v interface{}) error {
+		<-release
+		handled++
+		if v.(deposit).N == 1 {
+			return fmt.Errorf("rejected")
+		}
+		return nil
+	})})
+
+	first, err := b.SendAsync(ctx, deposit{"a", 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for the worker to pick up the first command so the second is queued
+	var second *Result
+	for deadline := time.Now().Add(time.Second); second == nil; {
+		if second, err = b.SendAsync(ctx, deposit{"a", 1}); err != nil && time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := b.SendAsync(ctx, deposit{"a", 2}); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := b.Shutdown(timeout); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected shutdown to time out with work in flight, got %v", err)
+	}
+
+	close(release)
+	if err := b.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if handled != 2 || first.Err() != nil || second.Err() == nil {
+		t.Errorf("expected queued commands to be drained, handled %d: %v, %v", handled, first.Err(), second.Err())
+	}
+}
+
+type transfer struct {
+	From, To string
+	Hops     int
+}
+
+func (t transfer) AggregateID() string { return t.From }
+
+func TestAsyncBusCrossWorkerSends(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	b := NewAsyncBus(NewSyncBus(), WithWorkers(2))
+
+	// find two accounts handled by different workers
+	from, to := "a", ""
+	for i := 0; to == ""; i++ {
+		if account := fmt.Sprint(i); b.partition(transfer{From: account}) != b.partition(transfer{From: from}) {
+			to = account
+		}
+	}
+
+	// the transfer bounces between both workers, each waiting for the other
+	b.Bind(transfer{}, []command.Handler{handlerFunc(func(ctx context.Context, v interface{}) error {
+		tr := v.(transfer)
+		if tr.Hops == 0 {
+			return nil
+		}
+		return b.Send(ctx, transfer{From: tr.To, To: tr.From, Hops: tr.Hops - 1})
+	})})
+
+	if err := b.Send(ctx, transfer{From: from, To: to, Hops: 4}); err != nil {
+		t.Fatalf("expected the transfer to complete, got %v", err)
+	}
+
+	if err := b.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAsyncBusQueuesAsyncSendsFromHandlers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	b := NewAsyncBus(NewSyncBus(), WithWorkers(2))
+
+	var (
+		mu      sync.Mutex
+		handled []int
+		queued  = make(chan struct{})
+		third   = make(chan *Result, 1)
+	)
+	b.Bind(deposit{}, []command.Handler{handlerFunc(func(ctx context.Context, v interface{}) error {
+		d := v.(deposit)
+		if d.N == 1 {
+			// the second deposit is queued behind the first one
+			<-queued
+
+			r, err := b.SendAsync(ctx, deposit{d.Account, 3})
+			if err != nil {
+				return err
+			}
+			third <- r
+		}
+
+		mu.Lock()
+		handled = append(handled, d.N)
+		mu.Unlock()
+		return nil
+	})})
+
+	first, err := b.SendAsync(ctx, deposit{"a", 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := b.SendAsync(ctx, deposit{"a", 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(queued)
+
+	for _, r := range []*Result{first, second, <-third} {
+		if err := r.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if fmt.Sprint(handled) != "[1 2 3]" {
+		t.Errorf("expected the deposits of a in order, got %v", handled)
+	}
+}
+
+func TestAsyncBusWorkersAtLeastOne(t *testing.T) {
+	b := NewAsyncBus(NewSyncBus(), WithWorkers(0))
+	b.Bind(deposit{}, []command.Handler{handlerFunc(func(ctx context.Context, v interface{}) error { return nil })})
+
+	if err := b.Send(context.Background(), deposit{"a", 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncBusBindWhileDispatching(t *testing.T) {
+	ctx := context.Background()
+	b := NewAsyncBus(NewSyncBus(), WithWorkers(4))
+	b.Bind(deposit{}, []command.Handler{handlerFunc(func(ctx context.Context, v interface{}) error { return nil })})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := b.Bind(transfer{}, []command.Handler{handlerFunc(func(ctx context.Context, v interface{}) error { return nil })}); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		if err := b.Send(ctx, deposit{fmt.Sprint(i), i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	if err := b.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
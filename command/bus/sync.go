@@ -2,12 +2,18 @@ package bus
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 
 	"github.com/AhmadWaleed/eventsource/command"
 )
 
+// ErrNoHandler is returned when sending a command no handler is bound to
+var ErrNoHandler = errors.New("no handler bound")
+
 // Bus is an interface for building bus to process both commands and evets.
 type Bus interface {
 	command.CommandSender
@@ -17,24 +23,46 @@ type Bus interface {
 }
 
 func NewSyncBus(middlewares ...command.Middleware) Bus {
+	interceptors := make([]command.Interceptor, len(middlewares))
+	for i, m := range middlewares {
+		interceptors[i] = command.Before(m)
+	}
+
+	return NewSyncBusWithInterceptors(interceptors...)
+}
+
+// NewSyncBusWithInterceptors returns a synchronous bus wrapping the handling
+// of each command and event with interceptors, the first one is the outermost.
+func NewSyncBusWithInterceptors(interceptors ...command.Interceptor) Bus {
 	return &synchronousBus{
-		middlewares: middlewares,
-		handlers:    make(map[reflect.Type][]command.Handler),
+		intercept: command.Chain(interceptors...),
+		handlers:  make(map[reflect.Type][]command.Handler),
 	}
 }
 
 // synchronousBus process commands/events handler synchronously
 // this is an example how the command pkg can be used extend and
 // build any type of command/event bus to process aggregate events.
+// Handlers may be bound while messages are dispatched, e.g. by the
+// workers of an AsyncBus.
 type synchronousBus struct {
-	middlewares []command.Middleware
-	handlers    map[reflect.Type][]command.Handler
+	intercept command.Interceptor
+
+	mu       sync.RWMutex
+	handlers map[reflect.Type][]command.Handler
 }
 
 func (b *synchronousBus) Bind(v interface{}, handlers []command.Handler) error {
 	t := typ(v)
-	if len(b.getHandlers(t)) > 0 {
-		return fmt.Errorf("handler already bind to %T", t)
+	if len(handlers) == 0 {
+		return fmt.Errorf("no handlers given for %v", t)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.handlers[t]) > 0 {
+		return fmt.Errorf("handler already bind to %v", t)
 	}
 
 	b.handlers[t] = handlers
@@ -42,34 +70,47 @@ func (b *synchronousBus) Bind(v interface{}, handlers []command.Handler) error {
 	return nil
 }
 
+// Send dispatches cmd to its handler, commands must have exactly one handler.
+// An error returned by a middleware aborts the dispatch.
 func (b *synchronousBus) Send(ctx context.Context, cmd interface{}) error {
-	for _, m := range b.middlewares {
-		m.Before(ctx, cmd)
-	}
-
-	var err error
-	for _, h := range b.getHandlers(cmd) {
-		err = h.Handle(ctx, cmd)
+	handlers := b.getHandlers(cmd)
+	switch {
+	case len(handlers) == 0:
+		return fmt.Errorf("%w: %v", ErrNoHandler, typ(cmd))
+	case len(handlers) > 1:
+		return fmt.Errorf("command %v has %d handlers, commands must have exactly one", typ(cmd), len(handlers))
 	}
 
-	return err
+	return b.intercept(handlers[0].Handle)(ctx, cmd)
 }
 
+// Publish dispatches event to all its handlers, events without handlers are
+// ignored. Handlers all run and their errors are returned as HandlerErrors.
 func (b *synchronousBus) Publish(ctx context.Context, event interface{}) error {
-	for _, m := range b.middlewares {
-		m.Before(ctx, event)
-	}
+	return b.intercept(b.fanOut)(ctx, event)
+}
 
-	var err error
+func (b *synchronousBus) fanOut(ctx context.Context, event interface{}) error {
+	var errs HandlerErrors
 	for _, h := range b.getHandlers(event) {
-		err = h.Handle(ctx, event)
+		if err := h.Handle(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
 	}
 
-	return err
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
 }
 
 func (b *synchronousBus) getHandlers(v interface{}) []command.Handler {
 	t := typ(v)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
 	if h, ok := b.handlers[t]; ok {
 		return h
 	}
@@ -77,6 +118,23 @@ func (b *synchronousBus) getHandlers(v interface{}) []command.Handler {
 	return make([]command.Handler, 0)
 }
 
+// HandlerErrors holds the errors of the handlers of an event
+type HandlerErrors []error
+
+func (e HandlerErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the handler errors, errors.Is and errors.As match any of them
+func (e HandlerErrors) Unwrap() []error {
+	return e
+}
+
 func typ(v interface{}) reflect.Type {
 	t := reflect.TypeOf(v)
 	if t.Kind() == reflect.Ptr {
@@ -0,0 +1,121 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/AhmadWaleed/eventsource/command"
+)
+
+var errRejected = errors.New("rejected")
+
+type middlewareFunc func(ctx context.Context, v interface{}) error
+
+func (f middlewareFunc) Before(ctx context.Context, v interface{}) error { return f(ctx, v) }
+
+func TestSyncBusSend(t *testing.T) {
+	ctx := context.Background()
+
+	var handled int
+	handler := handlerFunc(func(ctx context.Context, v interface{}) error {
+		handled++
+		return nil
+	})
+
+	b := NewSyncBus(middlewareFunc(func(ctx context.Context, v interface{}) error {
+		if v.(deposit).N < 0 {
+			return errRejected
+		}
+		return nil
+	}))
+
+	if err := b.Send(ctx, deposit{"a", 1}); !errors.Is(err, ErrNoHandler) {
+		t.Errorf("expected ErrNoHandler, got %v", err)
+	}
+
+	if err := b.Bind(deposit{}, []command.Handler{handler}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Bind(&deposit{}, []command.Handler{handler}); err == nil {
+		t.Error("expected binding a type twice to fail")
+	}
+
+	if err := b.Send(ctx, deposit{"a", 1}); err != nil || handled != 1 {
+		t.Errorf("expected command to be handled once, got %d: %v", handled, err)
+	}
+
+	if err := b.Send(ctx, deposit{"a", -1}); !errors.Is(err, errRejected) || handled != 1 {
+		t.Errorf("expected middleware to abort the dispatch, got %d: %v", handled, err)
+	}
+
+	b.Bind(deposited{}, []command.Handler{handler, handler})
+	if err := b.Send(ctx, deposited{}); err == nil || errors.Is(err, ErrNoHandler) {
+		t.Errorf("expected command with several handlers to fail, got %v", err)
+	}
+}
+
+func TestSyncBusPublish(t *testing.T) {
+	ctx := context.Background()
+	b := NewSyncBus()
+
+	if err := b.Publish(ctx, deposited{}); err != nil {
+		t.Errorf("expected event without handlers to be ignored, got %v", err)
+	}
+
+	var handled int
+	failing := func(err error) command.Handler {
+		return handlerFunc(func(ctx context.Context, v interface{}) error {
+			handled++
+			return err
+		})
+	}
+
+	errOther := errors.New("other")
+	b.Bind(deposited{}, []command.Handler{failing(errRejected), failing(nil), failing(errOther)})
+
+	err := b.Publish(ctx, deposited{})
+
+	var errs HandlerErrors
+	if !errors.As(err, &errs) || len(errs) != 2 || handled != 3 {
+		t.Fatalf("expected all handlers to run and both errors to be returned, got %d: %v", handled, err)
+	}
+	if !errors.Is(err, errRejected) || !errors.Is(err, errOther) {
+		t.Errorf("expected joined error to match each handler error, got %v", err)
+	}
+}
+
+func TestSyncBusInterceptors(t *testing.T) {
+	ctx := context.Background()
+
+	var outcomes []error
+	observe := func(next command.HandlerFunc) command.HandlerFunc {
+		return func(ctx context.Context, v interface{}) error {
+			err := next(ctx, v)
+			outcomes = append(outcomes, err)
+			return err
+		}
+	}
+
+	b := NewSyncBusWithInterceptors(command.Recover(), observe)
+	b.Bind(deposit{}, []command.Handler{handlerFunc(func(ctx context.Context, v interface{}) error {
+		panic("boom")
+	})})
+	b.Bind(deposited{}, []command.Handler{
+		handlerFunc(func(ctx context.Context, v interface{}) error { return errRejected }),
+		handlerFunc(func(ctx context.Context, v interface{}) error { return nil }),
+	})
+
+	var panicErr *command.PanicError
+	if err := b.Send(ctx, deposit{}); !errors.As(err, &panicErr) {
+		t.Errorf("expected recovered panic, got %v", err)
+	}
+
+	if err := b.Publish(ctx, deposited{}); !errors.Is(err, errRejected) {
+		t.Errorf("expected handler error, got %v", err)
+	}
+
+	if len(outcomes) != 1 || !errors.Is(outcomes[0], errRejected) {
+		t.Errorf("expected interceptors to wrap the event fan out once, got %v", outcomes)
+	}
+}
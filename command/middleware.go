@@ -0,0 +1,133 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// HandlerFunc adapts a function to a Handler
+type HandlerFunc func(ctx context.Context, v interface{}) error
+
+func (f HandlerFunc) Handle(ctx context.Context, v interface{}) error {
+	return f(ctx, v)
+}
+
+// Interceptor is an around-style middleware, it wraps the handling of
+// commands and events and decides whether and how next is called.
+type Interceptor func(next HandlerFunc) HandlerFunc
+
+// Chain composes interceptors into one, the first one is the outermost
+func Chain(interceptors ...Interceptor) Interceptor {
+	return func(next HandlerFunc) HandlerFunc {
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			next = interceptors[i](next)
+		}
+
+		return next
+	}
+}
+
+// Before adapts a Middleware to an Interceptor, an error returned by
+// the middleware aborts the handling.
+func Before(m Middleware) Interceptor {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, v interface{}) error {
+			if err := m.Before(ctx, v); err != nil {
+				return err
+			}
+
+			return next(ctx, v)
+		}
+	}
+}
+
+// PanicError is returned by Recover when a handler panics
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("handler panic: %v", e.Value)
+}
+
+// Recover turns handler panics into a PanicError
+func Recover() Interceptor {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, v interface{}) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = &PanicError{Value: r, Stack: debug.Stack()}
+				}
+			}()
+
+			return next(ctx, v)
+		}
+	}
+}
+
+// Logging logs the outcome of each message with logger, the standard
+// logger is used when logger is nil.
+func Logging(logger *log.Logger) Interceptor {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return Timing(func(v interface{}, d time.Duration, err error) {
+		if err != nil {
+			logger.Printf("%T failed after %s: %v", v, d, err)
+			return
+		}
+
+		logger.Printf("%T handled in %s", v, d)
+	})
+}
+
+// Timing reports how long handling each message took to observe
+func Timing(observe func(v interface{}, d time.Duration, err error)) Interceptor {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, v interface{}) error {
+			start := time.Now()
+			err := next(ctx, v)
+			observe(v, time.Since(start), err)
+
+			return err
+		}
+	}
+}
+
+// Timeout cancels the context of the handlers after d, handlers are
+// expected to return once their context is done.
+func Timeout(d time.Duration) Interceptor {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, v interface{}) error {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+
+			return next(ctx, v)
+		}
+	}
+}
+
+// Validator is implemented by commands and events validating themselves
+type Validator interface {
+	Validate() error
+}
+
+// Validation rejects messages implementing Validator which are not valid
+func Validation() Interceptor {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, v interface{}) error {
+			if val, ok := v.(Validator); ok {
+				if err := val.Validate(); err != nil {
+					return fmt.Errorf("invalid %T: %w", v, err)
+				}
+			}
+
+			return next(ctx, v)
+		}
+	}
+}
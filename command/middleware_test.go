@@ -0,0 +1,58 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+type transfer struct{ Amount int }
+
+func (t transfer) Validate() error {
+	if t.Amount <= 0 {
+		return errors.New("amount must be positive")
+	}
+	return nil
+}
+
+func TestInterceptors(t *testing.T) {
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	handle := Chain(Recover(), Logging(log.New(&buf, "", 0)), Validation(), Timeout(time.Millisecond))(func(ctx context.Context, v interface{}) error {
+		switch v.(transfer).Amount {
+		case 1:
+			return nil
+		case 2:
+			<-ctx.Done()
+			return ctx.Err()
+		default:
+			panic("boom")
+		}
+	})
+
+	if err := handle(ctx, transfer{1}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := handle(ctx, transfer{0}); err == nil || !strings.Contains(err.Error(), "amount must be positive") {
+		t.Errorf("expected validation error, got %v", err)
+	}
+
+	if err := handle(ctx, transfer{2}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected timeout, got %v", err)
+	}
+
+	var panicErr *PanicError
+	if err := handle(ctx, transfer{3}); !errors.As(err, &panicErr) || panicErr.Value != "boom" {
+		t.Errorf("expected recovered panic, got %v", err)
+	}
+
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 3 || !strings.Contains(lines[0], "command.transfer handled in") {
+		t.Errorf("expected each handled message to be logged, got %q", buf.String())
+	}
+}
@@ -0,0 +1,351 @@
+package eventsource
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressedMagic starts compressed payloads followed by the compressor id,
+// neither JSON, CBOR nor gob payloads start with it.
+var compressedMagic = []byte{0x00, 'z'}
+
+// Compressor compresses the payloads of the compressing marshalers
+type Compressor interface {
+	// ID tags the payloads compressed with the compressor, it must be unique
+	ID() byte
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	// Gzip compresses payloads with compress/gzip
+	Gzip Compressor = gzipCompressor{}
+
+	// Flate compresses payloads with compress/flate, it is a bit more compact than Gzip
+	Flate Compressor = flateCompressor{}
+
+	// Zstd compresses payloads with zstandard, it compresses better and
+	// decompresses faster than Gzip and Flate.
+	Zstd Compressor = &zstdCompressor{}
+)
+
+// MaxDecompressedSize limits the size of decompressed payloads, payloads
+// growing beyond it fail to decompress instead of exhausting memory.
+var MaxDecompressedSize int64 = 64 << 20
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[byte]Compressor{Gzip.ID(): Gzip, Flate.ID(): Flate, Zstd.ID(): Zstd}
+)
+
+// RegisterCompressor makes payloads compressed with c readable by every
+// compressing marshaler, Gzip, Flate and Zstd are registered by default.
+func RegisterCompressor(c Compressor) error {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+
+	if registered, ok := compressors[c.ID()]; ok && registered != c {
+		return fmt.Errorf("compressor id %d already registered by %T", c.ID(), registered)
+	}
+
+	compressors[c.ID()] = c
+
+	return nil
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) ID() byte { return 1 }
+
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return readLimited(r)
+}
+
+type flateCompressor struct{}
+
+func (flateCompressor) ID() byte { return 2 }
+
+func (flateCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (flateCompressor) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	return readLimited(r)
+}
+
+type zstdCompressor struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+}
+
+func (*zstdCompressor) ID() byte { return 3 }
+
+func (c *zstdCompressor) Compress(data []byte) ([]byte, error) {
+	// EncodeAll is safe for concurrent use, the encoder is shared
+	c.once.Do(func() {
+		c.encoder, _ = zstd.NewWriter(nil)
+	})
+
+	return c.encoder.EncodeAll(data, nil), nil
+}
+
+func (*zstdCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return readLimited(r)
+}
+
+// readLimited reads r up to MaxDecompressedSize
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > MaxDecompressedSize {
+		return nil, fmt.Errorf("decompressed payload exceeds %d bytes", MaxDecompressedSize)
+	}
+
+	return data, nil
+}
+
+// CompressionStats describes the payloads marshaled by a compressing marshaler
+type CompressionStats struct {
+	// Payloads is the number of marshaled payloads
+	Payloads int64
+
+	// Compressed is the number of payloads stored compressed
+	Compressed int64
+
+	// RawBytes is the size of the payloads before compression
+	RawBytes int64
+
+	// StoredBytes is the size of the payloads as stored
+	StoredBytes int64
+}
+
+// Ratio returns StoredBytes / RawBytes, 1 when nothing was marshaled yet
+func (s CompressionStats) Ratio() float64 {
+	if s.RawBytes == 0 {
+		return 1
+	}
+
+	return float64(s.StoredBytes) / float64(s.RawBytes)
+}
+
+// compression compresses payloads above a threshold and keeps the stats
+type compression struct {
+	compressor Compressor
+	threshold  int
+
+	payloads, compressed, rawBytes, storedBytes int64
+}
+
+func (c *compression) compress(data []byte) ([]byte, error) {
+	atomic.AddInt64(&c.payloads, 1)
+	atomic.AddInt64(&c.rawBytes, int64(len(data)))
+
+	if len(data) >= c.threshold {
+		compressed, err := c.compressor.Compress(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compress payload: %v", err)
+		}
+
+		// the payload is kept as is when compressing does not pay off
+		if len(compressed)+len(compressedMagic)+1 < len(data) {
+			data = append(append(append([]byte{}, compressedMagic...), c.compressor.ID()), compressed...)
+			atomic.AddInt64(&c.compressed, 1)
+		}
+	}
+
+	atomic.AddInt64(&c.storedBytes, int64(len(data)))
+
+	return data, nil
+}
+
+func (c *compression) decompress(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, compressedMagic) || len(data) <= len(compressedMagic) {
+		return data, nil
+	}
+
+	id := data[len(compressedMagic)]
+
+	compressorsMu.RLock()
+	compressor, ok := compressors[id]
+	compressorsMu.RUnlock()
+
+	if !ok && c.compressor.ID() == id {
+		compressor, ok = c.compressor, true
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown compressor id %d", id)
+	}
+
+	return compressor.Decompress(data[len(compressedMagic)+1:])
+}
+
+func (c *compression) stats() CompressionStats {
+	return CompressionStats{
+		Payloads:    atomic.LoadInt64(&c.payloads),
+		Compressed:  atomic.LoadInt64(&c.compressed),
+		RawBytes:    atomic.LoadInt64(&c.rawBytes),
+		StoredBytes: atomic.LoadInt64(&c.storedBytes),
+	}
+}
+
+// NewCompressingEventMarshaler compresses the payloads of m which are at least
+// threshold bytes. Stored payloads which are not compressed decode as before,
+// with postgres the table must be created WithBinaryData.
+func NewCompressingEventMarshaler(m EventMarshaler, c Compressor, threshold int) *CompressingEventMarshaler {
+	return &CompressingEventMarshaler{
+		EventMarshaler: m,
+		compression:    &compression{compressor: c, threshold: threshold},
+	}
+}
+
+// CompressingEventMarshaler decorates an EventMarshaler with compression
+type CompressingEventMarshaler struct {
+	EventMarshaler
+	compression *compression
+}
+
+func (m *CompressingEventMarshaler) Marshal(e Event) (EventModel, error) {
+	return m.MarshalContext(context.Background(), e)
+}
+
+// MarshalContext implements ContextEventMarshaler for the decorated marshaler
+func (m *CompressingEventMarshaler) MarshalContext(ctx context.Context, e Event) (EventModel, error) {
+	model, err := MarshalEvent(ctx, m.EventMarshaler, e)
+	if err != nil {
+		return EventModel{}, err
+	}
+
+	model.Data, err = m.compression.compress(model.Data)
+
+	return model, err
+}
+
+func (m *CompressingEventMarshaler) Unmarshal(model EventModel) (Event, error) {
+	return m.UnmarshalContext(context.Background(), model)
+}
+
+// UnmarshalContext implements ContextEventMarshaler for the decorated marshaler
+func (m *CompressingEventMarshaler) UnmarshalContext(ctx context.Context, model EventModel) (Event, error) {
+	data, err := m.compression.decompress(model.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	model.Data = data
+
+	return UnmarshalEvent(ctx, m.EventMarshaler, model)
+}
+
+// Stats returns the compression stats of the marshaled events
+func (m *CompressingEventMarshaler) Stats() CompressionStats {
+	return m.compression.stats()
+}
+
+// NewCompressingSnapshotMarshaler compresses the payloads of m which are at
+// least threshold bytes, see NewCompressingEventMarshaler.
+func NewCompressingSnapshotMarshaler(m SnapshotMarshaler, c Compressor, threshold int) *CompressingSnapshotMarshaler {
+	return &CompressingSnapshotMarshaler{
+		SnapshotMarshaler: m,
+		compression:       &compression{compressor: c, threshold: threshold},
+	}
+}
+
+// CompressingSnapshotMarshaler decorates a SnapshotMarshaler with compression
+type CompressingSnapshotMarshaler struct {
+	SnapshotMarshaler
+	compression *compression
+}
+
+func (m *CompressingSnapshotMarshaler) Marshal(s Snapshot) (SnapshotModel, error) {
+	return m.MarshalContext(context.Background(), s)
+}
+
+// MarshalContext implements ContextSnapshotMarshaler for the decorated marshaler
+func (m *CompressingSnapshotMarshaler) MarshalContext(ctx context.Context, s Snapshot) (SnapshotModel, error) {
+	model, err := marshalSnapshotContext(ctx, m.SnapshotMarshaler, s)
+	if err != nil {
+		return SnapshotModel{}, err
+	}
+
+	model.Data, err = m.compression.compress(model.Data)
+
+	return model, err
+}
+
+func (m *CompressingSnapshotMarshaler) Unmarshal(model SnapshotModel) (Snapshot, error) {
+	return m.UnmarshalContext(context.Background(), model)
+}
+
+// UnmarshalContext implements ContextSnapshotMarshaler for the decorated marshaler
+func (m *CompressingSnapshotMarshaler) UnmarshalContext(ctx context.Context, model SnapshotModel) (Snapshot, error) {
+	data, err := m.compression.decompress(model.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	model.Data = data
+
+	return unmarshalSnapshotContext(ctx, m.SnapshotMarshaler, model)
+}
+
+// Stats returns the compression stats of the marshaled snapshots
+func (m *CompressingSnapshotMarshaler) Stats() CompressionStats {
+	return m.compression.stats()
+}
@@ -0,0 +1,116 @@
+package eventsource
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompressingEventMarshaler(t *testing.T) {
+	for name, compressor := range map[string]Compressor{"gzip": Gzip, "flate": Flate, "zstd": Zstd} {
+		t.Run(name, func(t *testing.T) {
+			inner := new(JsonEventMarshaler)
+			inner.Bind(CustomerRegistered{})
+
+			marshaler := NewCompressingEventMarshaler(inner, compressor, 256)
+
+			small := &CustomerRegistered{EventSkeleton{ID: "abc123"}, "John", "Doe"}
+			large := &CustomerRegistered{EventSkeleton{ID: "abc123"}, strings.Repeat("John", 100), "Doe"}
+
+			for _, e := range []*CustomerRegistered{small, large} {
+				model, err := marshaler.Marshal(e)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if compressed := model.Data[0] == 0; compressed != (e == large) {
+					t.Errorf("expected only payloads above the threshold to be compressed, got %q", model.Data)
+				}
+
+				event, err := marshaler.Unmarshal(model)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if decoded := event.(*CustomerRegistered); decoded.FirstName != e.FirstName {
+					t.Errorf("unexpected decoded event: %+v", decoded)
+				}
+			}
+
+			stats := marshaler.Stats()
+			if stats.Payloads != 2 || stats.Compressed != 1 || stats.Ratio() >= 0.5 {
+				t.Errorf("unexpected stats: %+v with ratio %f", stats, stats.Ratio())
+			}
+
+			// rows stored before compression was enabled
+			legacy, err := inner.Marshal(large)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := marshaler.Unmarshal(legacy); err != nil {
+				t.Errorf("unable to unmarshal uncompressed payload: %v", err)
+			}
+		})
+	}
+}
+
+func TestCompressingSnapshotMarshaler(t *testing.T) {
+	inner := new(CborSnapshotMarshaler)
+	inner.Bind(counterState{})
+
+	marshaler := NewCompressingSnapshotMarshaler(inner, Gzip, 0)
+
+	model, err := marshaler.Marshal(SnapshotSkeleton{ID: "abc123", Version: 4, State: counterState{Count: 5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tiny payloads are stored as is since compressing them does not pay off
+	if stats := marshaler.Stats(); stats.Compressed != 0 || stats.Ratio() != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	snap, err := marshaler.Unmarshal(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.GetState().(*counterState).Count != 5 {
+		t.Errorf("unexpected decoded snapshot: %+v", snap)
+	}
+
+	if _, err := marshaler.Unmarshal(SnapshotModel{Data: []byte{0, 'z', 42, 1}}); err == nil || !strings.Contains(err.Error(), "unknown compressor") {
+		t.Errorf("expected unknown compressor error, got %v", err)
+	}
+}
+
+func TestCompressorsLimitDecompressedSize(t *testing.T) {
+	defer func(max int64) { MaxDecompressedSize = max }(MaxDecompressedSize)
+	MaxDecompressedSize = 1 << 10
+
+	for name, compressor := range map[string]Compressor{"gzip": Gzip, "flate": Flate, "zstd": Zstd} {
+		t.Run(name, func(t *testing.T) {
+			bomb, err := compressor.Compress(make([]byte, 1<<20))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := compressor.Decompress(bomb); err == nil || !strings.Contains(err.Error(), "exceeds") {
+				t.Errorf("expected the payload to exceed the limit, got %v", err)
+			}
+
+			data, err := compressor.Decompress(mustCompress(t, compressor, make([]byte, 1<<10)))
+			if err != nil || len(data) != 1<<10 {
+				t.Errorf("expected a payload at the limit to decompress, got %d bytes: %v", len(data), err)
+			}
+		})
+	}
+}
+
+func mustCompress(t *testing.T, c Compressor, data []byte) []byte {
+	t.Helper()
+
+	compressed, err := c.Compress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return compressed
+}
@@ -0,0 +1,379 @@
+package eventsource
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+const (
+	// RedactedPlaceholder replaces the encrypted fields of forgotten subjects
+	RedactedPlaceholder = "[redacted]"
+
+	// encryptTag marks the fields of events and snapshot states, `eventsource:"pii"`
+	// fields are encrypted with the key of the `eventsource:"subject"` field.
+	encryptTag = "eventsource"
+
+	encryptedPrefix = "enc:"
+)
+
+var (
+	// ErrKeyNotFound is returned by KeyStore when a subject has no key
+	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrSubjectForgotten is returned by KeyStore when creating the key of a forgotten subject
+	ErrSubjectForgotten = errors.New("subject forgotten")
+)
+
+// KeyStore holds the data keys of the subjects whose fields are encrypted
+type KeyStore interface {
+	// GetOrCreateKey returns the key of subject, creating it on first use.
+	// ErrSubjectForgotten is returned once the subject was forgotten.
+	GetOrCreateKey(ctx context.Context, subject string) ([]byte, error)
+
+	// GetKey returns ErrKeyNotFound when subject has no key or was forgotten
+	GetKey(ctx context.Context, subject string) ([]byte, error)
+
+	// ForgetSubject destroys the key of subject, its encrypted fields can
+	// never be decrypted again.
+	ForgetSubject(ctx context.Context, subject string) error
+}
+
+// NewDataKey returns a random AES-256 key
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func NewInmemKeyStore() KeyStore {
+	return &inmemKeyStore{keys: make(map[string][]byte)}
+}
+
+// inmemKeyStore keeps a nil key for forgotten subjects
+type inmemKeyStore struct {
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+func (s *inmemKeyStore) GetOrCreateKey(ctx context.Context, subject string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[subject]
+	if ok && key == nil {
+		return nil, fmt.Errorf("%w: %s", ErrSubjectForgotten, subject)
+	}
+
+	if !ok {
+		var err error
+		if key, err = NewDataKey(); err != nil {
+			return nil, err
+		}
+
+		s.keys[subject] = key
+	}
+
+	return key, nil
+}
+
+func (s *inmemKeyStore) GetKey(ctx context.Context, subject string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := s.keys[subject]
+	if key == nil {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, subject)
+	}
+
+	return key, nil
+}
+
+func (s *inmemKeyStore) ForgetSubject(ctx context.Context, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[subject] = nil
+
+	return nil
+}
+
+// encryptedFields holds the field indexes of a struct type tagged for encryption
+type encryptedFields struct {
+	subject []int
+	fields  [][]int
+}
+
+var encryptedFieldsCache sync.Map
+
+func encryptedFieldsOf(t reflect.Type) (*encryptedFields, error) {
+	if cached, ok := encryptedFieldsCache.Load(t); ok {
+		return cached.(*encryptedFields), nil
+	}
+
+	ef := new(encryptedFields)
+	if t.Kind() == reflect.Struct {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+
+			switch f.Tag.Get(encryptTag) {
+			case "subject":
+				if f.Type.Kind() != reflect.String {
+					return nil, fmt.Errorf("subject field %s of %v must be a string", f.Name, t)
+				}
+				ef.subject = f.Index
+			case "pii":
+				if f.Type.Kind() != reflect.String {
+					return nil, fmt.Errorf("encrypted field %s of %v must be a string", f.Name, t)
+				}
+				ef.fields = append(ef.fields, f.Index)
+			}
+		}
+	}
+
+	encryptedFieldsCache.Store(t, ef)
+
+	return ef, nil
+}
+
+// fieldCipher encrypts and decrypts the tagged fields of events and states
+type fieldCipher struct {
+	keys        KeyStore
+	placeholder *string
+}
+
+// encrypt returns a copy of v with its tagged fields encrypted, subject is
+// used when v has no subject field.
+func (c *fieldCipher) encrypt(ctx context.Context, v interface{}, subject string) (interface{}, error) {
+	rv := reflect.ValueOf(v)
+	t := elem(rv.Type())
+
+	ef, err := encryptedFieldsOf(t)
+	if err != nil || len(ef.fields) == 0 {
+		return v, err
+	}
+
+	cp := reflect.New(t).Elem()
+	cp.Set(reflect.Indirect(rv))
+
+	if ef.subject != nil {
+		subject = cp.FieldByIndex(ef.subject).String()
+	}
+
+	if subject == "" {
+		return nil, fmt.Errorf("unable to encrypt %v without a subject", t)
+	}
+
+	key, err := c.keys.GetOrCreateKey(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, index := range ef.fields {
+		f := cp.FieldByIndex(index)
+
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+
+		sealed := aead.Seal(nonce, nonce, []byte(f.String()), []byte(subject))
+		f.SetString(encryptedPrefix + base64.RawStdEncoding.EncodeToString(sealed))
+	}
+
+	if rv.Kind() == reflect.Ptr {
+		return cp.Addr().Interface(), nil
+	}
+
+	return cp.Interface(), nil
+}
+
+// decrypt decrypts the tagged fields of v in place, the fields of forgotten
+// subjects are set to the placeholder. Fields stored in plain text are kept.
+func (c *fieldCipher) decrypt(ctx context.Context, v interface{}, subject string) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr {
+		return nil
+	}
+
+	ef, err := encryptedFieldsOf(rv.Type().Elem())
+	if err != nil || len(ef.fields) == 0 {
+		return err
+	}
+
+	rv = rv.Elem()
+	if ef.subject != nil {
+		subject = rv.FieldByIndex(ef.subject).String()
+	}
+
+	var aead cipher.AEAD
+	for _, index := range ef.fields {
+		f := rv.FieldByIndex(index)
+		if !strings.HasPrefix(f.String(), encryptedPrefix) {
+			continue
+		}
+
+		if aead == nil {
+			key, err := c.keys.GetKey(ctx, subject)
+			if errors.Is(err, ErrKeyNotFound) {
+				c.redact(rv, ef)
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			if aead, err = newAEAD(key); err != nil {
+				return err
+			}
+		}
+
+		sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(f.String(), encryptedPrefix))
+		if err != nil || len(sealed) < aead.NonceSize() {
+			return fmt.Errorf("malformed encrypted field of %v", rv.Type())
+		}
+
+		plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(subject))
+		if err != nil {
+			return fmt.Errorf("unable to decrypt field of %v: %v", rv.Type(), err)
+		}
+
+		f.SetString(string(plain))
+	}
+
+	return nil
+}
+
+func (c *fieldCipher) redact(rv reflect.Value, ef *encryptedFields) {
+	for _, index := range ef.fields {
+		if f := rv.FieldByIndex(index); strings.HasPrefix(f.String(), encryptedPrefix) {
+			f.SetString(*c.placeholder)
+		}
+	}
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// NewEncryptingEventMarshaler encrypts the `eventsource:"pii"` string fields
+// of events with the key of their subject, the `eventsource:"subject"` field
+// or the aggregate id. Once the subject is forgotten in keys the fields decode
+// as the Placeholder.
+func NewEncryptingEventMarshaler(m EventMarshaler, keys KeyStore) *EncryptingEventMarshaler {
+	em := &EncryptingEventMarshaler{EventMarshaler: m, Placeholder: RedactedPlaceholder}
+	em.cipher = &fieldCipher{keys: keys, placeholder: &em.Placeholder}
+
+	return em
+}
+
+// EncryptingEventMarshaler decorates an EventMarshaler with field encryption
+type EncryptingEventMarshaler struct {
+	EventMarshaler
+
+	// Placeholder replaces the encrypted fields of forgotten subjects
+	Placeholder string
+
+	cipher *fieldCipher
+}
+
+func (m *EncryptingEventMarshaler) Marshal(e Event) (EventModel, error) {
+	return m.MarshalContext(context.Background(), e)
+}
+
+// MarshalContext implements ContextEventMarshaler, keys are fetched with ctx
+func (m *EncryptingEventMarshaler) MarshalContext(ctx context.Context, e Event) (EventModel, error) {
+	encrypted, err := m.cipher.encrypt(ctx, e, e.AggregateID())
+	if err != nil {
+		return EventModel{}, err
+	}
+
+	return MarshalEvent(ctx, m.EventMarshaler, encrypted.(Event))
+}
+
+func (m *EncryptingEventMarshaler) Unmarshal(model EventModel) (Event, error) {
+	return m.UnmarshalContext(context.Background(), model)
+}
+
+// UnmarshalContext implements ContextEventMarshaler, keys are fetched with ctx
+func (m *EncryptingEventMarshaler) UnmarshalContext(ctx context.Context, model EventModel) (Event, error) {
+	e, err := UnmarshalEvent(ctx, m.EventMarshaler, model)
+	if err != nil {
+		return nil, err
+	}
+
+	return e, m.cipher.decrypt(ctx, e, e.AggregateID())
+}
+
+// NewEncryptingSnapshotMarshaler encrypts the tagged fields of snapshot
+// states, see NewEncryptingEventMarshaler.
+func NewEncryptingSnapshotMarshaler(m SnapshotMarshaler, keys KeyStore) *EncryptingSnapshotMarshaler {
+	sm := &EncryptingSnapshotMarshaler{SnapshotMarshaler: m, Placeholder: RedactedPlaceholder}
+	sm.cipher = &fieldCipher{keys: keys, placeholder: &sm.Placeholder}
+
+	return sm
+}
+
+// EncryptingSnapshotMarshaler decorates a SnapshotMarshaler with field encryption
+type EncryptingSnapshotMarshaler struct {
+	SnapshotMarshaler
+
+	// Placeholder replaces the encrypted fields of forgotten subjects
+	Placeholder string
+
+	cipher *fieldCipher
+}
+
+func (m *EncryptingSnapshotMarshaler) Marshal(s Snapshot) (SnapshotModel, error) {
+	return m.MarshalContext(context.Background(), s)
+}
+
+// MarshalContext implements ContextSnapshotMarshaler, keys are fetched with ctx
+func (m *EncryptingSnapshotMarshaler) MarshalContext(ctx context.Context, s Snapshot) (SnapshotModel, error) {
+	state, err := m.cipher.encrypt(ctx, s.GetState(), s.AggregateRootID())
+	if err != nil {
+		return SnapshotModel{}, err
+	}
+
+	return marshalSnapshotContext(ctx, m.SnapshotMarshaler, SnapshotSkeleton{
+		ID:      s.AggregateRootID(),
+		Version: s.CurrentVersion(),
+		State:   state,
+	})
+}
+
+func (m *EncryptingSnapshotMarshaler) Unmarshal(model SnapshotModel) (Snapshot, error) {
+	return m.UnmarshalContext(context.Background(), model)
+}
+
+// UnmarshalContext implements ContextSnapshotMarshaler, keys are fetched with ctx
+func (m *EncryptingSnapshotMarshaler) UnmarshalContext(ctx context.Context, model SnapshotModel) (Snapshot, error) {
+	s, err := unmarshalSnapshotContext(ctx, m.SnapshotMarshaler, model)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, m.cipher.decrypt(ctx, s.GetState(), s.AggregateRootID())
+}
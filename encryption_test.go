@@ -0,0 +1,208 @@
+package eventsource
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type CustomerSignedUp struct {
+	EventSkeleton
+	Email     string `eventsource:"pii"`
+	Name      string `eventsource:"pii"`
+	Plan      string
+	AccountID string `eventsource:"subject"`
+}
+
+func TestEncryptingEventMarshaler(t *testing.T) {
+	ctx := context.Background()
+	keys := NewInmemKeyStore()
+
+	inner := new(JsonEventMarshaler)
+	inner.Bind(CustomerSignedUp{}, CustomerRegistered{})
+	marshaler := NewEncryptingEventMarshaler(inner, keys)
+
+	e := &CustomerSignedUp{EventSkeleton{ID: "abc123"}, "john@example.com", "John", "pro", "account-1"}
+	model, err := marshaler.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(model.Data), "john@example.com") || !strings.Contains(string(model.Data), `"Plan":"pro"`) {
+		t.Errorf("expected only tagged fields to be encrypted, got %s", model.Data)
+	}
+	if e.Email != "john@example.com" {
+		t.Errorf("expected marshaled event to be left as is, got %+v", e)
+	}
+
+	event, err := marshaler.Unmarshal(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded := event.(*CustomerSignedUp); decoded.Email != e.Email || decoded.Name != e.Name {
+		t.Errorf("unexpected decoded event: %+v", decoded)
+	}
+
+	// events without tagged fields and events stored before encryption
+	plain, err := marshaler.Marshal(&CustomerRegistered{EventSkeleton{ID: "abc123"}, "John", "Doe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := marshaler.Unmarshal(plain); err != nil {
+		t.Errorf("unable to unmarshal event without encrypted fields: %v", err)
+	}
+
+	if err := keys.ForgetSubject(ctx, "account-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	event, err = marshaler.Unmarshal(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded := event.(*CustomerSignedUp); decoded.Email != RedactedPlaceholder || decoded.Name != RedactedPlaceholder || decoded.Plan != "pro" {
+		t.Errorf("expected redacted fields after forgetting the subject, got %+v", decoded)
+	}
+
+	if _, err := marshaler.Marshal(e); err == nil {
+		t.Error("expected marshaling an event of a forgotten subject to fail")
+	}
+}
+
+type customerState struct {
+	Email string `eventsource:"pii"`
+}
+
+func TestEncryptingSnapshotMarshaler(t *testing.T) {
+	keys := NewInmemKeyStore()
+
+	inner := new(JsonSnapshotMarshaler)
+	inner.Bind(customerState{})
+	marshaler := NewEncryptingSnapshotMarshaler(inner, keys)
+	marshaler.Placeholder = "***"
+
+	model, err := marshaler.Marshal(SnapshotSkeleton{ID: "abc123", Version: 2, State: customerState{Email: "john@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(model.Data), "john@example.com") {
+		t.Errorf("expected state to be encrypted, got %s", model.Data)
+	}
+
+	snap, err := marshaler.Unmarshal(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := snap.GetState().(*customerState); state.Email != "john@example.com" {
+		t.Errorf("unexpected decoded state: %+v", state)
+	}
+
+	keys.ForgetSubject(context.Background(), "abc123")
+
+	snap, err = marshaler.Unmarshal(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := snap.GetState().(*customerState); state.Email != "***" {
+		t.Errorf("expected redacted state, got %+v", state)
+	}
+}
+
+type keyStoreCtxKey struct{}
+
+// ctxKeyStore records the values of keyStoreCtxKey its calls are made with
+type ctxKeyStore struct {
+	KeyStore
+	seen []interface{}
+}
+
+func (s *ctxKeyStore) GetOrCreateKey(ctx context.Context, subject string) ([]byte, error) {
+	s.seen = append(s.seen, ctx.Value(keyStoreCtxKey{}))
+	return s.KeyStore.GetOrCreateKey(ctx, subject)
+}
+
+func (s *ctxKeyStore) GetKey(ctx context.Context, subject string) ([]byte, error) {
+	s.seen = append(s.seen, ctx.Value(keyStoreCtxKey{}))
+	return s.KeyStore.GetKey(ctx, subject)
+}
+
+func TestEncryptingEventMarshalerPassesContext(t *testing.T) {
+	ctx := context.WithValue(context.Background(), keyStoreCtxKey{}, "request-1")
+	keys := &ctxKeyStore{KeyStore: NewInmemKeyStore()}
+
+	inner := new(JsonEventMarshaler)
+	inner.Bind(CustomerSignedUp{})
+
+	// the compressing marshaler passes the context to the one it decorates
+	marshaler := NewCompressingEventMarshaler(NewEncryptingEventMarshaler(inner, keys), Gzip, 0)
+
+	model, err := MarshalEvent(ctx, marshaler, &CustomerSignedUp{EventSkeleton{ID: "abc123"}, "john@example.com", "John", "pro", "account-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnmarshalEvent(ctx, marshaler, model); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys.seen) != 2 || keys.seen[0] != "request-1" || keys.seen[1] != "request-1" {
+		t.Errorf("expected the key store to be called with the context of the caller, got %v", keys.seen)
+	}
+}
+
+func TestInmemKeyStore(t *testing.T) {
+	testKeyStore(t, NewInmemKeyStore)
+}
+
+// testKeyStore verifies the key store contract against the stores
+// returned by factory, each test gets a new store.
+func testKeyStore(t *testing.T, factory func() KeyStore) {
+	t.Run("GetOrCreate", func(t *testing.T) {
+		ctx := context.Background()
+		store := factory()
+
+		if _, err := store.GetKey(ctx, "subject-1"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("expected ErrKeyNotFound before the key is created, got %v", err)
+		}
+
+		key, err := store.GetOrCreateKey(ctx, "subject-1")
+		if err != nil {
+			t.Fatalf("unable to create key: %v", err)
+		}
+
+		for _, get := range []func(context.Context, string) ([]byte, error){store.GetOrCreateKey, store.GetKey} {
+			again, err := get(ctx, "subject-1")
+			if err != nil || string(again) != string(key) {
+				t.Errorf("expected the same key, got %x, %v", again, err)
+			}
+		}
+
+		other, err := store.GetOrCreateKey(ctx, "subject-2")
+		if err != nil || string(other) == string(key) {
+			t.Errorf("expected a distinct key per subject, got %x, %v", other, err)
+		}
+	})
+
+	t.Run("ForgetSubject", func(t *testing.T) {
+		ctx := context.Background()
+		store := factory()
+
+		if _, err := store.GetOrCreateKey(ctx, "forget-1"); err != nil {
+			t.Fatalf("unable to create key: %v", err)
+		}
+
+		for _, subject := range []string{"forget-1", "never-seen"} {
+			if err := store.ForgetSubject(ctx, subject); err != nil {
+				t.Fatalf("unable to forget %s: %v", subject, err)
+			}
+
+			if _, err := store.GetKey(ctx, subject); !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("expected ErrKeyNotFound for forgotten %s, got %v", subject, err)
+			}
+
+			if _, err := store.GetOrCreateKey(ctx, subject); !errors.Is(err, ErrSubjectForgotten) {
+				t.Errorf("expected ErrSubjectForgotten for forgotten %s, got %v", subject, err)
+			}
+		}
+	})
+}
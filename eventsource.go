@@ -2,6 +2,7 @@ package eventsource
 
 import (
 	"context"
+	"fmt"
 	"time"
 )
 
@@ -26,6 +27,9 @@ type EventSkeleton struct {
 
 	// At contains the event time
 	At time.Time
+
+	// Envelope contains the event id and metadata, it is not part of the event data
+	Envelope Envelope `json:"-"`
 }
 
 // AggregateID implements part of the Event interface
@@ -43,6 +47,16 @@ func (m EventSkeleton) EventAt() time.Time {
 	return m.At
 }
 
+// EventEnvelope implements part of the Enveloped interface
+func (m EventSkeleton) EventEnvelope() Envelope {
+	return m.Envelope
+}
+
+// SetEventEnvelope implements part of the Enveloped interface
+func (m *EventSkeleton) SetEventEnvelope(env Envelope) {
+	m.Envelope = env
+}
+
 type AggregateRoot interface {
 	AggregateRootID() string
 	GetVersion() int
@@ -62,6 +76,12 @@ type AggregateRootRepository interface {
 
 // EventModel provides the shape of the records to be saved to the db
 type EventModel struct {
+	// ID uniquely identifies the event, stores assign one when empty
+	ID string
+
+	// Metadata contains the event headers such as correlation and causation id
+	Metadata Metadata
+
 	// Version is the event version the Data represents
 	Version int
 
@@ -74,11 +94,69 @@ type EventModel struct {
 
 type History []EventModel
 
+const (
+	// ExpectedVersionAny disables the optimistic concurrency check, events
+	// are appended regardless of the current stream version.
+	ExpectedVersionAny = -2
+
+	// ExpectedVersionNoStream requires that no events have been saved for
+	// the aggregate yet, it prevents constructors from overwriting a stream.
+	ExpectedVersionNoStream = -1
+)
+
+// ErrConcurrencyConflict is returned by an EventStore when the expected
+// version given to SaveEvents does not match the current stream version.
+type ErrConcurrencyConflict struct {
+	AggregateID string
+	Expected    int
+	Actual      int
+}
+
+func (e *ErrConcurrencyConflict) Error() string {
+	return fmt.Sprintf("concurrency conflict on aggregate %s: expected version %d, actual version %d", e.AggregateID, e.Expected, e.Actual)
+}
+
+// EventStore persists and loads aggregate event streams.
+//
+// GetEventsForAggregate returns the events following version ordered by
+// version. Version 0 returns the whole stream like ExpectedVersionNoStream,
+// as it always did, callers skip the first event themselves. An error
+// wrapping ErrAggregateNotFound is returned when the stream does not exist.
+//
+// SaveEvents appends models to the stream after checking that the version of
+// the last stored event equals version (ExpectedVersionNoStream when the stream
+// must not exist, ExpectedVersionAny to skip the check). Appended events are
+// numbered version+1, version+2, ... otherwise *ErrConcurrencyConflict is returned.
 type EventStore interface {
 	SaveEvents(ctx context.Context, aggrID string, models History, version int) error
 	GetEventsForAggregate(ctx context.Context, aggrID string, version int) (History, error)
 }
 
+// RecordedEvent is an event model read from the global stream of a store
+type RecordedEvent struct {
+	EventModel
+
+	// Offset is the global position of the event, unique across all aggregates
+	Offset int64
+
+	// AggregateID contains the id of the aggregate the event belongs to
+	AggregateID string
+}
+
+// GlobalEventReader is implemented by event stores which keep a global commit
+// order. ReadAll returns at most limit events with an offset greater than
+// fromOffset ordered by offset, a limit <= 0 returns all remaining events.
+type GlobalEventReader interface {
+	ReadAll(ctx context.Context, fromOffset int64, limit int) ([]RecordedEvent, error)
+}
+
+// EventNotifier is implemented by event stores able to signal newly saved
+// events. The returned channel receives a value whenever events are appended
+// and is abandoned once ctx is done.
+type EventNotifier interface {
+	Notifications(ctx context.Context) <-chan struct{}
+}
+
 type SnapshottingBehaviour interface {
 	AggregateRoot
 	SnapshotInterval() int
@@ -122,6 +200,8 @@ type SnapshotModel struct {
 	Data    []byte
 }
 
+// SnapshotStore persists aggregate snapshots, GetSnapshotForAggregate returns
+// the newest snapshot at or below version or ErrSnapNotFound.
 type SnapshotStore interface {
 	SaveSnapshot(ctx context.Context, agrID string, model SnapshotModel, version int) error
 	GetSnapshotForAggregate(ctx context.Context, agrID string, version int) (SnapshotModel, error)
@@ -139,11 +219,60 @@ type SnapshotMarshaler interface {
 	Unmarshal(m SnapshotModel) (Snapshot, error)
 }
 
+// ContextEventMarshaler is implemented by event marshalers doing I/O, e.g.
+// the encrypting marshaler fetching keys. They get the context of the
+// caller through MarshalEvent and UnmarshalEvent.
+type ContextEventMarshaler interface {
+	MarshalContext(ctx context.Context, e Event) (EventModel, error)
+	UnmarshalContext(ctx context.Context, model EventModel) (Event, error)
+}
+
+// ContextSnapshotMarshaler is the ContextEventMarshaler of snapshots
+type ContextSnapshotMarshaler interface {
+	MarshalContext(ctx context.Context, s Snapshot) (SnapshotModel, error)
+	UnmarshalContext(ctx context.Context, model SnapshotModel) (Snapshot, error)
+}
+
+// MarshalEvent marshals e with m, passing ctx along when m is a ContextEventMarshaler
+func MarshalEvent(ctx context.Context, m EventMarshaler, e Event) (EventModel, error) {
+	if cm, ok := m.(ContextEventMarshaler); ok {
+		return cm.MarshalContext(ctx, e)
+	}
+
+	return m.Marshal(e)
+}
+
+// UnmarshalEvent unmarshals model with m, passing ctx along when m is a ContextEventMarshaler
+func UnmarshalEvent(ctx context.Context, m EventMarshaler, model EventModel) (Event, error) {
+	if cm, ok := m.(ContextEventMarshaler); ok {
+		return cm.UnmarshalContext(ctx, model)
+	}
+
+	return m.Unmarshal(model)
+}
+
+func marshalSnapshotContext(ctx context.Context, m SnapshotMarshaler, s Snapshot) (SnapshotModel, error) {
+	if cm, ok := m.(ContextSnapshotMarshaler); ok {
+		return cm.MarshalContext(ctx, s)
+	}
+
+	return m.Marshal(s)
+}
+
+func unmarshalSnapshotContext(ctx context.Context, m SnapshotMarshaler, model SnapshotModel) (Snapshot, error) {
+	if cm, ok := m.(ContextSnapshotMarshaler); ok {
+		return cm.UnmarshalContext(ctx, model)
+	}
+
+	return m.Unmarshal(model)
+}
+
 type AggregateRootBase struct {
 	ID         string
 	streamSize int
 	stream     []Event
 	Version    int
+	persisted  bool
 }
 
 func (aggr *AggregateRootBase) AggregateRootID() string {
@@ -154,6 +283,23 @@ func (aggr *AggregateRootBase) GetVersion() int {
 	return aggr.Version
 }
 
+// versioned lets the repository correct the version of an aggregate
+// restored from a snapshot or saved, and tell whether it has a stream yet.
+// AggregateRootBase implements it.
+type versioned interface {
+	setVersion(v int)
+	stored() bool
+}
+
+func (aggr *AggregateRootBase) setVersion(v int) {
+	aggr.Version = v
+	aggr.persisted = true
+}
+
+func (aggr *AggregateRootBase) stored() bool {
+	return aggr.persisted
+}
+
 func (aggr *AggregateRootBase) Apply(aggregate AggregateRoot, e Event, isNew bool) error {
 	if isNew {
 		aggr.stream = append(aggr.stream, e)
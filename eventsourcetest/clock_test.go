@@ -0,0 +1,44 @@
+package eventsourcetest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestManualClock(t *testing.T) {
+	start := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+
+	now := clock.After(0)
+	minute := clock.After(time.Minute)
+	hour := clock.After(time.Hour)
+
+	if at := <-now; !at.Equal(start) {
+		t.Errorf("expected timers which are due to fire at once, got %v", at)
+	}
+
+	if clock.Timers() != 2 {
+		t.Fatalf("expected 2 pending timers, got %d", clock.Timers())
+	}
+
+	clock.Advance(time.Minute)
+
+	select {
+	case at := <-minute:
+		if !at.Equal(start.Add(time.Minute)) {
+			t.Errorf("expected the timer to fire at the new time, got %v", at)
+		}
+	default:
+		t.Fatal("expected the timer to fire once the clock advanced")
+	}
+
+	select {
+	case <-hour:
+		t.Fatal("expected the timer not to fire before it is due")
+	default:
+	}
+
+	if clock.Timers() != 1 || !clock.Now().Equal(start.Add(time.Minute)) {
+		t.Errorf("expected 1 pending timer at %v, got %d at %v", start.Add(time.Minute), clock.Timers(), clock.Now())
+	}
+}
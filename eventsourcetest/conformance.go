@@ -0,0 +1,367 @@
+package eventsourcetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/AhmadWaleed/eventsource"
+)
+
+// RunEventStoreTests verifies that the stores returned by factory behave like
+// the in-memory event store. Each test gets a new store from factory, stores
+// implementing eventsource.GlobalEventReader are checked for global ordering.
+func RunEventStoreTests(t *testing.T, factory func() eventsource.EventStore) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, store eventsource.EventStore)
+	}{
+		{"Ordering", testOrdering},
+		{"VersionFiltering", testVersionFiltering},
+		{"UnknownAggregate", testUnknownAggregate},
+		{"ExpectedVersion", testExpectedVersion},
+		{"ConcurrentWriters", testConcurrentWriters},
+		{"ContextCancellation", testContextCancellation},
+		{"Envelope", testEnvelope},
+		{"LargeStream", testLargeStream},
+		{"GlobalOrder", testGlobalOrder},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, factory())
+		})
+	}
+}
+
+// RunSnapshotStoreTests verifies that the stores returned by factory behave
+// like the in-memory snapshot store, each test gets a new store.
+func RunSnapshotStoreTests(t *testing.T, factory func() eventsource.SnapshotStore) {
+	t.Run("NearestVersion", func(t *testing.T) {
+		ctx := context.Background()
+		store := factory()
+
+		for _, version := range []int{2, 5, 9} {
+			model := eventsource.SnapshotModel{ID: "snap-1", Version: version, Data: payload(version)}
+			if err := store.SaveSnapshot(ctx, "snap-1", model, version); err != nil {
+				t.Fatalf("unable to save snapshot: %v", err)
+			}
+		}
+
+		for version, want := range map[int]int{2: 2, 4: 2, 5: 5, 8: 5, 9: 9, math.MaxInt32: 9} {
+			model, err := store.GetSnapshotForAggregate(ctx, "snap-1", version)
+			if err != nil {
+				t.Fatalf("unable to get snapshot at version %d: %v", version, err)
+			}
+
+			if model.Version != want || string(model.Data) != string(payload(want)) {
+				t.Errorf("expected snapshot %d at version %d, got %d with data %s", want, version, model.Version, model.Data)
+			}
+		}
+
+		if _, err := store.GetSnapshotForAggregate(ctx, "snap-1", 1); !errors.Is(err, eventsource.ErrSnapNotFound) {
+			t.Errorf("expected ErrSnapNotFound below the oldest snapshot, got %v", err)
+		}
+	})
+
+	t.Run("KeyedByParameters", func(t *testing.T) {
+		ctx := context.Background()
+		store := factory()
+
+		model := eventsource.SnapshotModel{ID: "other", Version: 1, Data: payload(3)}
+		if err := store.SaveSnapshot(ctx, "snap-2", model, 3); err != nil {
+			t.Fatalf("unable to save snapshot: %v", err)
+		}
+
+		got, err := store.GetSnapshotForAggregate(ctx, "snap-2", 3)
+		if err != nil {
+			t.Fatalf("expected the snapshot under the aggregate id passed to SaveSnapshot: %v", err)
+		}
+
+		if got.ID != "snap-2" || got.Version != 3 || string(got.Data) != string(payload(3)) {
+			t.Errorf("expected snapshot snap-2 at version 3, got %s at %d with data %s", got.ID, got.Version, got.Data)
+		}
+
+		if _, err := store.GetSnapshotForAggregate(ctx, "snap-2", 2); !errors.Is(err, eventsource.ErrSnapNotFound) {
+			t.Errorf("expected the snapshot to be saved at the version passed to SaveSnapshot, got %v", err)
+		}
+
+		if _, err := store.GetSnapshotForAggregate(ctx, "other", math.MaxInt32); !errors.Is(err, eventsource.ErrSnapNotFound) {
+			t.Errorf("expected nothing under the id of the model, got %v", err)
+		}
+
+		model.Data = payload(4)
+		if err := store.SaveSnapshot(ctx, "snap-2", model, 3); err != nil {
+			t.Fatalf("unable to overwrite snapshot: %v", err)
+		}
+
+		if got, err := store.GetSnapshotForAggregate(ctx, "snap-2", 3); err != nil || string(got.Data) != string(payload(4)) {
+			t.Errorf("expected the snapshot to be overwritten, got %s: %v", got.Data, err)
+		}
+	})
+
+	t.Run("UnknownAggregate", func(t *testing.T) {
+		_, err := factory().GetSnapshotForAggregate(context.Background(), "unknown", math.MaxInt32)
+		if !errors.Is(err, eventsource.ErrSnapNotFound) {
+			t.Errorf("expected ErrSnapNotFound, got %v", err)
+		}
+	})
+}
+
+func payload(n int) []byte {
+	return []byte(fmt.Sprintf(`{"n":%d}`, n))
+}
+
+func models(from, n int) eventsource.History {
+	history := make(eventsource.History, n)
+	for i := range history {
+		history[i] = eventsource.EventModel{
+			At:   eventsource.EpochMillis(1654084800000 + int64(from+i)),
+			Data: payload(from + i),
+		}
+	}
+
+	return history
+}
+
+func save(t *testing.T, store eventsource.EventStore, aggrID string, history eventsource.History, version int) {
+	t.Helper()
+
+	if err := store.SaveEvents(context.Background(), aggrID, history, version); err != nil {
+		t.Fatalf("unable to save events of %s at version %d: %v", aggrID, version, err)
+	}
+}
+
+func load(t *testing.T, store eventsource.EventStore, aggrID string, version int) eventsource.History {
+	t.Helper()
+
+	history, err := store.GetEventsForAggregate(context.Background(), aggrID, version)
+	if err != nil {
+		t.Fatalf("unable to get events of %s after version %d: %v", aggrID, version, err)
+	}
+
+	return history
+}
+
+// expectStream checks that history holds the events from..from+n-1 as saved by models
+func expectStream(t *testing.T, history eventsource.History, from, n int) {
+	t.Helper()
+
+	if len(history) != n {
+		t.Fatalf("expected %d events, got %d", n, len(history))
+	}
+
+	for i, m := range history {
+		version := from + i
+		if m.Version != version {
+			t.Fatalf("expected event %d to have version %d, got %d", i, version, m.Version)
+		}
+
+		if string(m.Data) != string(payload(version)) || m.At != eventsource.EpochMillis(1654084800000+int64(version)) {
+			t.Fatalf("event %d was not stored as saved, got data %s at %d", version, m.Data, m.At)
+		}
+	}
+}
+
+func testOrdering(t *testing.T, store eventsource.EventStore) {
+	save(t, store, "order-1", models(0, 3), eventsource.ExpectedVersionNoStream)
+	save(t, store, "order-2", models(0, 1), eventsource.ExpectedVersionNoStream)
+	save(t, store, "order-1", models(3, 2), 2)
+
+	expectStream(t, load(t, store, "order-1", eventsource.ExpectedVersionNoStream), 0, 5)
+	expectStream(t, load(t, store, "order-2", eventsource.ExpectedVersionNoStream), 0, 1)
+}
+
+func testVersionFiltering(t *testing.T, store eventsource.EventStore) {
+	save(t, store, "filter-1", models(0, 5), eventsource.ExpectedVersionNoStream)
+
+	expectStream(t, load(t, store, "filter-1", eventsource.ExpectedVersionNoStream), 0, 5)
+	expectStream(t, load(t, store, "filter-1", 0), 0, 5)
+	expectStream(t, load(t, store, "filter-1", 2), 3, 2)
+	expectStream(t, load(t, store, "filter-1", 4), 5, 0)
+}
+
+func testUnknownAggregate(t *testing.T, store eventsource.EventStore) {
+	_, err := store.GetEventsForAggregate(context.Background(), "unknown", eventsource.ExpectedVersionNoStream)
+	if !errors.Is(err, eventsource.ErrAggregateNotFound) {
+		t.Errorf("expected ErrAggregateNotFound, got %v", err)
+	}
+}
+
+func testExpectedVersion(t *testing.T, store eventsource.EventStore) {
+	ctx := context.Background()
+	save(t, store, "version-1", models(0, 2), eventsource.ExpectedVersionNoStream)
+
+	for _, version := range []int{eventsource.ExpectedVersionNoStream, 0, 2} {
+		err := store.SaveEvents(ctx, "version-1", models(2, 1), version)
+
+		var conflict *eventsource.ErrConcurrencyConflict
+		if !errors.As(err, &conflict) {
+			t.Fatalf("expected concurrency conflict saving at version %d, got %v", version, err)
+		}
+
+		if conflict.AggregateID != "version-1" || conflict.Expected != version || conflict.Actual != 1 {
+			t.Errorf("unexpected conflict saving at version %d: %+v", version, conflict)
+		}
+	}
+
+	save(t, store, "version-1", models(2, 1), eventsource.ExpectedVersionAny)
+	save(t, store, "version-1", models(3, 1), 2)
+
+	expectStream(t, load(t, store, "version-1", eventsource.ExpectedVersionNoStream), 0, 4)
+}
+
+func testConcurrentWriters(t *testing.T, store eventsource.EventStore) {
+	save(t, store, "race-1", models(0, 1), eventsource.ExpectedVersionNoStream)
+
+	const writers = 10
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		succeeded int
+	)
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := store.SaveEvents(context.Background(), "race-1", models(1, 2), 0)
+
+			var conflict *eventsource.ErrConcurrencyConflict
+			if err != nil && !errors.As(err, &conflict) {
+				t.Errorf("expected concurrency conflict, got %v", err)
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				succeeded++
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if succeeded != 1 {
+		t.Errorf("expected exactly 1 writer to succeed, got %d", succeeded)
+	}
+
+	expectStream(t, load(t, store, "race-1", eventsource.ExpectedVersionNoStream), 0, 3)
+}
+
+func testContextCancellation(t *testing.T, store eventsource.EventStore) {
+	save(t, store, "cancel-1", models(0, 1), eventsource.ExpectedVersionNoStream)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := store.SaveEvents(ctx, "cancel-1", models(1, 1), 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled saving events, got %v", err)
+	}
+
+	if _, err := store.GetEventsForAggregate(ctx, "cancel-1", eventsource.ExpectedVersionNoStream); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled loading events, got %v", err)
+	}
+
+	expectStream(t, load(t, store, "cancel-1", eventsource.ExpectedVersionNoStream), 0, 1)
+}
+
+func testEnvelope(t *testing.T, store eventsource.EventStore) {
+	history := models(0, 2)
+	history[0].ID = eventsource.NewEventID()
+	history[0].Metadata = eventsource.Metadata{eventsource.MetadataCorrelationID: "corr-1", "tenant": "acme"}
+	save(t, store, "envelope-1", history, eventsource.ExpectedVersionNoStream)
+
+	if history[1].ID != "" {
+		t.Errorf("expected the models of the caller to be left untouched, got event id %q", history[1].ID)
+	}
+
+	loaded := load(t, store, "envelope-1", eventsource.ExpectedVersionNoStream)
+	if loaded[0].ID != history[0].ID {
+		t.Errorf("expected event id %s, got %s", history[0].ID, loaded[0].ID)
+	}
+
+	for k, v := range history[0].Metadata {
+		if loaded[0].Metadata[k] != v {
+			t.Errorf("expected metadata %s=%s, got %v", k, v, loaded[0].Metadata)
+		}
+	}
+
+	if loaded[1].ID == "" || loaded[1].ID == loaded[0].ID {
+		t.Errorf("expected store to assign a unique event id, got %q", loaded[1].ID)
+	}
+}
+
+func testLargeStream(t *testing.T, store eventsource.EventStore) {
+	const batch, batches = 100, 20
+
+	version := eventsource.ExpectedVersionNoStream
+	for i := 0; i < batches; i++ {
+		save(t, store, "large-1", models(i*batch, batch), version)
+		version += batch
+	}
+
+	expectStream(t, load(t, store, "large-1", eventsource.ExpectedVersionNoStream), 0, batch*batches)
+	expectStream(t, load(t, store, "large-1", batch*batches-11), batch*batches-10, 10)
+}
+
+func testGlobalOrder(t *testing.T, store eventsource.EventStore) {
+	reader, ok := store.(eventsource.GlobalEventReader)
+	if !ok {
+		t.Skipf("%T do not implement GlobalEventReader", store)
+	}
+
+	ctx := context.Background()
+	start, err := reader.ReadAll(ctx, 0, 0)
+	if err != nil {
+		t.Fatalf("unable to read all events: %v", err)
+	}
+
+	var from int64
+	if len(start) > 0 {
+		from = start[len(start)-1].Offset
+	}
+
+	save(t, store, "global-1", models(0, 2), eventsource.ExpectedVersionNoStream)
+	save(t, store, "global-2", models(0, 1), eventsource.ExpectedVersionNoStream)
+	save(t, store, "global-1", models(2, 1), 1)
+
+	want := []struct {
+		aggrID  string
+		version int
+	}{{"global-1", 0}, {"global-1", 1}, {"global-2", 0}, {"global-1", 2}}
+
+	events, err := reader.ReadAll(ctx, from, 0)
+	if err != nil {
+		t.Fatalf("unable to read all events: %v", err)
+	}
+
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events, got %d", len(want), len(events))
+	}
+
+	for i, e := range events {
+		if e.AggregateID != want[i].aggrID || e.Version != want[i].version {
+			t.Errorf("expected %s@%d at position %d, got %s@%d", want[i].aggrID, want[i].version, i, e.AggregateID, e.Version)
+		}
+
+		if i > 0 && e.Offset <= events[i-1].Offset {
+			t.Errorf("expected increasing offsets, got %d after %d", e.Offset, events[i-1].Offset)
+		}
+	}
+
+	page, err := reader.ReadAll(ctx, events[0].Offset, 2)
+	if err != nil {
+		t.Fatalf("unable to read all events: %v", err)
+	}
+
+	if len(page) != 2 || page[0].Offset != events[1].Offset || page[1].Offset != events[2].Offset {
+		t.Errorf("expected a page of the 2 events after offset %d, got %+v", events[0].Offset, page)
+	}
+}
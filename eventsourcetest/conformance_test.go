@@ -0,0 +1,15 @@
+package eventsourcetest
+
+import (
+	"testing"
+
+	"github.com/AhmadWaleed/eventsource"
+)
+
+func TestInmemEventStore(t *testing.T) {
+	RunEventStoreTests(t, eventsource.NewInmemEventStore)
+}
+
+func TestInmemSnapStore(t *testing.T) {
+	RunSnapshotStoreTests(t, eventsource.NewInmemSnapStore)
+}
@@ -0,0 +1,217 @@
+// Package eventsourcetest provides helpers to test event sourced aggregates
+// without wiring a repository, marshaler or event store.
+package eventsourcetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/AhmadWaleed/eventsource"
+)
+
+// Scenario describes an aggregate test in given/when/then form
+//
+//	eventsourcetest.For(t, &Shipment{}).
+//		Given(&ShipmentPacked{...}).
+//		When(PickupShipment{...}).
+//		Then(&ShipmentPickedUp{...})
+//
+// Events are compared ignoring the At time and envelope of EventSkeleton,
+// which are usually set by the handler at the time the command is handled.
+type Scenario struct {
+	t         TB
+	ctx       context.Context
+	aggregate eventsource.AggregateRoot
+	given     []eventsource.Event
+	cmd       interface{}
+}
+
+// TB is the subset of testing.TB used by Scenario
+type TB interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+	Fatalf(format string, args ...interface{})
+}
+
+// For starts a scenario for a new aggregate which must implement eventsource.AggregateHandler
+func For(t TB, aggregate eventsource.AggregateRoot) *Scenario {
+	return &Scenario{
+		t:         t,
+		ctx:       context.Background(),
+		aggregate: aggregate,
+	}
+}
+
+// WithContext sets the context the command is handled with
+func (s *Scenario) WithContext(ctx context.Context) *Scenario {
+	s.ctx = ctx
+	return s
+}
+
+// Given sets the events the aggregate is loaded from before the command
+func (s *Scenario) Given(events ...eventsource.Event) *Scenario {
+	s.given = append(s.given, events...)
+	return s
+}
+
+// When sets the command sent to the aggregate
+func (s *Scenario) When(cmd interface{}) *Scenario {
+	s.cmd = cmd
+	return s
+}
+
+// Then asserts that the command is handled and produces exactly the expected events
+func (s *Scenario) Then(expected ...eventsource.Event) {
+	s.t.Helper()
+
+	actual, err := s.run()
+	if err != nil {
+		s.t.Errorf("expected events, got error: %v", err)
+		return
+	}
+
+	if diff := diffEvents(expected, actual); diff != "" {
+		s.t.Errorf("unexpected events:\n%s", diff)
+	}
+}
+
+// ThenError asserts that the command fails with the expected error, matched
+// with errors.Is or by message, without producing any event.
+func (s *Scenario) ThenError(expected error) {
+	s.t.Helper()
+
+	actual, err := s.run()
+	if err == nil {
+		s.t.Errorf("expected error %q, got events:\n%s", expected, formatEvents(actual))
+		return
+	}
+
+	if !errors.Is(err, expected) && err.Error() != expected.Error() {
+		s.t.Errorf("expected error %q, got %q", expected, err)
+	}
+
+	if len(actual) > 0 {
+		s.t.Errorf("expected no events along with the error, got:\n%s", formatEvents(actual))
+	}
+}
+
+// Aggregate returns the aggregate, after Then it holds the state following the command
+func (s *Scenario) Aggregate() eventsource.AggregateRoot {
+	return s.aggregate
+}
+
+func (s *Scenario) run() ([]eventsource.Event, error) {
+	s.t.Helper()
+
+	handler, ok := s.aggregate.(eventsource.AggregateHandler)
+	if !ok {
+		s.t.Fatalf("%T do not implement CommandHandler", s.aggregate)
+	}
+
+	if s.cmd == nil {
+		s.t.Fatalf("no command given, call When before Then")
+	}
+
+	if err := s.aggregate.LoadFromHistory(s.aggregate, s.given); err != nil {
+		s.t.Fatalf("unable to apply given events: %v", err)
+	}
+
+	err := handler.Handle(s.ctx, s.cmd)
+	events := s.aggregate.GetUncommitedEvents()
+	s.aggregate.CommitEvents()
+
+	return events, err
+}
+
+// diffEvents describes the differences between the expected and
+// actual events, an empty string means they are equal.
+func diffEvents(expected, actual []eventsource.Event) string {
+	var b strings.Builder
+
+	n := len(expected)
+	if len(actual) > n {
+		n = len(actual)
+	}
+
+	for i := 0; i < n; i++ {
+		switch {
+		case i >= len(actual):
+			fmt.Fprintf(&b, "  %d: missing %s\n", i, formatEvent(expected[i]))
+		case i >= len(expected):
+			fmt.Fprintf(&b, "  %d: unexpected %s\n", i, formatEvent(actual[i]))
+		default:
+			e, a := normalize(expected[i]), normalize(actual[i])
+			if reflect.TypeOf(e) != reflect.TypeOf(a) {
+				fmt.Fprintf(&b, "  %d: expected %s\n     got %s\n", i, formatEvent(expected[i]), formatEvent(actual[i]))
+			} else if !reflect.DeepEqual(e, a) {
+				fmt.Fprintf(&b, "  %d: %T\n", i, expected[i])
+				diffFields(&b, "", reflect.ValueOf(e), reflect.ValueOf(a))
+			}
+		}
+	}
+
+	return b.String()
+}
+
+// diffFields writes the struct fields which are different between e and a
+func diffFields(b *strings.Builder, prefix string, e, a reflect.Value) {
+	if e.Kind() != reflect.Struct {
+		fmt.Fprintf(b, "     %s: expected %#v, got %#v\n", strings.TrimPrefix(prefix, "."), e.Interface(), a.Interface())
+		return
+	}
+
+	for i := 0; i < e.NumField(); i++ {
+		field := e.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		ef, af := e.Field(i), a.Field(i)
+		if !reflect.DeepEqual(ef.Interface(), af.Interface()) {
+			diffFields(b, prefix+"."+field.Name, ef, af)
+		}
+	}
+}
+
+// normalize returns the event struct value with the
+// EventSkeleton time and envelope cleared.
+func normalize(e eventsource.Event) interface{} {
+	v := reflect.ValueOf(e)
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+
+	if v.Kind() != reflect.Struct {
+		return v.Interface()
+	}
+
+	cp := reflect.New(v.Type()).Elem()
+	cp.Set(v)
+
+	skeleton := reflect.TypeOf(eventsource.EventSkeleton{})
+	for i := 0; i < cp.NumField(); i++ {
+		if cp.Type().Field(i).Type == skeleton && cp.Field(i).CanSet() {
+			cp.Field(i).FieldByName("At").Set(reflect.ValueOf(time.Time{}))
+			cp.Field(i).FieldByName("Envelope").Set(reflect.ValueOf(eventsource.Envelope{}))
+		}
+	}
+
+	return cp.Interface()
+}
+
+func formatEvent(e eventsource.Event) string {
+	return fmt.Sprintf("%T%+v", e, normalize(e))
+}
+
+func formatEvents(events []eventsource.Event) string {
+	var b strings.Builder
+	for i, e := range events {
+		fmt.Fprintf(&b, "  %d: %s\n", i, formatEvent(e))
+	}
+
+	return b.String()
+}
@@ -0,0 +1,130 @@
+package eventsourcetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AhmadWaleed/eventsource"
+)
+
+var errAlreadyOpen = errors.New("account already open")
+
+type AccountOpened struct {
+	eventsource.EventSkeleton
+	Owner string
+}
+
+type MoneyDeposited struct {
+	eventsource.EventSkeleton
+	Amount int
+}
+
+type OpenAccount struct {
+	eventsource.Command
+	Owner string
+}
+
+type Deposit struct {
+	eventsource.Command
+	Amount int
+}
+
+type Account struct {
+	eventsource.AggregateRootBase
+	Balance int
+}
+
+func (a *Account) Handle(ctx context.Context, v interface{}) error {
+	switch cmd := v.(type) {
+	case OpenAccount:
+		if a.ID != "" {
+			return errAlreadyOpen
+		}
+		return a.Apply(a, &AccountOpened{eventsource.EventSkeleton{ID: cmd.AggregateID(), At: time.Now()}, cmd.Owner}, true)
+	case Deposit:
+		return a.Apply(a, &MoneyDeposited{eventsource.EventSkeleton{ID: cmd.AggregateID(), At: time.Now()}, cmd.Amount}, true)
+	default:
+		return fmt.Errorf("unexpected command %T", cmd)
+	}
+}
+
+func (a *Account) On(e eventsource.Event) error {
+	switch v := e.(type) {
+	case *AccountOpened:
+		a.ID = v.AggregateID()
+	case *MoneyDeposited:
+		a.Balance += v.Amount
+	default:
+		return fmt.Errorf("unexpected event %T", e)
+	}
+
+	return nil
+}
+
+func skeleton(id string) eventsource.EventSkeleton {
+	return eventsource.EventSkeleton{ID: id}
+}
+
+// recorder captures failures instead of failing the test
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestScenario(t *testing.T) {
+	For(t, &Account{}).
+		When(OpenAccount{eventsource.Command{ID: "acc-1"}, "jane"}).
+		Then(&AccountOpened{skeleton("acc-1"), "jane"})
+
+	s := For(t, &Account{}).
+		Given(&AccountOpened{skeleton("acc-1"), "jane"}, &MoneyDeposited{skeleton("acc-1"), 10}).
+		When(Deposit{eventsource.Command{ID: "acc-1"}, 5})
+	s.Then(&MoneyDeposited{skeleton("acc-1"), 5})
+
+	if balance := s.Aggregate().(*Account).Balance; balance != 15 {
+		t.Errorf("expected balance 15, got %d", balance)
+	}
+
+	For(t, &Account{}).
+		Given(&AccountOpened{skeleton("acc-1"), "jane"}).
+		When(OpenAccount{eventsource.Command{ID: "acc-1"}, "john"}).
+		ThenError(errAlreadyOpen)
+}
+
+func TestScenarioReportsDifferences(t *testing.T) {
+	r := &recorder{TB: t}
+
+	For(r, &Account{}).
+		Given(&AccountOpened{skeleton("acc-1"), "jane"}).
+		When(Deposit{eventsource.Command{ID: "acc-1"}, 5}).
+		Then(&MoneyDeposited{skeleton("acc-1"), 7}, &MoneyDeposited{skeleton("acc-1"), 1})
+
+	if len(r.errors) != 1 {
+		t.Fatalf("expected 1 failure, got %v", r.errors)
+	}
+
+	for _, want := range []string{"Amount: expected 7, got 5", "1: missing *eventsourcetest.MoneyDeposited"} {
+		if !strings.Contains(r.errors[0], want) {
+			t.Errorf("expected failure to contain %q, got:\n%s", want, r.errors[0])
+		}
+	}
+
+	r.errors = nil
+	For(r, &Account{}).
+		When(OpenAccount{eventsource.Command{ID: "acc-1"}, "jane"}).
+		ThenError(errAlreadyOpen)
+
+	if len(r.errors) != 1 || !strings.Contains(r.errors[0], "got events") {
+		t.Errorf("expected failure listing the produced events, got %v", r.errors)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package eventstore
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// lockDir only creates the lock file of dir, the directory is not locked
+// on this platform.
+func lockDir(dir string) (*os.File, error) {
+	return os.OpenFile(filepath.Join(dir, lockFile), os.O_RDWR|os.O_CREATE, 0o644)
+}
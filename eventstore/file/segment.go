@@ -0,0 +1,189 @@
+package eventstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AhmadWaleed/eventsource"
+)
+
+// Records are framed as a 4 bytes length and a 4 bytes CRC-32C of the
+// payload followed by the JSON encoded payload, all little endian.
+const headerSize = 8
+
+const (
+	segmentExt = ".seg"
+	indexFile  = "index"
+	lockFile   = "LOCK"
+)
+
+const (
+	kindEvent    = "event"
+	kindSnapshot = "snapshot"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errTorn is returned when a record is incomplete or does not match its CRC
+var errTorn = errors.New("torn record")
+
+// record is an event or a snapshot as appended to a segment
+type record struct {
+	Kind        string                  `json:"kind"`
+	AggregateID string                  `json:"aggregate_id"`
+	Version     int                     `json:"version"`
+	Offset      int64                   `json:"offset,omitempty"`
+	ID          string                  `json:"id,omitempty"`
+	Metadata    eventsource.Metadata    `json:"metadata,omitempty"`
+	At          eventsource.EpochMillis `json:"at,omitempty"`
+	Data        []byte                  `json:"data"`
+}
+
+// location is the position of a framed record in a segment
+type location struct {
+	Segment int64 `json:"segment"`
+	Pos     int64 `json:"pos"`
+	Size    int64 `json:"size"`
+}
+
+func (l location) end() int64 {
+	return l.Pos + l.Size
+}
+
+// indexEntry locates a record, the index holds one entry per record
+type indexEntry struct {
+	Kind        string `json:"kind"`
+	AggregateID string `json:"aggregate_id"`
+	Version     int    `json:"version"`
+	Offset      int64  `json:"offset,omitempty"`
+	location
+}
+
+func frame(buf []byte, v interface{}) ([]byte, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var header [headerSize]byte
+	binary.LittleEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.Checksum(payload, crcTable))
+
+	return append(append(buf, header[:]...), payload...), nil
+}
+
+// unframe returns the payload of the framed record in data
+func unframe(data []byte) ([]byte, error) {
+	if len(data) < headerSize {
+		return nil, errTorn
+	}
+
+	n := binary.LittleEndian.Uint32(data[:4])
+	payload := data[headerSize:]
+	if uint32(len(payload)) != n || crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(data[4:headerSize]) {
+		return nil, errTorn
+	}
+
+	return payload, nil
+}
+
+// scan reads the records of f from pos until its end or a torn record, it
+// returns the end of the last valid record.
+func scan(f *os.File, pos int64, fn func(loc location, payload []byte) error) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return pos, err
+	}
+
+	r := bufio.NewReaderSize(io.NewSectionReader(f, pos, info.Size()-pos), 1<<16)
+
+	var header [headerSize]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				return pos, nil
+			}
+
+			return pos, errTorn
+		}
+
+		n := binary.LittleEndian.Uint32(header[:4])
+		if int64(n) > info.Size()-pos-headerSize {
+			return pos, errTorn
+		}
+
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return pos, errTorn
+		}
+
+		if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:]) {
+			return pos, errTorn
+		}
+
+		loc := location{Pos: pos, Size: headerSize + int64(n)}
+		if err := fn(loc, payload); err != nil {
+			return pos, err
+		}
+
+		pos = loc.end()
+	}
+}
+
+func readRecord(f *os.File, loc location) (record, error) {
+	data := make([]byte, loc.Size)
+	if _, err := f.ReadAt(data, loc.Pos); err != nil {
+		return record{}, fmt.Errorf("unable to read record at %d of segment %d: %v", loc.Pos, loc.Segment, err)
+	}
+
+	payload, err := unframe(data)
+	if err != nil {
+		return record{}, fmt.Errorf("corrupted record at %d of segment %d", loc.Pos, loc.Segment)
+	}
+
+	var rec record
+	err = json.Unmarshal(payload, &rec)
+
+	return rec, err
+}
+
+func segmentPath(dir string, id int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+// listSegments returns the ids of the segments in dir in ascending order
+func listSegments(dir string) ([]int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		id, err := strconv.ParseInt(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids, nil
+}
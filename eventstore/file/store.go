@@ -0,0 +1,755 @@
+package eventstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AhmadWaleed/eventsource"
+)
+
+// SyncPolicy decides when appended records are flushed to disk with fsync
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes every append before it returns, it is the default
+	SyncAlways SyncPolicy = iota
+
+	// SyncInterval flushes every sync interval, appends made since the last
+	// flush may be lost when the machine crashes.
+	SyncInterval
+
+	// SyncNever leaves flushing to the operating system
+	SyncNever
+)
+
+type StoreOption func(s *Store)
+
+// WithSyncPolicy sets when appends are flushed to disk
+func WithSyncPolicy(p SyncPolicy) StoreOption {
+	return func(s *Store) {
+		s.syncPolicy = p
+	}
+}
+
+// WithSyncInterval flushes appends every d, see SyncInterval
+func WithSyncInterval(d time.Duration) StoreOption {
+	return func(s *Store) {
+		s.syncPolicy = SyncInterval
+		s.syncInterval = d
+	}
+}
+
+// WithSegmentSize sets the size after which a new segment is started, 64MB by default
+func WithSegmentSize(n int64) StoreOption {
+	return func(s *Store) {
+		s.segmentSize = n
+	}
+}
+
+// NewStore opens the store kept in dir, creating it when missing. Records
+// torn by a crash at the end of the last segment are truncated and the
+// index is completed with the records it is missing.
+func NewStore(dir string, opts ...StoreOption) (*Store, error) {
+	s := &Store{
+		dir:          dir,
+		segmentSize:  64 << 20,
+		syncPolicy:   SyncAlways,
+		syncInterval: time.Second,
+		segments:     make(map[int64]*os.File),
+		streams:      make(map[string][]int64),
+		snapshots:    make(map[string][]snapshotEntry),
+		listeners:    make(map[chan struct{}]struct{}),
+		done:         make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s.lock = lock
+
+	if err := s.open(); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+
+	if s.syncPolicy == SyncInterval {
+		s.wg.Add(1)
+		go s.syncLoop()
+	}
+
+	return s, nil
+}
+
+// Store is an append-only event and snapshot store kept in segment files,
+// it implements eventsource.EventStore, eventsource.SnapshotStore,
+// eventsource.GlobalEventReader and eventsource.EventNotifier. A directory
+// is opened by a single Store at a time, NewStore fails while another
+// Store holds its lock file.
+type Store struct {
+	dir          string
+	segmentSize  int64
+	syncPolicy   SyncPolicy
+	syncInterval time.Duration
+
+	mu         sync.RWMutex
+	segments   map[int64]*os.File
+	active     int64
+	activeSize int64
+	index      *os.File
+	indexSize  int64
+	dirty      bool
+	closed     bool
+	lock       *os.File
+
+	// log holds the location of each event by offset-1, streams the
+	// offsets of the events of each aggregate by version.
+	log       []eventEntry
+	streams   map[string][]int64
+	snapshots map[string][]snapshotEntry
+
+	listeners map[chan struct{}]struct{}
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+type eventEntry struct {
+	aggregateID string
+	location
+}
+
+type snapshotEntry struct {
+	version int
+	location
+}
+
+func (s *Store) SaveEvents(ctx context.Context, aggrID string, models eventsource.History, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errors.New("store closed")
+	}
+
+	actual := len(s.streams[aggrID]) - 1
+	if version != eventsource.ExpectedVersionAny && version != actual {
+		return &eventsource.ErrConcurrencyConflict{AggregateID: aggrID, Expected: version, Actual: actual}
+	}
+
+	if len(models) == 0 {
+		return nil
+	}
+
+	records := make([]record, len(models))
+	for i, m := range models {
+		if m.ID == "" {
+			m.ID = eventsource.NewEventID()
+		}
+
+		records[i] = record{
+			Kind:        kindEvent,
+			AggregateID: aggrID,
+			Version:     actual + 1 + i,
+			Offset:      int64(len(s.log) + 1 + i),
+			ID:          m.ID,
+			Metadata:    m.Metadata,
+			At:          m.At,
+			Data:        m.Data,
+		}
+	}
+
+	entries, err := s.append(records)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		s.apply(e)
+	}
+
+	for ch := range s.listeners {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) GetEventsForAggregate(ctx context.Context, aggrID string, version int) (eventsource.History, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	offsets, ok := s.streams[aggrID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", eventsource.ErrAggregateNotFound, aggrID)
+	}
+
+	// 0 returns the whole stream, see eventsource.EventStore
+	if version == 0 {
+		version = eventsource.ExpectedVersionNoStream
+	}
+
+	// versions start at 0 and follow each other
+	if version+1 > 0 {
+		if version+1 >= len(offsets) {
+			return nil, nil
+		}
+
+		offsets = offsets[version+1:]
+	}
+
+	history := make(eventsource.History, 0, len(offsets))
+	for _, offset := range offsets {
+		rec, err := s.read(s.log[offset-1].location)
+		if err != nil {
+			return nil, err
+		}
+
+		history = append(history, eventModel(rec))
+	}
+
+	return history, nil
+}
+
+// ReadAll returns up to limit events after fromOffset, 0 for no limit
+func (s *Store) ReadAll(ctx context.Context, fromOffset int64, limit int) ([]eventsource.RecordedEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if fromOffset < 0 {
+		fromOffset = 0
+	}
+
+	if fromOffset >= int64(len(s.log)) {
+		return nil, nil
+	}
+
+	entries := s.log[fromOffset:]
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	events := make([]eventsource.RecordedEvent, len(entries))
+	for i, e := range entries {
+		rec, err := s.read(e.location)
+		if err != nil {
+			return nil, err
+		}
+
+		events[i] = eventsource.RecordedEvent{
+			EventModel:  eventModel(rec),
+			Offset:      rec.Offset,
+			AggregateID: rec.AggregateID,
+		}
+	}
+
+	return events, nil
+}
+
+func (s *Store) Notifications(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+
+	s.mu.Lock()
+	s.listeners[ch] = struct{}{}
+	s.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		s.mu.Lock()
+		delete(s.listeners, ch)
+		s.mu.Unlock()
+	}()
+
+	return ch
+}
+
+func (s *Store) SaveSnapshot(ctx context.Context, aggrID string, model eventsource.SnapshotModel, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errors.New("store closed")
+	}
+
+	entries, err := s.append([]record{{
+		Kind:        kindSnapshot,
+		AggregateID: aggrID,
+		Version:     version,
+		Data:        model.Data,
+	}})
+	if err != nil {
+		return err
+	}
+
+	s.apply(entries[0])
+
+	return nil
+}
+
+// GetSnapshotForAggregate returns the newest snapshot at or below version
+func (s *Store) GetSnapshotForAggregate(ctx context.Context, aggrID string, version int) (eventsource.SnapshotModel, error) {
+	if err := ctx.Err(); err != nil {
+		return eventsource.SnapshotModel{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshots := s.snapshots[aggrID]
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if snapshots[i].version > version {
+			continue
+		}
+
+		rec, err := s.read(snapshots[i].location)
+		if err != nil {
+			return eventsource.SnapshotModel{}, err
+		}
+
+		return eventsource.SnapshotModel{ID: aggrID, Version: rec.Version, Data: rec.Data}, nil
+	}
+
+	return eventsource.SnapshotModel{}, eventsource.ErrSnapNotFound
+}
+
+// Sync flushes the appended records to disk
+func (s *Store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sync()
+}
+
+// Close flushes and closes the segment files
+func (s *Store) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.closed = true
+	close(s.done)
+	err := s.sync()
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	if cerr := s.closeFiles(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// append writes records to the active segment and their entries to the
+// index, the active segment is rotated beforehand once it is full.
+func (s *Store) append(records []record) ([]indexEntry, error) {
+	if s.activeSize >= s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		buf     []byte
+		entries = make([]indexEntry, len(records))
+		pos     = s.activeSize
+	)
+
+	for i, rec := range records {
+		var err error
+		start := len(buf)
+		if buf, err = frame(buf, rec); err != nil {
+			return nil, err
+		}
+
+		entries[i] = indexEntry{
+			Kind:        rec.Kind,
+			AggregateID: rec.AggregateID,
+			Version:     rec.Version,
+			Offset:      rec.Offset,
+			location:    location{Segment: s.active, Pos: pos + int64(start), Size: int64(len(buf) - start)},
+		}
+	}
+
+	f := s.segments[s.active]
+	if _, err := f.WriteAt(buf, pos); err != nil {
+		// drop what was written of the batch, it was not acknowledged
+		f.Truncate(pos)
+		return nil, fmt.Errorf("unable to append to segment %d: %v", s.active, err)
+	}
+	s.dirty = true
+
+	// the segment is flushed first so the index never points past it
+	indexSize := s.indexSize
+	if err := s.commit(f, entries); err != nil {
+		// the offsets of the batch are handed out again by the next append,
+		// so neither file may keep records of it.
+		f.Truncate(pos)
+		s.index.Truncate(indexSize)
+		s.indexSize = indexSize
+		return nil, err
+	}
+	s.activeSize += int64(len(buf))
+
+	return entries, nil
+}
+
+// commit flushes the segment written to, then indexes the entries of the
+// records appended to it.
+func (s *Store) commit(f *os.File, entries []indexEntry) error {
+	if s.syncPolicy == SyncAlways {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.writeIndex(entries); err != nil {
+		return err
+	}
+
+	if s.syncPolicy == SyncAlways {
+		if err := s.index.Sync(); err != nil {
+			return err
+		}
+
+		s.dirty = false
+	}
+
+	return nil
+}
+
+func (s *Store) writeIndex(entries []indexEntry) error {
+	var buf []byte
+	for _, e := range entries {
+		var err error
+		if buf, err = frame(buf, e); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.index.WriteAt(buf, s.indexSize); err != nil {
+		// the index is completed from the segments when the store is opened again
+		s.index.Truncate(s.indexSize)
+		return fmt.Errorf("unable to write index: %v", err)
+	}
+	s.indexSize += int64(len(buf))
+	s.dirty = true
+
+	return nil
+}
+
+func (s *Store) rotate() error {
+	if err := s.segments[s.active].Sync(); err != nil {
+		return err
+	}
+
+	id := s.active + 1
+	f, err := os.OpenFile(segmentPath(s.dir, id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+
+	s.segments[id] = f
+	s.active, s.activeSize = id, 0
+
+	return syncDir(s.dir)
+}
+
+func (s *Store) sync() error {
+	if !s.dirty {
+		return nil
+	}
+
+	if err := s.segments[s.active].Sync(); err != nil {
+		return err
+	}
+
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+
+	s.dirty = false
+
+	return nil
+}
+
+func (s *Store) syncLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			s.sync()
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *Store) read(loc location) (record, error) {
+	f, ok := s.segments[loc.Segment]
+	if !ok {
+		return record{}, fmt.Errorf("segment %d not found", loc.Segment)
+	}
+
+	return readRecord(f, loc)
+}
+
+// apply adds the record located by e to the in-memory index
+func (s *Store) apply(e indexEntry) {
+	switch e.Kind {
+	case kindEvent:
+		s.log = append(s.log, eventEntry{aggregateID: e.AggregateID, location: e.location})
+		s.streams[e.AggregateID] = append(s.streams[e.AggregateID], e.Offset)
+	case kindSnapshot:
+		snapshots := s.snapshots[e.AggregateID]
+
+		// a snapshot saved again at a version replaces the previous one
+		i := sort.Search(len(snapshots), func(i int) bool { return snapshots[i].version >= e.Version })
+		if i < len(snapshots) && snapshots[i].version == e.Version {
+			snapshots[i].location = e.location
+		} else {
+			snapshots = append(snapshots, snapshotEntry{})
+			copy(snapshots[i+1:], snapshots[i:])
+			snapshots[i] = snapshotEntry{version: e.Version, location: e.location}
+		}
+
+		s.snapshots[e.AggregateID] = snapshots
+	}
+}
+
+// valid reports whether e follows the entries applied so far
+func (s *Store) valid(e indexEntry) bool {
+	switch e.Kind {
+	case kindEvent:
+		return e.Offset == int64(len(s.log)+1) && e.Version == len(s.streams[e.AggregateID])
+	case kindSnapshot:
+		return true
+	}
+
+	return false
+}
+
+// open loads the index, verifies it against the segments and recovers the
+// records appended after the last indexed one.
+func (s *Store) open() error {
+	ids, err := listSegments(s.dir)
+	if err != nil {
+		return err
+	}
+
+	if len(ids) == 0 {
+		ids = []int64{0}
+	}
+
+	sizes := make(map[int64]int64)
+	for _, id := range ids {
+		f, err := os.OpenFile(segmentPath(s.dir, id), os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			return err
+		}
+		s.segments[id] = f
+
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		sizes[id] = info.Size()
+	}
+	s.active = ids[len(ids)-1]
+
+	if s.index, err = os.OpenFile(filepath.Join(s.dir, indexFile), os.O_RDWR|os.O_CREATE, 0o644); err != nil {
+		return err
+	}
+
+	resume := location{Segment: ids[0]}
+	s.indexSize, err = scan(s.index, 0, func(_ location, payload []byte) error {
+		var e indexEntry
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return errTorn
+		}
+
+		size, ok := sizes[e.Segment]
+		if !ok || e.end() > size || !s.valid(e) {
+			return errTorn
+		}
+
+		s.apply(e)
+		resume = e.location
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, errTorn) {
+		return err
+	}
+
+	// the last indexed record may have been lost with the segment tail
+	if resume.Size > 0 {
+		if _, err := s.read(resume); err != nil {
+			return s.rebuild(ids)
+		}
+	}
+
+	if err := s.index.Truncate(s.indexSize); err != nil {
+		return err
+	}
+
+	resume.Pos, resume.Size = resume.end(), 0
+
+	return s.recover(ids, resume)
+}
+
+// rebuild recreates the index from all the segments
+func (s *Store) rebuild(ids []int64) error {
+	s.log = nil
+	s.streams = make(map[string][]int64)
+	s.snapshots = make(map[string][]snapshotEntry)
+	s.indexSize = 0
+
+	if err := s.index.Truncate(0); err != nil {
+		return err
+	}
+
+	return s.recover(ids, location{Segment: ids[0]})
+}
+
+// recover indexes the records of the segments from resume, a torn record
+// at the end of the last segment is truncated.
+func (s *Store) recover(ids []int64, resume location) error {
+	for _, id := range ids {
+		if id < resume.Segment {
+			continue
+		}
+
+		pos := int64(0)
+		if id == resume.Segment {
+			pos = resume.Pos
+		}
+
+		var entries []indexEntry
+		end, err := scan(s.segments[id], pos, func(loc location, payload []byte) error {
+			var rec record
+			if err := json.Unmarshal(payload, &rec); err != nil {
+				return errTorn
+			}
+
+			loc.Segment = id
+			e := indexEntry{Kind: rec.Kind, AggregateID: rec.AggregateID, Version: rec.Version, Offset: rec.Offset, location: loc}
+			if !s.valid(e) {
+				return fmt.Errorf("record at %d of segment %d is out of sequence", loc.Pos, id)
+			}
+
+			s.apply(e)
+			entries = append(entries, e)
+
+			return nil
+		})
+
+		if errors.Is(err, errTorn) {
+			if id != ids[len(ids)-1] {
+				return fmt.Errorf("segment %d is corrupted at %d", id, end)
+			}
+
+			if err := s.segments[id].Truncate(end); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+
+		if err := s.writeIndex(entries); err != nil {
+			return err
+		}
+
+		if id == s.active {
+			s.activeSize = end
+		}
+	}
+
+	return s.sync()
+}
+
+func (s *Store) closeFiles() error {
+	var err error
+	for _, f := range s.segments {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	if s.index != nil {
+		if cerr := s.index.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	// closing the lock file releases the lock
+	if s.lock != nil {
+		if cerr := s.lock.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+func eventModel(rec record) eventsource.EventModel {
+	return eventsource.EventModel{
+		ID:       rec.ID,
+		Metadata: rec.Metadata,
+		Version:  rec.Version,
+		At:       rec.At,
+		Data:     rec.Data,
+	}
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,195 @@
+package eventstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/AhmadWaleed/eventsource"
+	"github.com/AhmadWaleed/eventsource/eventsourcetest"
+)
+
+func openStore(t *testing.T, dir string, opts ...StoreOption) *Store {
+	t.Helper()
+
+	s, err := NewStore(dir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func TestStore(t *testing.T) {
+	eventsourcetest.RunEventStoreTests(t, func() eventsource.EventStore {
+		return openStore(t, t.TempDir(), WithSegmentSize(4<<10))
+	})
+}
+
+func TestSnapshotStore(t *testing.T) {
+	eventsourcetest.RunSnapshotStoreTests(t, func() eventsource.SnapshotStore {
+		return openStore(t, t.TempDir())
+	})
+}
+
+func save(t *testing.T, s *Store, aggrID string, n, version int) {
+	t.Helper()
+
+	history := make(eventsource.History, n)
+	for i := range history {
+		history[i] = eventsource.EventModel{Data: []byte(`{"n":1}`)}
+	}
+
+	if err := s.SaveEvents(context.Background(), aggrID, history, version); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectEvents(t *testing.T, s *Store, aggrID string, n int) {
+	t.Helper()
+
+	history, err := s.GetEventsForAggregate(context.Background(), aggrID, eventsource.ExpectedVersionNoStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history) != n || history[n-1].Version != n-1 {
+		t.Fatalf("expected %d events of %s, got %d", n, aggrID, len(history))
+	}
+
+	all, err := s.ReadAll(context.Background(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, e := range all {
+		if e.Offset != int64(i+1) {
+			t.Fatalf("expected offset %d, got %d", i+1, e.Offset)
+		}
+	}
+}
+
+func TestStoreReopen(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s, err := NewStore(dir, WithSegmentSize(1<<10), WithSyncPolicy(SyncNever))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	save(t, s, "abc123", 50, eventsource.ExpectedVersionNoStream)
+	save(t, s, "def456", 10, eventsource.ExpectedVersionNoStream)
+	if err := s.SaveSnapshot(ctx, "abc123", eventsource.SnapshotModel{Data: []byte(`{"n":49}`)}, 49); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if segments, _ := listSegments(dir); len(segments) < 2 {
+		t.Fatalf("expected segments to be rotated, got %v", segments)
+	}
+
+	s = openStore(t, dir)
+	expectEvents(t, s, "abc123", 50)
+	expectEvents(t, s, "def456", 10)
+
+	if snap, err := s.GetSnapshotForAggregate(ctx, "abc123", 60); err != nil || snap.Version != 49 {
+		t.Errorf("expected snapshot at version 49, got %+v, %v", snap, err)
+	}
+
+	save(t, s, "abc123", 1, 49)
+	expectEvents(t, s, "abc123", 51)
+}
+
+func TestStoreRecovery(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	save(t, s, "abc123", 3, eventsource.ExpectedVersionNoStream)
+	s.Close()
+
+	segment := segmentPath(dir, 0)
+	info, _ := os.Stat(segment)
+
+	// a crash while appending left half a record behind and the index was lost
+	f, _ := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte{42, 0, 0, 0, 1, 2, 3, 4, '{'})
+	f.Close()
+	os.Remove(filepath.Join(dir, indexFile))
+
+	s = openStore(t, dir)
+	expectEvents(t, s, "abc123", 3)
+
+	if after, _ := os.Stat(segment); after.Size() != info.Size() {
+		t.Errorf("expected torn record to be truncated, got size %d instead of %d", after.Size(), info.Size())
+	}
+
+	save(t, s, "abc123", 1, 2)
+	expectEvents(t, s, "abc123", 4)
+	s.Close()
+
+	// the index points past the segment when its tail was lost
+	os.Truncate(segment, info.Size())
+
+	s = openStore(t, dir)
+	expectEvents(t, s, "abc123", 3)
+}
+
+func TestStoreLocksDir(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewStore(dir); err == nil {
+		t.Fatal("expected the store to be locked")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	openStore(t, dir)
+}
+
+func TestStoreAppendFailure(t *testing.T) {
+	dir := t.TempDir()
+
+	s := openStore(t, dir)
+	save(t, s, "abc123", 3, eventsource.ExpectedVersionNoStream)
+
+	segment := segmentPath(dir, 0)
+	info, _ := os.Stat(segment)
+
+	// the index can no longer be written once its file is closed
+	index := s.index
+	index.Close()
+	if err := s.SaveEvents(context.Background(), "abc123", eventsource.History{{Data: []byte(`{"n":1}`)}}, 2); err == nil {
+		t.Fatal("expected append to fail")
+	}
+
+	if after, _ := os.Stat(segment); after.Size() != info.Size() || s.activeSize != info.Size() {
+		t.Fatalf("expected the failed append to be truncated, got size %d instead of %d", after.Size(), info.Size())
+	}
+
+	var err error
+	if s.index, err = os.OpenFile(filepath.Join(dir, indexFile), os.O_RDWR, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	save(t, s, "abc123", 2, 2)
+	expectEvents(t, s, "abc123", 5)
+	s.Close()
+
+	s = openStore(t, dir)
+	expectEvents(t, s, "abc123", 5)
+}
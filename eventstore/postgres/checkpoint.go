@@ -0,0 +1,53 @@
+package eventstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/AhmadWaleed/eventsource"
+)
+
+func NewCheckpointStore(db *sql.DB, table string) eventsource.CheckpointStore {
+	return &checkpointStore{
+		db:    db,
+		table: table,
+	}
+}
+
+func CreateCheckpointTable(ctx context.Context, db *sql.DB, table string) error {
+	sql := `
+	CREATE TABLE IF NOT EXISTS %s (
+	    name      VARCHAR(255) PRIMARY KEY NOT NULL,
+	    "offset"  BIGINT NOT NULL
+	);
+`
+	_, err := db.ExecContext(ctx, fmt.Sprintf(sql, table))
+	return err
+}
+
+type checkpointStore struct {
+	db    *sql.DB
+	table string
+}
+
+func (s *checkpointStore) GetCheckpoint(ctx context.Context, name string) (int64, error) {
+	var offset int64
+	row := s.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT "offset" FROM %s WHERE name = $1`, s.table), name)
+	if err := row.Scan(&offset); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	return offset, nil
+}
+
+func (s *checkpointStore) SaveCheckpoint(ctx context.Context, name string, offset int64) error {
+	sql := fmt.Sprintf(`INSERT INTO %s (name, "offset") VALUES ($1, $2) ON CONFLICT (name) DO UPDATE SET "offset" = EXCLUDED."offset"`, s.table)
+	_, err := s.db.ExecContext(ctx, sql, name, offset)
+	return err
+}
@@ -0,0 +1,56 @@
+package eventstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/AhmadWaleed/eventsource"
+	"github.com/AhmadWaleed/eventsource/internal/dbtest"
+)
+
+func TestCheckpointStore(t *testing.T) {
+	db := openDB(t)
+
+	testCheckpointStore(t, func() eventsource.CheckpointStore {
+		return NewCheckpointStore(db, dbtest.CreateTable(t, db, "checkpoints", CreateCheckpointTable))
+	})
+}
+
+// testCheckpointStore verifies the checkpoint store contract against the stores
+// returned by factory, each test gets a new store.
+func testCheckpointStore(t *testing.T, factory func() eventsource.CheckpointStore) {
+	t.Run("SaveAndGet", func(t *testing.T) {
+		ctx := context.Background()
+		store := factory()
+
+		offset, err := store.GetCheckpoint(ctx, "projector-1")
+		if err != nil || offset != 0 {
+			t.Fatalf("expected checkpoint 0 before any save, got %d, %v", offset, err)
+		}
+
+		for _, want := range []int64{5, 12, 0} {
+			if err := store.SaveCheckpoint(ctx, "projector-1", want); err != nil {
+				t.Fatalf("unable to save checkpoint: %v", err)
+			}
+
+			offset, err := store.GetCheckpoint(ctx, "projector-1")
+			if err != nil || offset != want {
+				t.Errorf("expected checkpoint %d, got %d, %v", want, offset, err)
+			}
+		}
+	})
+
+	t.Run("Isolation", func(t *testing.T) {
+		ctx := context.Background()
+		store := factory()
+
+		if err := store.SaveCheckpoint(ctx, "projector-1", 7); err != nil {
+			t.Fatalf("unable to save checkpoint: %v", err)
+		}
+
+		offset, err := store.GetCheckpoint(ctx, "projector-2")
+		if err != nil || offset != 0 {
+			t.Errorf("expected checkpoints to be kept per name, got %d, %v", offset, err)
+		}
+	})
+}
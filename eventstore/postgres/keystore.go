@@ -0,0 +1,75 @@
+package eventstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/AhmadWaleed/eventsource"
+)
+
+func NewKeyStore(db *sql.DB, table string) eventsource.KeyStore {
+	return &keyStore{
+		db:    db,
+		table: table,
+	}
+}
+
+// CreateKeyTable creates the table of the data keys, the key of a forgotten
+// subject is set to NULL so the subject is not given a new key.
+func CreateKeyTable(ctx context.Context, db *sql.DB, table string) error {
+	sql := `
+	CREATE TABLE IF NOT EXISTS %s (
+	    subject       VARCHAR(255) PRIMARY KEY NOT NULL,
+	    key           BYTEA,
+	    forgotten_at  TIMESTAMPTZ
+	);
+`
+	_, err := db.ExecContext(ctx, fmt.Sprintf(sql, table))
+	return err
+}
+
+type keyStore struct {
+	db    *sql.DB
+	table string
+}
+
+func (s *keyStore) GetOrCreateKey(ctx context.Context, subject string) ([]byte, error) {
+	key, err := eventsource.NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+
+	sql := fmt.Sprintf(`INSERT INTO %s (subject, key) VALUES ($1, $2) ON CONFLICT (subject) DO NOTHING`, s.table)
+	if _, err := s.db.ExecContext(ctx, sql, subject, key); err != nil {
+		return nil, err
+	}
+
+	key, err = s.GetKey(ctx, subject)
+	if errors.Is(err, eventsource.ErrKeyNotFound) {
+		return nil, fmt.Errorf("%w: %s", eventsource.ErrSubjectForgotten, subject)
+	}
+
+	return key, err
+}
+
+func (s *keyStore) GetKey(ctx context.Context, subject string) ([]byte, error) {
+	var key []byte
+	row := s.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT key FROM %s WHERE subject = $1`, s.table), subject)
+	if err := row.Scan(&key); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	if key == nil {
+		return nil, fmt.Errorf("%w: %s", eventsource.ErrKeyNotFound, subject)
+	}
+
+	return key, nil
+}
+
+func (s *keyStore) ForgetSubject(ctx context.Context, subject string) error {
+	sql := fmt.Sprintf(`INSERT INTO %s (subject, key, forgotten_at) VALUES ($1, NULL, NOW()) ON CONFLICT (subject) DO UPDATE SET key = NULL, forgotten_at = EXCLUDED.forgotten_at`, s.table)
+	_, err := s.db.ExecContext(ctx, sql, subject)
+	return err
+}
@@ -0,0 +1,71 @@
+package eventstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/AhmadWaleed/eventsource"
+	"github.com/AhmadWaleed/eventsource/internal/dbtest"
+)
+
+func TestKeyStore(t *testing.T) {
+	db := openDB(t)
+
+	testKeyStore(t, func() eventsource.KeyStore {
+		return NewKeyStore(db, dbtest.CreateTable(t, db, "keys", CreateKeyTable))
+	})
+}
+
+// testKeyStore verifies the key store contract against the stores
+// returned by factory, each test gets a new store.
+func testKeyStore(t *testing.T, factory func() eventsource.KeyStore) {
+	t.Run("GetOrCreate", func(t *testing.T) {
+		ctx := context.Background()
+		store := factory()
+
+		if _, err := store.GetKey(ctx, "subject-1"); !errors.Is(err, eventsource.ErrKeyNotFound) {
+			t.Errorf("expected ErrKeyNotFound before the key is created, got %v", err)
+		}
+
+		key, err := store.GetOrCreateKey(ctx, "subject-1")
+		if err != nil {
+			t.Fatalf("unable to create key: %v", err)
+		}
+
+		for _, get := range []func(context.Context, string) ([]byte, error){store.GetOrCreateKey, store.GetKey} {
+			again, err := get(ctx, "subject-1")
+			if err != nil || string(again) != string(key) {
+				t.Errorf("expected the same key, got %x, %v", again, err)
+			}
+		}
+
+		other, err := store.GetOrCreateKey(ctx, "subject-2")
+		if err != nil || string(other) == string(key) {
+			t.Errorf("expected a distinct key per subject, got %x, %v", other, err)
+		}
+	})
+
+	t.Run("ForgetSubject", func(t *testing.T) {
+		ctx := context.Background()
+		store := factory()
+
+		if _, err := store.GetOrCreateKey(ctx, "forget-1"); err != nil {
+			t.Fatalf("unable to create key: %v", err)
+		}
+
+		for _, subject := range []string{"forget-1", "never-seen"} {
+			if err := store.ForgetSubject(ctx, subject); err != nil {
+				t.Fatalf("unable to forget %s: %v", subject, err)
+			}
+
+			if _, err := store.GetKey(ctx, subject); !errors.Is(err, eventsource.ErrKeyNotFound) {
+				t.Errorf("expected ErrKeyNotFound for forgotten %s, got %v", subject, err)
+			}
+
+			if _, err := store.GetOrCreateKey(ctx, subject); !errors.Is(err, eventsource.ErrSubjectForgotten) {
+				t.Errorf("expected ErrSubjectForgotten for forgotten %s, got %v", subject, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,132 @@
+package eventstore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type ListenerOption func(l *Listener)
+
+// WithReconnectInterval sets the delay before reconnecting a lost
+// connection, it doubles after each failed attempt up to max.
+func WithReconnectInterval(min, max time.Duration) ListenerOption {
+	return func(l *Listener) {
+		l.minReconnect = min
+		l.maxReconnect = max
+	}
+}
+
+// WithPingInterval sets how long the connection may stay idle before it is
+// pinged, so a broken connection is detected and reconnected.
+func WithPingInterval(d time.Duration) ListenerOption {
+	return func(l *Listener) {
+		l.pingInterval = d
+	}
+}
+
+// WithListenerEventHandler sets the function called with the connection
+// events of the listener, such as pq.ListenerEventDisconnected and
+// pq.ListenerEventConnectionAttemptFailed. Events are dropped by default.
+func WithListenerEventHandler(fn func(event pq.ListenerEventType, err error)) ListenerOption {
+	return func(l *Listener) {
+		l.onEvent = fn
+	}
+}
+
+// NewListener listens on channel with a connection to dsn dedicated to
+// LISTEN, it blocks until the connection is established. Stores notify the
+// channel with WithNotify and subscriptions are woken up with WithListener.
+func NewListener(dsn, channel string, opts ...ListenerOption) (*Listener, error) {
+	l := &Listener{
+		channel:      channel,
+		minReconnect: 100 * time.Millisecond,
+		maxReconnect: time.Minute,
+		pingInterval: time.Minute,
+		onEvent:      func(pq.ListenerEventType, error) {},
+		subscribers:  make(map[chan struct{}]struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	l.listener = pq.NewListener(dsn, l.minReconnect, l.maxReconnect, l.onEvent)
+	if err := l.listener.Listen(channel); err != nil {
+		l.listener.Close()
+		return nil, err
+	}
+
+	go l.run()
+
+	return l, nil
+}
+
+// Listener signals notifications received on a channel to its subscribers.
+// Notifications sent while the connection is lost are missed, subscribers
+// are signalled once it is reconnected so they read what they missed.
+type Listener struct {
+	channel      string
+	minReconnect time.Duration
+	maxReconnect time.Duration
+	pingInterval time.Duration
+	onEvent      func(event pq.ListenerEventType, err error)
+	listener     *pq.Listener
+
+	mu          sync.Mutex
+	subscribers map[chan struct{}]struct{}
+}
+
+// Notifications implements eventsource.EventNotifier
+func (l *Listener) Notifications(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+
+	l.mu.Lock()
+	l.subscribers[ch] = struct{}{}
+	l.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		l.mu.Lock()
+		delete(l.subscribers, ch)
+		l.mu.Unlock()
+	}()
+
+	return ch
+}
+
+// Close closes the connection, subscribers are no longer signalled
+func (l *Listener) Close() error {
+	return l.listener.Close()
+}
+
+func (l *Listener) run() {
+	for {
+		select {
+		case _, ok := <-l.listener.Notify:
+			if !ok {
+				return
+			}
+
+			// a nil notification is received after reconnecting
+			l.signal()
+		case <-time.After(l.pingInterval):
+			go l.listener.Ping()
+		}
+	}
+}
+
+func (l *Listener) signal() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ch := range l.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package eventstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/AhmadWaleed/eventsource"
+	"github.com/AhmadWaleed/eventsource/command"
+)
+
+func CreateOutboxTable(ctx context.Context, db *sql.DB, table string, opts ...TableOption) error {
+	c := newTableConfig(opts)
+	sql := `
+	CREATE TABLE IF NOT EXISTS %[1]s (
+	    id             BIGSERIAL PRIMARY KEY NOT NULL,
+	    aggregate_id   VARCHAR(255) NOT NULL,
+	    version        INTEGER NOT NULL,
+	    event_id       VARCHAR(64) NOT NULL,
+	    metadata       JSON NOT NULL,
+	    data           %[2]s NOT NULL,
+	    at             BIGINT NOT NULL,
+	    created_at     TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	    dispatched_at  TIMESTAMPTZ,
+	    attempts       INTEGER NOT NULL DEFAULT 0,
+	    last_error     TEXT,
+	    failed_at      TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS idx_%[1]s_pending ON %[1]s (id) WHERE dispatched_at IS NULL;
+	CREATE INDEX IF NOT EXISTS idx_%[1]s_failed ON %[1]s (aggregate_id, id) WHERE dispatched_at IS NULL AND failed_at IS NOT NULL;
+`
+	_, err := db.ExecContext(ctx, fmt.Sprintf(sql, table, c.dataType))
+	return err
+}
+
+func writeOutbox(ctx context.Context, tx *sql.Tx, table, agrID string, version int, models eventsource.History) error {
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(`INSERT INTO %s (aggregate_id, version, event_id, metadata, data, at) VALUES ($1, $2, $3, $4, $5, $6)`, table))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i, model := range models {
+		metadata, err := json.Marshal(model.Metadata)
+		if err != nil {
+			return err
+		}
+
+		if _, err := stmt.ExecContext(ctx, agrID, version+i, model.ID, metadata, model.Data, model.At); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type RelayOption func(r *OutboxRelay)
+
+// WithRelayBatchSize sets how many outbox rows are dispatched per transaction
+func WithRelayBatchSize(n int) RelayOption {
+	return func(r *OutboxRelay) {
+		r.batchSize = n
+	}
+}
+
+// WithRelayMaxAttempts sets how often a row is dispatched before it is
+// dead-lettered, 5 by default. Dead-lettered rows are skipped until they are
+// retried with RetryFailed.
+func WithRelayMaxAttempts(n int) RelayOption {
+	return func(r *OutboxRelay) {
+		r.maxAttempts = n
+	}
+}
+
+// WithRelayErrorHandler sets the function called by Run when a batch could
+// not be dispatched, errors are dropped by default.
+func WithRelayErrorHandler(fn func(err error)) RelayOption {
+	return func(r *OutboxRelay) {
+		r.onError = fn
+	}
+}
+
+// WithRelayPollInterval sets how long the relay waits when the outbox is drained
+func WithRelayPollInterval(d time.Duration) RelayOption {
+	return func(r *OutboxRelay) {
+		r.pollInterval = d
+	}
+}
+
+func NewOutboxRelay(db *sql.DB, table string, marshaler eventsource.EventMarshaler, publisher command.EventPublisher, opts ...RelayOption) *OutboxRelay {
+	r := &OutboxRelay{
+		db:           db,
+		table:        table,
+		marshaler:    marshaler,
+		publisher:    publisher,
+		batchSize:    100,
+		maxAttempts:  5,
+		pollInterval: time.Second,
+		onError:      func(error) {},
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+// OutboxRelay drains the outbox table into an event publisher. Rows are
+// marked as dispatched only after they were published, an event may be
+// published more than once when the relay crashes in between. A row which
+// keeps failing is dead-lettered so it does not block the rows of other
+// aggregates, the later rows of its aggregate wait behind it until it is
+// retried with RetryFailed.
+type OutboxRelay struct {
+	db           *sql.DB
+	table        string
+	marshaler    eventsource.EventMarshaler
+	publisher    command.EventPublisher
+	batchSize    int
+	maxAttempts  int
+	pollInterval time.Duration
+	onError      func(err error)
+}
+
+// OutboxLag describes the events waiting to be dispatched
+type OutboxLag struct {
+	// Pending is the number of undispatched events
+	Pending int64
+
+	// Oldest is how long the oldest undispatched event has been waiting
+	Oldest time.Duration
+
+	// Failed is the number of dead-lettered events
+	Failed int64
+}
+
+// Run dispatches the outbox until ctx is done, failed batches are retried
+// after the poll interval.
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	for {
+		n, err := r.Dispatch(ctx)
+		if err != nil {
+			r.onError(err)
+		}
+
+		if err == nil && n == r.batchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.pollInterval):
+		}
+	}
+}
+
+// Dispatch publishes one batch of pending events in order and returns how
+// many were dispatched. Rows are locked so several relays can run at once.
+func (r *OutboxRelay) Dispatch(ctx context.Context) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// rows behind a dead-lettered row of their aggregate are held back, so
+	// the events of an aggregate are never published out of order
+	sql := fmt.Sprintf(`
+	SELECT id, version, event_id, metadata, data, at FROM %[1]s o
+	WHERE dispatched_at IS NULL AND failed_at IS NULL AND NOT EXISTS (
+	    SELECT 1 FROM %[1]s f
+	    WHERE f.aggregate_id = o.aggregate_id AND f.id < o.id AND f.dispatched_at IS NULL AND f.failed_at IS NOT NULL
+	)
+	ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED`, r.table)
+	rows, err := tx.QueryContext(ctx, sql, r.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	type row struct {
+		id    int64
+		model eventsource.EventModel
+	}
+
+	var batch []row
+	for rows.Next() {
+		var rec row
+		if err := scanEvent(rows, &rec.model, &rec.id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		batch = append(batch, rec)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	update := fmt.Sprintf(`UPDATE %s SET dispatched_at = NOW() WHERE id = $1`, r.table)
+	fail := fmt.Sprintf(`UPDATE %s SET attempts = attempts + 1, last_error = $2, failed_at = CASE WHEN attempts + 1 >= $3 THEN NOW() END WHERE id = $1`, r.table)
+
+	var n int
+	for _, rec := range batch {
+		event, err := eventsource.UnmarshalEvent(ctx, r.marshaler, rec.model)
+		if err == nil {
+			err = r.publisher.Publish(ctx, event)
+		}
+
+		if err == nil {
+			_, err = tx.ExecContext(ctx, update, rec.id)
+		}
+
+		if err != nil {
+			// keep what was dispatched so far, the failed row stays pending
+			// until it runs out of attempts
+			if _, ferr := tx.ExecContext(ctx, fail, rec.id, err.Error(), r.maxAttempts); ferr != nil {
+				return 0, ferr
+			}
+
+			if cerr := tx.Commit(); cerr != nil {
+				return 0, cerr
+			}
+
+			return n, fmt.Errorf("unable to dispatch outbox row %d: %v", rec.id, err)
+		}
+
+		n++
+	}
+
+	return n, tx.Commit()
+}
+
+// Lag reports the events waiting in the outbox
+func (r *OutboxRelay) Lag(ctx context.Context) (OutboxLag, error) {
+	var (
+		lag     OutboxLag
+		seconds float64
+	)
+
+	sql := fmt.Sprintf(`
+	SELECT
+	    COUNT(*) FILTER (WHERE failed_at IS NULL),
+	    COALESCE(EXTRACT(EPOCH FROM NOW() - MIN(created_at) FILTER (WHERE failed_at IS NULL)), 0),
+	    COUNT(*) FILTER (WHERE failed_at IS NOT NULL)
+	FROM %s WHERE dispatched_at IS NULL`, r.table)
+	if err := r.db.QueryRowContext(ctx, sql).Scan(&lag.Pending, &seconds, &lag.Failed); err != nil {
+		return OutboxLag{}, err
+	}
+
+	lag.Oldest = time.Duration(seconds * float64(time.Second))
+
+	return lag, nil
+}
+
+// RetryFailed puts the dead-lettered rows back in the outbox with their
+// attempts reset, it returns how many rows were retried.
+func (r *OutboxRelay) RetryFailed(ctx context.Context) (int64, error) {
+	sql := fmt.Sprintf(`UPDATE %s SET attempts = 0, failed_at = NULL WHERE dispatched_at IS NULL AND failed_at IS NOT NULL`, r.table)
+	res, err := r.db.ExecContext(ctx, sql)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
@@ -0,0 +1,131 @@
+package eventstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/AhmadWaleed/eventsource"
+)
+
+func NewSagaStore(db *sql.DB, table string) eventsource.SagaStore {
+	return &sagaStore{
+		db:    db,
+		table: table,
+	}
+}
+
+func CreateSagaTable(ctx context.Context, db *sql.DB, table string) error {
+	sql := `
+	CREATE TABLE IF NOT EXISTS %s (
+	    name       VARCHAR(255) NOT NULL,
+	    key        VARCHAR(255) NOT NULL,
+	    version    INTEGER NOT NULL,
+	    data       JSON NOT NULL,
+	    completed  BOOLEAN NOT NULL DEFAULT FALSE,
+	    deadline   TIMESTAMPTZ,
+	    PRIMARY KEY (name, key)
+	);
+
+	CREATE INDEX IF NOT EXISTS %s_deadline_idx ON %s (name, deadline) WHERE NOT completed;
+`
+	_, err := db.ExecContext(ctx, fmt.Sprintf(sql, table, table, table))
+	return err
+}
+
+type sagaStore struct {
+	db    *sql.DB
+	table string
+}
+
+func (s *sagaStore) GetSaga(ctx context.Context, name, key string) (eventsource.SagaModel, error) {
+	query := fmt.Sprintf(`SELECT name, key, version, data, completed, deadline FROM %s WHERE name = $1 AND key = $2`, s.table)
+
+	model, err := scanSaga(s.db.QueryRowContext(ctx, query, name, key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return eventsource.SagaModel{}, fmt.Errorf("%w: %s %s", eventsource.ErrSagaNotFound, name, key)
+	}
+
+	return model, err
+}
+
+// SaveSaga inserts new instances and updates stored ones only at expectedVersion
+func (s *sagaStore) SaveSaga(ctx context.Context, model eventsource.SagaModel, expectedVersion int) error {
+	var deadline *time.Time
+	if !model.Deadline.IsZero() {
+		deadline = &model.Deadline
+	}
+
+	var (
+		res sql.Result
+		err error
+	)
+
+	if expectedVersion == eventsource.ExpectedVersionNoStream {
+		query := fmt.Sprintf(`INSERT INTO %s (name, key, version, data, completed, deadline) VALUES ($1, $2, 0, $3, $4, $5) ON CONFLICT (name, key) DO NOTHING`, s.table)
+		res, err = s.db.ExecContext(ctx, query, model.Name, model.Key, model.Data, model.Completed, deadline)
+	} else {
+		query := fmt.Sprintf(`UPDATE %s SET version = version + 1, data = $3, completed = $4, deadline = $5 WHERE name = $1 AND key = $2 AND version = $6`, s.table)
+		res, err = s.db.ExecContext(ctx, query, model.Name, model.Key, model.Data, model.Completed, deadline, expectedVersion)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 1 {
+		return err
+	}
+
+	actual := eventsource.ExpectedVersionNoStream
+	row := s.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT version FROM %s WHERE name = $1 AND key = $2`, s.table), model.Name, model.Key)
+	if err := row.Scan(&actual); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	return &eventsource.ErrConcurrencyConflict{AggregateID: model.Name + "/" + model.Key, Expected: expectedVersion, Actual: actual}
+}
+
+func (s *sagaStore) ExpiredSagas(ctx context.Context, name string, now time.Time) ([]eventsource.SagaModel, error) {
+	query := fmt.Sprintf(`SELECT name, key, version, data, completed, deadline FROM %s WHERE name = $1 AND NOT completed AND deadline <= $2 ORDER BY deadline`, s.table)
+
+	rows, err := s.db.QueryContext(ctx, query, name, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var expired []eventsource.SagaModel
+	for rows.Next() {
+		model, err := scanSaga(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		expired = append(expired, model)
+	}
+
+	return expired, rows.Err()
+}
+
+// scanner is implemented by *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSaga(row scanner) (eventsource.SagaModel, error) {
+	var (
+		model    eventsource.SagaModel
+		deadline sql.NullTime
+	)
+
+	if err := row.Scan(&model.Name, &model.Key, &model.Version, &model.Data, &model.Completed, &deadline); err != nil {
+		return eventsource.SagaModel{}, err
+	}
+
+	model.Deadline = deadline.Time
+
+	return model, nil
+}
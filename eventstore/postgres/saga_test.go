@@ -0,0 +1,110 @@
+package eventstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AhmadWaleed/eventsource"
+	"github.com/AhmadWaleed/eventsource/internal/dbtest"
+)
+
+func TestSagaStore(t *testing.T) {
+	db := openDB(t)
+
+	testSagaStore(t, func() eventsource.SagaStore {
+		return NewSagaStore(db, dbtest.CreateTable(t, db, "sagas", CreateSagaTable))
+	})
+}
+
+// testSagaStore verifies the saga store contract against the stores returned
+// by factory, each test gets a new store.
+func testSagaStore(t *testing.T, factory func() eventsource.SagaStore) {
+	t.Run("Versioning", func(t *testing.T) {
+		ctx := context.Background()
+		store := factory()
+
+		if _, err := store.GetSaga(ctx, "saga", "key-1"); !errors.Is(err, eventsource.ErrSagaNotFound) {
+			t.Errorf("expected ErrSagaNotFound, got %v", err)
+		}
+
+		model := eventsource.SagaModel{Name: "saga", Key: "key-1", Data: sagaData(0)}
+		if err := store.SaveSaga(ctx, model, eventsource.ExpectedVersionNoStream); err != nil {
+			t.Fatalf("unable to save saga: %v", err)
+		}
+
+		model.Data = sagaData(1)
+		if err := store.SaveSaga(ctx, model, 0); err != nil {
+			t.Fatalf("unable to save saga at version 0: %v", err)
+		}
+
+		for _, version := range []int{eventsource.ExpectedVersionNoStream, 0} {
+			var conflict *eventsource.ErrConcurrencyConflict
+			if err := store.SaveSaga(ctx, model, version); !errors.As(err, &conflict) || conflict.Actual != 1 {
+				t.Errorf("expected concurrency conflict saving at version %d, got %v", version, err)
+			}
+		}
+
+		stored, err := store.GetSaga(ctx, "saga", "key-1")
+		if err != nil {
+			t.Fatalf("unable to get saga: %v", err)
+		}
+
+		if stored.Name != "saga" || stored.Key != "key-1" || stored.Version != 1 || string(stored.Data) != string(sagaData(1)) {
+			t.Errorf("saga was not stored as saved, got %+v", stored)
+		}
+
+		if _, err := store.GetSaga(ctx, "other", "key-1"); !errors.Is(err, eventsource.ErrSagaNotFound) {
+			t.Errorf("expected sagas to be scoped by name, got %v", err)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		ctx := context.Background()
+		store := factory()
+		now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+		for i, s := range []struct {
+			name      string
+			deadline  time.Time
+			completed bool
+		}{
+			{"saga", now.Add(-time.Minute), false},
+			{"saga", now.Add(-time.Hour), false},
+			{"saga", now, false},
+			{"saga", now.Add(time.Minute), false},
+			{"saga", now.Add(-time.Minute), true},
+			{"saga", time.Time{}, false},
+			{"other", now.Add(-time.Minute), false},
+		} {
+			model := eventsource.SagaModel{Name: s.name, Key: fmt.Sprintf("key-%d", i), Data: sagaData(i), Completed: s.completed, Deadline: s.deadline}
+			if err := store.SaveSaga(ctx, model, eventsource.ExpectedVersionNoStream); err != nil {
+				t.Fatalf("unable to save saga: %v", err)
+			}
+		}
+
+		expired, err := store.ExpiredSagas(ctx, "saga", now)
+		if err != nil {
+			t.Fatalf("unable to get expired sagas: %v", err)
+		}
+
+		var keys []string
+		for _, model := range expired {
+			keys = append(keys, model.Key)
+		}
+
+		if fmt.Sprint(keys) != "[key-1 key-0 key-2]" {
+			t.Errorf("expected the sagas past their deadline by deadline, got %v", keys)
+		}
+
+		if len(expired) > 0 && !expired[0].Deadline.Equal(now.Add(-time.Hour)) {
+			t.Errorf("expected the deadline to be stored, got %v", expired[0].Deadline)
+		}
+	})
+}
+
+func sagaData(n int) []byte {
+	return []byte(fmt.Sprintf(`{"n":%d}`, n))
+}
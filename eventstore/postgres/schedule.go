@@ -0,0 +1,170 @@
+package eventstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/AhmadWaleed/eventsource"
+)
+
+func NewScheduleStore(db *sql.DB, table string) eventsource.ScheduleStore {
+	return &scheduleStore{
+		db:    db,
+		table: table,
+	}
+}
+
+func CreateScheduleTable(ctx context.Context, db *sql.DB, table string) error {
+	sql := `
+	CREATE TABLE IF NOT EXISTS %[1]s (
+	    id            VARCHAR(255) PRIMARY KEY NOT NULL,
+	    due_at        TIMESTAMPTZ NOT NULL,
+	    type          VARCHAR(255) NOT NULL,
+	    data          JSON NOT NULL,
+	    metadata      JSON NOT NULL,
+	    locked_until  TIMESTAMPTZ,
+	    attempts      INTEGER NOT NULL DEFAULT 0,
+	    last_error    TEXT,
+	    failed_at     TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS %[1]s_due_at_idx ON %[1]s (due_at);
+`
+	_, err := db.ExecContext(ctx, fmt.Sprintf(sql, table))
+	return err
+}
+
+type scheduleStore struct {
+	db    *sql.DB
+	table string
+}
+
+func (s *scheduleStore) Schedule(ctx context.Context, cmd eventsource.ScheduledCommand) error {
+	metadata, err := json.Marshal(cmd.Metadata)
+	if err != nil {
+		return err
+	}
+
+	sql := fmt.Sprintf(`INSERT INTO %s (id, due_at, type, data, metadata) VALUES ($1, $2, $3, $4, $5)`, s.table)
+	if _, err := s.db.ExecContext(ctx, sql, cmd.ID, cmd.DueAt, cmd.Type, cmd.Data, metadata); err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("%w: %s", eventsource.ErrAlreadyScheduled, cmd.ID)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *scheduleStore) Cancel(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE id = $1`, s.table), id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("%w: %s", eventsource.ErrScheduleNotFound, id)
+	}
+
+	return nil
+}
+
+// Claim locks the due commands until now+lease, commands locked by
+// concurrent schedulers are skipped.
+func (s *scheduleStore) Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]eventsource.ScheduledCommand, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+
+	sql := fmt.Sprintf(`
+	UPDATE %s SET locked_until = $2 WHERE id IN (
+	    SELECT id FROM %s
+	    WHERE due_at <= $1 AND (locked_until IS NULL OR locked_until <= $1) AND failed_at IS NULL
+	    ORDER BY due_at LIMIT NULLIF($3, -1)
+	    FOR UPDATE SKIP LOCKED
+	) RETURNING id, due_at, type, data, metadata, attempts, COALESCE(last_error, '')`, s.table, s.table)
+
+	rows, err := s.db.QueryContext(ctx, sql, now, now.Add(lease), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	claimed, err := scanScheduled(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// RETURNING does not keep the order of the sub query
+	sort.Slice(claimed, func(i, j int) bool { return claimed[i].DueAt.Before(claimed[j].DueAt) })
+
+	return claimed, nil
+}
+
+func (s *scheduleStore) Complete(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE id = $1`, s.table), id)
+	return err
+}
+
+// Fail counts the failed attempt, dead-lettered commands get a failed_at
+// and are skipped by Claim.
+func (s *scheduleStore) Fail(ctx context.Context, id, reason string, deadLetter bool) error {
+	sql := fmt.Sprintf(`UPDATE %s SET attempts = attempts + 1, last_error = $2, failed_at = CASE WHEN $3 THEN NOW() END WHERE id = $1`, s.table)
+	res, err := s.db.ExecContext(ctx, sql, id, reason, deadLetter)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("%w: %s", eventsource.ErrScheduleNotFound, id)
+	}
+
+	return nil
+}
+
+func (s *scheduleStore) Failed(ctx context.Context) ([]eventsource.ScheduledCommand, error) {
+	sql := fmt.Sprintf(`SELECT id, due_at, type, data, metadata, attempts, COALESCE(last_error, '') FROM %s WHERE failed_at IS NOT NULL ORDER BY due_at`, s.table)
+	rows, err := s.db.QueryContext(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanScheduled(rows)
+}
+
+func scanScheduled(rows *sql.Rows) ([]eventsource.ScheduledCommand, error) {
+	var cmds []eventsource.ScheduledCommand
+	for rows.Next() {
+		var (
+			cmd      eventsource.ScheduledCommand
+			metadata []byte
+		)
+
+		if err := rows.Scan(&cmd.ID, &cmd.DueAt, &cmd.Type, &cmd.Data, &metadata, &cmd.Attempts, &cmd.LastError); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(metadata, &cmd.Metadata); err != nil {
+			return nil, err
+		}
+
+		cmds = append(cmds, cmd)
+	}
+
+	return cmds, rows.Err()
+}
@@ -0,0 +1,171 @@
+package eventstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AhmadWaleed/eventsource"
+	"github.com/AhmadWaleed/eventsource/internal/dbtest"
+)
+
+func TestScheduleStore(t *testing.T) {
+	db := openDB(t)
+
+	testScheduleStore(t, func() eventsource.ScheduleStore {
+		return NewScheduleStore(db, dbtest.CreateTable(t, db, "schedules", CreateScheduleTable))
+	})
+}
+
+// testScheduleStore verifies the schedule store contract against the stores
+// returned by factory, each test gets a new store.
+func testScheduleStore(t *testing.T, factory func() eventsource.ScheduleStore) {
+	ctx := context.Background()
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	scheduled := func(id string, due time.Duration) eventsource.ScheduledCommand {
+		return eventsource.ScheduledCommand{
+			ID:       id,
+			DueAt:    now.Add(due),
+			Type:     "cmd",
+			Data:     scheduleData(int(due / time.Minute)),
+			Metadata: eventsource.Metadata{eventsource.MetadataCorrelationID: "corr-" + id},
+		}
+	}
+
+	schedule := func(t *testing.T, store eventsource.ScheduleStore, cmds ...eventsource.ScheduledCommand) {
+		t.Helper()
+
+		for _, cmd := range cmds {
+			if err := store.Schedule(ctx, cmd); err != nil {
+				t.Fatalf("unable to schedule %s: %v", cmd.ID, err)
+			}
+		}
+	}
+
+	claim := func(t *testing.T, store eventsource.ScheduleStore, at time.Time, limit int) string {
+		t.Helper()
+
+		claimed, err := store.Claim(ctx, at, time.Minute, limit)
+		if err != nil {
+			t.Fatalf("unable to claim commands: %v", err)
+		}
+
+		ids := make([]string, len(claimed))
+		for i, cmd := range claimed {
+			ids[i] = cmd.ID
+		}
+
+		return fmt.Sprint(ids)
+	}
+
+	t.Run("Claim", func(t *testing.T) {
+		store := factory()
+		schedule(t, store, scheduled("c", 0), scheduled("a", -2*time.Minute), scheduled("b", -time.Minute), scheduled("d", time.Hour))
+
+		if err := store.Schedule(ctx, scheduled("a", 0)); !errors.Is(err, eventsource.ErrAlreadyScheduled) {
+			t.Errorf("expected ErrAlreadyScheduled scheduling an id twice, got %v", err)
+		}
+
+		claimed, err := store.Claim(ctx, now, time.Minute, 2)
+		if err != nil {
+			t.Fatalf("unable to claim commands: %v", err)
+		}
+
+		if len(claimed) != 2 || claimed[0].ID != "a" || claimed[1].ID != "b" {
+			t.Fatalf("expected the 2 commands due first, got %+v", claimed)
+		}
+
+		want := scheduled("a", -2*time.Minute)
+		if got := claimed[0]; !got.DueAt.Equal(want.DueAt) || got.Type != want.Type || string(got.Data) != string(want.Data) || got.Metadata[eventsource.MetadataCorrelationID] != "corr-a" {
+			t.Errorf("command was not stored as scheduled, got %+v", got)
+		}
+
+		if ids := claim(t, store, now, 0); ids != "[c]" {
+			t.Errorf("expected claimed commands to be locked, got %s", ids)
+		}
+
+		if err := store.Complete(ctx, "a"); err != nil {
+			t.Fatalf("unable to complete command: %v", err)
+		}
+
+		if ids := claim(t, store, now.Add(time.Minute), 0); ids != "[b c]" {
+			t.Errorf("expected uncompleted commands to be claimed again after their lease, got %s", ids)
+		}
+
+		for _, id := range []string{"b", "c"} {
+			if err := store.Complete(ctx, id); err != nil {
+				t.Fatalf("unable to complete command: %v", err)
+			}
+		}
+
+		if ids := claim(t, store, now.Add(time.Hour), 0); ids != "[d]" {
+			t.Errorf("expected commands to be claimed once due, got %s", ids)
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		store := factory()
+		schedule(t, store, scheduled("a", 0), scheduled("b", 0))
+
+		if err := store.Cancel(ctx, "a"); err != nil {
+			t.Fatalf("unable to cancel command: %v", err)
+		}
+
+		if err := store.Cancel(ctx, "a"); !errors.Is(err, eventsource.ErrScheduleNotFound) {
+			t.Errorf("expected ErrScheduleNotFound cancelling twice, got %v", err)
+		}
+
+		if ids := claim(t, store, now, 0); ids != "[b]" {
+			t.Errorf("expected cancelled commands not to be claimed, got %s", ids)
+		}
+	})
+
+	t.Run("Fail", func(t *testing.T) {
+		store := factory()
+		schedule(t, store, scheduled("a", 0), scheduled("b", time.Minute))
+
+		if ids := claim(t, store, now.Add(time.Minute), 0); ids != "[a b]" {
+			t.Fatalf("expected both commands to be claimed, got %s", ids)
+		}
+
+		if err := store.Fail(ctx, "a", "unavailable", false); err != nil {
+			t.Fatalf("unable to fail command: %v", err)
+		}
+		if err := store.Fail(ctx, "b", "rejected", true); err != nil {
+			t.Fatalf("unable to dead-letter command: %v", err)
+		}
+		if err := store.Fail(ctx, "unknown", "rejected", true); !errors.Is(err, eventsource.ErrScheduleNotFound) {
+			t.Errorf("expected ErrScheduleNotFound failing an unknown command, got %v", err)
+		}
+
+		claimed, err := store.Claim(ctx, now.Add(2*time.Minute), time.Minute, 0)
+		if err != nil {
+			t.Fatalf("unable to claim commands: %v", err)
+		}
+		if len(claimed) != 1 || claimed[0].ID != "a" || claimed[0].Attempts != 1 || claimed[0].LastError != "unavailable" {
+			t.Fatalf("expected only the failed command to be claimed again with its attempt, got %+v", claimed)
+		}
+
+		failed, err := store.Failed(ctx)
+		if err != nil {
+			t.Fatalf("unable to list failed commands: %v", err)
+		}
+		if len(failed) != 1 || failed[0].ID != "b" || failed[0].Attempts != 1 || failed[0].LastError != "rejected" {
+			t.Fatalf("expected the dead-lettered command, got %+v", failed)
+		}
+
+		if err := store.Cancel(ctx, "b"); err != nil {
+			t.Fatalf("unable to cancel dead-lettered command: %v", err)
+		}
+		if failed, err := store.Failed(ctx); err != nil || len(failed) != 0 {
+			t.Errorf("expected cancelled commands to be removed, got %+v, %v", failed, err)
+		}
+	})
+}
+
+func scheduleData(n int) []byte {
+	return []byte(fmt.Sprintf(`{"n":%d}`, n))
+}
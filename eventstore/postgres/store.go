@@ -3,82 +3,210 @@ package eventstore
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
-	"sort"
+	"time"
 
 	"github.com/AhmadWaleed/eventsource"
+	"github.com/lib/pq"
 )
 
-func NewStore(db *sql.DB, table string) eventsource.EventStore {
-	return &store{
-		db:    db,
-		table: table,
+type StoreOption func(s *store)
+
+// WithOutbox writes saved events to the outbox table within
+// the same transaction, see CreateOutboxTable and OutboxRelay.
+func WithOutbox(table string) StoreOption {
+	return func(s *store) {
+		s.outbox = table
+	}
+}
+
+// WithNotify notifies channel when events are saved, listeners on the
+// channel are woken up once the transaction commits, see NewListener.
+func WithNotify(channel string) StoreOption {
+	return func(s *store) {
+		s.notify = channel
+	}
+}
+
+// WithListener signals the notifications of l to subscriptions reading the
+// store, they keep polling to catch up with notifications missed by l.
+func WithListener(l *Listener) StoreOption {
+	return func(s *store) {
+		s.listener = l
+	}
+}
+
+// WithGapTimeout makes ReadAll stop before a gap in offsets while the event
+// after it was recorded less than d ago, a transaction holding an offset of
+// the gap may still commit. Gaps left by rolled back transactions are
+// skipped once d elapsed. The age is measured by the database from the
+// recorded_at column, the clocks of the writers play no part.
+//
+// It is 5 seconds by default. Writers of different aggregates do not wait
+// for each other, so a transaction which takes longer than d to commit
+// after its insert may have its events skipped by subscriptions; 0 turns
+// the hold back off.
+func WithGapTimeout(d time.Duration) StoreOption {
+	return func(s *store) {
+		s.gapTimeout = d
 	}
 }
 
-func CreateEventStoreTable(ctx context.Context, db *sql.DB, table string) error {
+func NewStore(db *sql.DB, table string, opts ...StoreOption) eventsource.EventStore {
+	s := &store{
+		db:         db,
+		table:      table,
+		gapTimeout: 5 * time.Second,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+type TableOption func(c *tableConfig)
+
+type tableConfig struct {
+	dataType string
+}
+
+// WithBinaryData stores the event and snapshot data as BYTEA instead
+// of JSON, it is required by the gob and CBOR marshalers.
+func WithBinaryData() TableOption {
+	return func(c *tableConfig) {
+		c.dataType = "BYTEA"
+	}
+}
+
+func newTableConfig(opts []TableOption) tableConfig {
+	c := tableConfig{dataType: "JSON"}
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	return c
+}
+
+// CreateEventStoreTable creates table, a table created by an earlier version
+// is migrated. Its events get a random event id and empty metadata.
+func CreateEventStoreTable(ctx context.Context, db *sql.DB, table string, opts ...TableOption) error {
+	c := newTableConfig(opts)
 	sql := `
-	CREATE TABLE IF NOT EXISTS %s (
+	CREATE TABLE IF NOT EXISTS %[1]s (
 	    "offset"    BIGSERIAL PRIMARY KEY NOT NULL,
 	    id        VARCHAR(255) NOT NULL,
 	    version   INTEGER NOT NULL,
-	    data      JSON NOT NULL,
-	    at        BIGINT NOT NULL
+	    event_id  VARCHAR(64) NOT NULL,
+	    metadata  JSON NOT NULL,
+	    data      %[2]s NOT NULL,
+	    at        BIGINT NOT NULL,
+	    recorded_at TIMESTAMPTZ NOT NULL DEFAULT clock_timestamp()
 	);
-	CREATE UNIQUE INDEX IF NOT EXISTS idx_%s ON %s (id, version);
+	ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS event_id VARCHAR(64) NOT NULL DEFAULT md5(random()::text || clock_timestamp()::text)::uuid::text;
+	ALTER TABLE %[1]s ALTER COLUMN event_id DROP DEFAULT;
+	ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS metadata JSON NOT NULL DEFAULT '{}';
+	ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS recorded_at TIMESTAMPTZ NOT NULL DEFAULT '-infinity';
+	ALTER TABLE %[1]s ALTER COLUMN recorded_at SET DEFAULT clock_timestamp();
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_%[1]s ON %[1]s (id, version);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_%[1]s_event_id ON %[1]s (event_id);
 `
-	_, err := db.ExecContext(ctx, fmt.Sprintf(sql, table, table, table))
+	_, err := db.ExecContext(ctx, fmt.Sprintf(sql, table, c.dataType))
 	return err
 }
 
 type store struct {
-	db    *sql.DB
-	table string
+	db         *sql.DB
+	table      string
+	outbox     string
+	notify     string
+	listener   *Listener
+	gapTimeout time.Duration
 }
 
 func (s *store) SaveEvents(ctx context.Context, agrID string, models eventsource.History, version int) error {
-	tx, err := s.db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	stmt, err := tx.Prepare(fmt.Sprintf(`INSERT INTO %s (id, version, data, at) VALUES ($1, $2, $3, $4)`, s.table))
+	// event ids are generated on a copy, models belong to the caller
+	models = append(eventsource.History(nil), models...)
+
+	var actual int
+	row := tx.QueryRowContext(ctx, fmt.Sprintf(`SELECT COALESCE(MAX(version), -1) FROM %s WHERE id = $1`, s.table), agrID)
+	if err := row.Scan(&actual); err != nil {
+		return err
+	}
+
+	if version != eventsource.ExpectedVersionAny && version != actual {
+		return &eventsource.ErrConcurrencyConflict{AggregateID: agrID, Expected: version, Actual: actual}
+	}
+
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(`INSERT INTO %s (id, version, event_id, metadata, data, at) VALUES ($1, $2, $3, $4, $5, $6)`, s.table))
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	for _, model := range models {
-		_, err = stmt.ExecContext(ctx, agrID, model.Version, model.Data, model.At)
+	for i := range models {
+		if models[i].ID == "" {
+			models[i].ID = eventsource.NewEventID()
+		}
+
+		metadata, err := json.Marshal(models[i].Metadata)
 		if err != nil {
 			return err
 		}
+
+		_, err = stmt.ExecContext(ctx, agrID, actual+1+i, models[i].ID, metadata, models[i].Data, models[i].At)
+		if err != nil {
+			if isUniqueViolation(err) {
+				// a concurrent writer appended to the stream after our version check
+				return &eventsource.ErrConcurrencyConflict{AggregateID: agrID, Expected: version, Actual: actual + 1 + i}
+			}
+
+			return err
+		}
 	}
 
-	if err != nil {
-		return tx.Rollback()
+	if s.outbox != "" {
+		if err := writeOutbox(ctx, tx, s.outbox, agrID, actual+1, models); err != nil {
+			return err
+		}
+	}
+
+	if s.notify != "" {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_notify($1, $2)`, s.notify, agrID); err != nil {
+			return err
+		}
 	}
 
 	return tx.Commit()
 }
 
 func (s *store) GetEventsForAggregate(ctx context.Context, agrID string, version int) (eventsource.History, error) {
+	// 0 returns the whole stream, see eventsource.EventStore
 	if version == 0 {
-		version = math.MaxInt32
+		version = eventsource.ExpectedVersionNoStream
 	}
 
-	sql := fmt.Sprintf(`SELECT version, data, at FROM %s WHERE id = $1 and version <= $2`, s.table)
+	sql := fmt.Sprintf(`SELECT version, event_id, metadata, data, at FROM %s WHERE id = $1 and version > $2 ORDER BY version`, s.table)
 	rows, err := s.db.QueryContext(ctx, sql, agrID, version)
 	if err != nil {
 		return eventsource.History{}, err
 	}
 	defer rows.Close()
 
-	history := make(eventsource.History, 0, version+1)
+	var history eventsource.History
 	for rows.Next() {
 		var rec eventsource.EventModel
-		err := rows.Scan(&rec.Version, &rec.Data, &rec.At)
+		err := scanEvent(rows, &rec)
 		if err != nil {
 			return eventsource.History{}, err
 		}
@@ -86,9 +214,110 @@ func (s *store) GetEventsForAggregate(ctx context.Context, agrID string, version
 		history = append(history, rec)
 	}
 
-	sort.Slice(history, func(x, y int) bool {
-		return history[x].Version < history[y].Version
-	})
+	if err := rows.Err(); err != nil {
+		return eventsource.History{}, err
+	}
+
+	if len(history) == 0 {
+		var exists bool
+		row := s.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM %s WHERE id = $1)`, s.table), agrID)
+		if err := row.Scan(&exists); err != nil {
+			return eventsource.History{}, err
+		}
+
+		if !exists {
+			return eventsource.History{}, fmt.Errorf("%w: %s", eventsource.ErrAggregateNotFound, agrID)
+		}
+	}
 
 	return history, nil
 }
+
+// ReadAll reads events across all aggregates ordered by the "offset" column.
+// Offsets are assigned when rows are inserted, a transaction committing after
+// a later one becomes visible behind the position readers may already be at
+// unless the store waits for gaps to be filled, see WithGapTimeout.
+func (s *store) ReadAll(ctx context.Context, fromOffset int64, limit int) ([]eventsource.RecordedEvent, error) {
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+
+	// recent is computed by the database so the clocks of readers and
+	// writers do not need to agree
+	sql := fmt.Sprintf(`SELECT "offset", id, recorded_at > clock_timestamp() - make_interval(secs => $3), version, event_id, metadata, data, at FROM %s WHERE "offset" > $1 ORDER BY "offset" LIMIT $2`, s.table)
+	rows, err := s.db.QueryContext(ctx, sql, fromOffset, limit, s.gapTimeout.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		events []eventsource.RecordedEvent
+		recent []bool
+	)
+	for rows.Next() {
+		var (
+			rec eventsource.RecordedEvent
+			r   bool
+		)
+		err := scanEvent(rows, &rec.EventModel, &rec.Offset, &rec.AggregateID, &r)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, rec)
+		recent = append(recent, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if s.gapTimeout > 0 {
+		events = holdBackGaps(events, recent, fromOffset)
+	}
+
+	return events, nil
+}
+
+// Notifications signals events saved to the channel of the listener set
+// with WithListener, the returned channel is nil without a listener.
+func (s *store) Notifications(ctx context.Context) <-chan struct{} {
+	if s.listener == nil {
+		return nil
+	}
+
+	return s.listener.Notifications(ctx)
+}
+
+// holdBackGaps cuts events at the first gap in offsets followed by a recent
+// event, recent holds whether each event was recorded within the timeout.
+func holdBackGaps(events []eventsource.RecordedEvent, recent []bool, from int64) []eventsource.RecordedEvent {
+	prev := from
+	for i, e := range events {
+		if e.Offset != prev+1 && recent[i] {
+			return events[:i]
+		}
+
+		prev = e.Offset
+	}
+
+	return events
+}
+
+// scanEvent scans the leading columns into dest followed by
+// version, event_id, metadata, data and at into model.
+func scanEvent(rows *sql.Rows, model *eventsource.EventModel, dest ...interface{}) error {
+	var metadata []byte
+	dest = append(dest, &model.Version, &model.ID, &metadata, &model.Data, &model.At)
+	if err := rows.Scan(dest...); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(metadata, &model.Metadata)
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
@@ -0,0 +1,459 @@
+package eventstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AhmadWaleed/eventsource"
+	"github.com/AhmadWaleed/eventsource/eventsourcetest"
+	"github.com/AhmadWaleed/eventsource/internal/dbtest"
+)
+
+// postgresDSN returns EVENTSOURCE_POSTGRES_DSN, the test is skipped when it
+// is unset. The builder service of docker-compose sets it to its postgres
+// service:
+//
+//	docker-compose run builder go test ./eventstore/postgres
+func postgresDSN(t *testing.T) string {
+	dsn := os.Getenv("EVENTSOURCE_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("EVENTSOURCE_POSTGRES_DSN not set")
+	}
+
+	return dsn
+}
+
+func openDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("postgres", postgresDSN(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// createDataTable creates a new table holding event or snapshot data with
+// create and opts and drops it after the test
+func createDataTable(t *testing.T, db *sql.DB, prefix string, create func(context.Context, *sql.DB, string, ...TableOption) error, opts ...TableOption) string {
+	t.Helper()
+
+	return dbtest.CreateTable(t, db, prefix, func(ctx context.Context, db *sql.DB, table string) error {
+		return create(ctx, db, table, opts...)
+	})
+}
+
+func TestStore(t *testing.T) {
+	db := openDB(t)
+
+	eventsourcetest.RunEventStoreTests(t, func() eventsource.EventStore {
+		return NewStore(db, createDataTable(t, db, "events", CreateEventStoreTable))
+	})
+}
+
+func TestStoreBinaryData(t *testing.T) {
+	db := openDB(t)
+
+	eventsourcetest.RunEventStoreTests(t, func() eventsource.EventStore {
+		return NewStore(db, createDataTable(t, db, "events", CreateEventStoreTable, WithBinaryData()))
+	})
+}
+
+func TestCreateEventStoreTableMigrates(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	// the table as created before events had an id and metadata
+	table := dbtest.CreateTable(t, db, "events", func(ctx context.Context, db *sql.DB, table string) error {
+		_, err := db.ExecContext(ctx, fmt.Sprintf(`
+	CREATE TABLE %[1]s (
+	    "offset"    BIGSERIAL PRIMARY KEY NOT NULL,
+	    id        VARCHAR(255) NOT NULL,
+	    version   INTEGER NOT NULL,
+	    data      JSON NOT NULL,
+	    at        BIGINT NOT NULL
+	);
+	CREATE UNIQUE INDEX idx_%[1]s ON %[1]s (id, version);
+	INSERT INTO %[1]s (id, version, data, at) VALUES ('legacy-1', 0, '{}', 1), ('legacy-1', 1, '{}', 2);
+`, table))
+		return err
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := CreateEventStoreTable(ctx, db, table); err != nil {
+			t.Fatalf("unable to migrate the table: %v", err)
+		}
+	}
+
+	store := NewStore(db, table)
+	event := eventsource.History{{Data: []byte(`{}`), At: 3}}
+	if err := store.SaveEvents(ctx, "legacy-1", event, 1); err != nil {
+		t.Fatalf("unable to save events after the migration: %v", err)
+	}
+
+	history, err := store.GetEventsForAggregate(ctx, "legacy-1", eventsource.ExpectedVersionNoStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history) != 3 || history[0].ID == "" || history[0].ID == history[1].ID {
+		t.Errorf("expected 3 events with distinct ids, got %+v", history)
+	}
+
+	// the events saved before the migration are not recent
+	var recent int
+	if err := db.QueryRowContext(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE recorded_at > clock_timestamp() - interval '1 minute'`, table)).Scan(&recent); err != nil {
+		t.Fatal(err)
+	}
+
+	if recent != 1 {
+		t.Errorf("expected 1 recently recorded event, got %d", recent)
+	}
+}
+
+func TestStoreReadAllHoldsBackGaps(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+	table := createDataTable(t, db, "events", CreateEventStoreTable)
+	store := NewStore(db, table, WithGapTimeout(time.Hour))
+
+	save := func(id string) {
+		event := eventsource.History{{Data: []byte(`{}`), At: 1}}
+		if err := store.SaveEvents(ctx, id, event, eventsource.ExpectedVersionNoStream); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the offset taken by a transaction which did not commit yet
+	save("gap-1")
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(`SELECT nextval(pg_get_serial_sequence('%s', 'offset'))`, table)); err != nil {
+		t.Fatal(err)
+	}
+	save("gap-2")
+
+	readAll := func() int {
+		events, err := store.(eventsource.GlobalEventReader).ReadAll(ctx, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(events)
+	}
+
+	if n := readAll(); n != 1 {
+		t.Fatalf("expected the event after the gap to be held back, got %d events", n)
+	}
+
+	// the gap is skipped once the event after it is older than the timeout
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(`UPDATE %s SET recorded_at = clock_timestamp() - interval '2 hours'`, table)); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := readAll(); n != 2 {
+		t.Errorf("expected the gap to be skipped, got %d events", n)
+	}
+}
+
+func TestStoreReadAllConcurrentWriters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := openDB(t)
+	store := NewStore(db, createDataTable(t, db, "events", CreateEventStoreTable))
+
+	const writers, events = 8, 20
+
+	var (
+		mu      sync.Mutex
+		offsets = make(map[int64]bool)
+	)
+	sub := eventsource.NewCatchUpSubscription(store.(eventsource.GlobalEventReader), 0, func(ctx context.Context, e eventsource.RecordedEvent) error {
+		mu.Lock()
+		offsets[e.Offset] = true
+		mu.Unlock()
+		return nil
+	}, eventsource.WithPollInterval(time.Millisecond))
+	go sub.Run(ctx)
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(agrID string) {
+			defer wg.Done()
+
+			for version := 0; version < events; version++ {
+				event := eventsource.History{{Data: []byte(`{}`), At: eventsource.Now()}}
+				if err := store.SaveEvents(ctx, agrID, event, version-1); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(fmt.Sprintf("writer-%d", w))
+	}
+	wg.Wait()
+
+	// every event is delivered although offsets were taken concurrently
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(offsets)
+		mu.Unlock()
+
+		if n == writers*events {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d events to be delivered, got %d", writers*events, n)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSnapshotStore(t *testing.T) {
+	db := openDB(t)
+
+	eventsourcetest.RunSnapshotStoreTests(t, func() eventsource.SnapshotStore {
+		return NewSnapshotStore(db, createDataTable(t, db, "snapshots", CreateSnapshotTable))
+	})
+}
+
+type outboxEvent struct {
+	eventsource.EventSkeleton
+}
+
+type recordingPublisher struct {
+	events []interface{}
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, v interface{}) error {
+	p.events = append(p.events, v)
+	return nil
+}
+
+func TestOutboxRelay(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+	outbox := createDataTable(t, db, "outbox", CreateOutboxTable)
+	store := NewStore(db, createDataTable(t, db, "events", CreateEventStoreTable), WithOutbox(outbox))
+
+	marshaler := new(eventsource.JsonEventMarshaler)
+	if err := marshaler.Bind(outboxEvent{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, agrID := range []string{"a", "b", "c"} {
+		model, err := marshaler.Marshal(outboxEvent{eventsource.EventSkeleton{ID: agrID, At: time.Now()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the event of b can not be unmarshaled
+		if agrID == "b" {
+			model.Data = []byte(`{"type":"unbound"}`)
+		}
+
+		if err := store.SaveEvents(ctx, agrID, eventsource.History{model}, eventsource.ExpectedVersionNoStream); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the second event of b waits behind the first one
+	model, err := marshaler.Marshal(outboxEvent{eventsource.EventSkeleton{ID: "b", At: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveEvents(ctx, "b", eventsource.History{model}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := &recordingPublisher{}
+	relay := NewOutboxRelay(db, outbox, marshaler, publisher, WithRelayMaxAttempts(2))
+
+	expect := func(dispatched int, failed bool, pending, deadLetters int64) {
+		t.Helper()
+
+		n, err := relay.Dispatch(ctx)
+		if n != dispatched || (err != nil) != failed {
+			t.Fatalf("expected %d dispatched rows and failure %v, got %d, %v", dispatched, failed, n, err)
+		}
+
+		lag, err := relay.Lag(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if lag.Pending != pending || lag.Failed != deadLetters {
+			t.Fatalf("expected %d pending and %d failed rows, got %+v", pending, deadLetters, lag)
+		}
+	}
+
+	expect(1, true, 3, 0)
+	expect(0, true, 2, 1)
+	expect(1, false, 1, 1)
+
+	if len(publisher.events) != 2 {
+		t.Errorf("expected the events of a and c to be published, got %d", len(publisher.events))
+	}
+
+	retried, err := relay.RetryFailed(ctx)
+	if err != nil || retried != 1 {
+		t.Fatalf("expected 1 retried row, got %d, %v", retried, err)
+	}
+
+	expect(0, true, 2, 0)
+}
+
+func TestSnapshotStoreRetention(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+	table := createDataTable(t, db, "snapshots", CreateSnapshotTable)
+	store := NewSnapshotStore(db, table, WithRetention(2))
+
+	for version := 1; version <= 4; version++ {
+		model := eventsource.SnapshotModel{ID: "snap-1", Version: version, Data: []byte(fmt.Sprintf(`{"v":%d}`, version))}
+		if err := store.SaveSnapshot(ctx, "snap-1", model, version); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a snapshot saved again at the same version replaces the stored one
+	model := eventsource.SnapshotModel{ID: "snap-1", Version: 4, Data: []byte(`{"v":"replaced"}`)}
+	if err := store.SaveSnapshot(ctx, "snap-1", model, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	if err := db.QueryRowContext(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM %s`, table)).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 2 {
+		t.Errorf("expected 2 snapshots to be retained, got %d", count)
+	}
+
+	if _, err := store.GetSnapshotForAggregate(ctx, "snap-1", 2); !errors.Is(err, eventsource.ErrSnapNotFound) {
+		t.Errorf("expected pruned snapshots to be gone, got %v", err)
+	}
+
+	latest, err := store.GetSnapshotForAggregate(ctx, "snap-1", 10)
+	if err != nil || latest.Version != 4 || string(latest.Data) != `{"v":"replaced"}` {
+		t.Errorf("expected the replaced snapshot at version 4, got %+v, %v", latest, err)
+	}
+}
+
+func TestSnapshotStoreBinaryData(t *testing.T) {
+	db := openDB(t)
+
+	eventsourcetest.RunSnapshotStoreTests(t, func() eventsource.SnapshotStore {
+		return NewSnapshotStore(db, createDataTable(t, db, "snapshots", CreateSnapshotTable, WithBinaryData()))
+	})
+}
+
+func TestStoreNotify(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := openDB(t)
+	table := createDataTable(t, db, "events", CreateEventStoreTable)
+	channel := table + "_saved"
+
+	l, err := NewListener(postgresDSN(t), channel, WithReconnectInterval(10*time.Millisecond, 100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	writer := NewStore(db, table, WithNotify(channel))
+	reader := NewStore(db, table, WithListener(l), WithGapTimeout(time.Second)).(eventsource.GlobalEventReader)
+
+	delivered := make(chan eventsource.RecordedEvent, 10)
+	sub := eventsource.NewCatchUpSubscription(reader, 0, func(ctx context.Context, e eventsource.RecordedEvent) error {
+		delivered <- e
+		return nil
+	}, eventsource.WithPollInterval(time.Hour))
+	go sub.Run(ctx)
+
+	expect := func(agrID string) {
+		t.Helper()
+
+		select {
+		case e := <-delivered:
+			if e.AggregateID != agrID {
+				t.Fatalf("expected an event of %s, got %s", agrID, e.AggregateID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event of %s was not delivered", agrID)
+		}
+	}
+
+	save := func(agrID string) {
+		t.Helper()
+
+		event := eventsource.History{{Data: []byte(`{}`), At: eventsource.Now()}}
+		if err := writer.SaveEvents(ctx, agrID, event, eventsource.ExpectedVersionNoStream); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for !sub.Live() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	save("notify-1")
+	expect("notify-1")
+
+	// events saved while the listener reconnects are read once it is back
+	_, err = db.ExecContext(ctx, `SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE pid <> pg_backend_pid() AND query LIKE 'LISTEN %' AND query LIKE '%' || $1 || '%'`, channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	save("notify-2")
+	expect("notify-2")
+}
+
+func TestHoldBackGaps(t *testing.T) {
+	// events from offset 10 on were recorded within the timeout
+	events := func(offsets ...int64) ([]eventsource.RecordedEvent, []bool) {
+		var (
+			events []eventsource.RecordedEvent
+			recent []bool
+		)
+		for _, offset := range offsets {
+			events = append(events, eventsource.RecordedEvent{Offset: offset})
+			recent = append(recent, offset >= 10)
+		}
+
+		return events, recent
+	}
+
+	tests := []struct {
+		name    string
+		from    int64
+		offsets []int64
+		want    int
+	}{
+		{"Contiguous", 10, []int64{11, 12, 13}, 3},
+		{"RecentGap", 10, []int64{11, 13, 14}, 1},
+		{"RecentGapAtStart", 10, []int64{12, 13}, 0},
+		{"OldGap", 0, []int64{1, 3, 4}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, recent := events(tt.offsets...)
+			got := holdBackGaps(events, recent, tt.from)
+			if len(got) != tt.want {
+				t.Errorf("expected %d events, got %d", tt.want, len(got))
+			}
+		})
+	}
+}
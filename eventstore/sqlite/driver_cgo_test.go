@@ -0,0 +1,9 @@
+//go:build !sqlite_purego
+
+package eventstore
+
+import _ "github.com/mattn/go-sqlite3"
+
+// testDriver is the cgo driver, build with -tags sqlite_purego to run the
+// tests against the pure Go driver.
+const testDriver = "sqlite3"
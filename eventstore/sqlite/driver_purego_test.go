@@ -0,0 +1,10 @@
+//go:build sqlite_purego
+
+package eventstore
+
+import _ "modernc.org/sqlite"
+
+// testDriver is the pure Go driver, the tests run without cgo:
+//
+//	CGO_ENABLED=0 go test -tags sqlite_purego ./eventstore/sqlite
+const testDriver = "sqlite"
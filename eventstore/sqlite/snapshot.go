@@ -0,0 +1,91 @@
+package eventstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/AhmadWaleed/eventsource"
+)
+
+type SnapshotStoreOption func(s *snapshotStore)
+
+// WithRetention keeps only the n newest snapshots of each aggregate,
+// older snapshots are pruned when a new one is saved.
+func WithRetention(n int) SnapshotStoreOption {
+	return func(s *snapshotStore) {
+		s.retention = n
+	}
+}
+
+func NewSnapshotStore(db *sql.DB, table string, opts ...SnapshotStoreOption) eventsource.SnapshotStore {
+	s := &snapshotStore{
+		db:    db,
+		table: table,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+func CreateSnapshotTable(ctx context.Context, db *sql.DB, table string) error {
+	sql := `
+	CREATE TABLE IF NOT EXISTS %s (
+	    id        VARCHAR(255) NOT NULL,
+	    version   INTEGER NOT NULL,
+	    data      BLOB NOT NULL,
+	    PRIMARY KEY (id, version)
+	);
+`
+	_, err := db.ExecContext(ctx, fmt.Sprintf(sql, table))
+	return err
+}
+
+type snapshotStore struct {
+	db        *sql.DB
+	table     string
+	retention int
+}
+
+func (s *snapshotStore) SaveSnapshot(ctx context.Context, agrID string, model eventsource.SnapshotModel, version int) error {
+	tx, err := beginImmediate(ctx, s.db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sql := fmt.Sprintf(`INSERT INTO %s (id, version, data) VALUES (?, ?, ?) ON CONFLICT (id, version) DO UPDATE SET data = excluded.data`, s.table)
+	if _, err := tx.ExecContext(ctx, sql, agrID, version, model.Data); err != nil {
+		return err
+	}
+
+	if s.retention > 0 {
+		sql := fmt.Sprintf(`DELETE FROM %s WHERE id = ?1 AND version NOT IN (SELECT version FROM %s WHERE id = ?1 ORDER BY version DESC LIMIT ?2)`, s.table, s.table)
+		if _, err := tx.ExecContext(ctx, sql, agrID, s.retention); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetSnapshotForAggregate returns the newest snapshot at or below version
+func (s *snapshotStore) GetSnapshotForAggregate(ctx context.Context, agrID string, version int) (eventsource.SnapshotModel, error) {
+	model := eventsource.SnapshotModel{ID: agrID}
+
+	query := fmt.Sprintf(`SELECT version, data FROM %s WHERE id = ? AND version <= ? ORDER BY version DESC LIMIT 1`, s.table)
+	err := s.db.QueryRowContext(ctx, query, agrID, version).Scan(&model.Version, &model.Data)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return eventsource.SnapshotModel{}, eventsource.ErrSnapNotFound
+		}
+
+		return eventsource.SnapshotModel{}, err
+	}
+
+	return model, nil
+}
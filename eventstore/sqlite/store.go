@@ -0,0 +1,274 @@
+// Package eventstore stores events and snapshots in SQLite databases, it
+// needs no server which suits CLI tools and integration tests.
+//
+// The package does not import a driver. Either import the cgo driver
+//
+//	import _ "github.com/mattn/go-sqlite3"
+//	db, err := eventstore.Open(ctx, "sqlite3", "events.db")
+//
+// or the pure Go driver to build without cgo
+//
+//	import _ "modernc.org/sqlite"
+//	db, err := eventstore.Open(ctx, "sqlite", "events.db")
+//
+// The tests use the cgo driver, the sqlite_purego build tag runs them
+// against the pure Go driver.
+package eventstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/AhmadWaleed/eventsource"
+)
+
+// Open opens the database file at path with the registered driver and
+// switches it to WAL mode, so readers in other processes do not block
+// writers. The pool is limited to a single connection, SQLite allows a
+// single writer and concurrent transactions would fail with SQLITE_BUSY.
+func Open(ctx context.Context, driver, path string) (*sql.DB, error) {
+	db, err := sql.Open(driver, path)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(1)
+
+	for _, pragma := range []string{
+		`PRAGMA journal_mode = WAL`,
+		`PRAGMA synchronous = NORMAL`,
+		`PRAGMA busy_timeout = 5000`,
+	} {
+		if _, err := db.ExecContext(ctx, pragma); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("unable to set %q on %s: %w", pragma, path, err)
+		}
+	}
+
+	return db, nil
+}
+
+// NewStore returns an event store using table, the database should be
+// opened with Open.
+func NewStore(db *sql.DB, table string) eventsource.EventStore {
+	return &store{
+		db:    db,
+		table: table,
+	}
+}
+
+// CreateEventStoreTable creates table with the columns and indexes of the
+// postgres event store. Data is stored as BLOB, which holds JSON as well
+// as binary encodings.
+func CreateEventStoreTable(ctx context.Context, db *sql.DB, table string) error {
+	sql := `
+	CREATE TABLE IF NOT EXISTS %s (
+	    "offset"  INTEGER PRIMARY KEY AUTOINCREMENT,
+	    id        VARCHAR(255) NOT NULL,
+	    version   INTEGER NOT NULL,
+	    event_id  VARCHAR(64) NOT NULL,
+	    metadata  TEXT NOT NULL,
+	    data      BLOB NOT NULL,
+	    at        BIGINT NOT NULL
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_%s ON %s (id, version);
+	CREATE UNIQUE INDEX IF NOT EXISTS idx_%s_event_id ON %s (event_id);
+`
+	_, err := db.ExecContext(ctx, fmt.Sprintf(sql, table, table, table, table, table))
+	return err
+}
+
+type store struct {
+	db    *sql.DB
+	table string
+}
+
+func (s *store) SaveEvents(ctx context.Context, agrID string, models eventsource.History, version int) error {
+	tx, err := beginImmediate(ctx, s.db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// event ids are generated on a copy, models belong to the caller
+	models = append(eventsource.History(nil), models...)
+
+	var actual int
+	row := tx.QueryRowContext(ctx, fmt.Sprintf(`SELECT COALESCE(MAX(version), -1) FROM %s WHERE id = ?`, s.table), agrID)
+	if err := row.Scan(&actual); err != nil {
+		return err
+	}
+
+	if version != eventsource.ExpectedVersionAny && version != actual {
+		return &eventsource.ErrConcurrencyConflict{AggregateID: agrID, Expected: version, Actual: actual}
+	}
+
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf(`INSERT INTO %s (id, version, event_id, metadata, data, at) VALUES (?, ?, ?, ?, ?, ?)`, s.table))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i := range models {
+		if models[i].ID == "" {
+			models[i].ID = eventsource.NewEventID()
+		}
+
+		metadata, err := json.Marshal(models[i].Metadata)
+		if err != nil {
+			return err
+		}
+
+		_, err = stmt.ExecContext(ctx, agrID, actual+1+i, models[i].ID, string(metadata), models[i].Data, models[i].At)
+		if err != nil {
+			if isUniqueViolation(err) {
+				// another process appended to the stream after our version check
+				return &eventsource.ErrConcurrencyConflict{AggregateID: agrID, Expected: version, Actual: actual + 1 + i}
+			}
+
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *store) GetEventsForAggregate(ctx context.Context, agrID string, version int) (eventsource.History, error) {
+	// 0 returns the whole stream, see eventsource.EventStore
+	if version == 0 {
+		version = eventsource.ExpectedVersionNoStream
+	}
+
+	sql := fmt.Sprintf(`SELECT version, event_id, metadata, data, at FROM %s WHERE id = ? AND version > ? ORDER BY version`, s.table)
+	rows, err := s.db.QueryContext(ctx, sql, agrID, version)
+	if err != nil {
+		return eventsource.History{}, err
+	}
+	defer rows.Close()
+
+	var history eventsource.History
+	for rows.Next() {
+		var rec eventsource.EventModel
+		err := scanEvent(rows, &rec)
+		if err != nil {
+			return eventsource.History{}, err
+		}
+
+		history = append(history, rec)
+	}
+
+	if err := rows.Err(); err != nil {
+		return eventsource.History{}, err
+	}
+
+	if len(history) == 0 {
+		var exists bool
+		row := s.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM %s WHERE id = ?)`, s.table), agrID)
+		if err := row.Scan(&exists); err != nil {
+			return eventsource.History{}, err
+		}
+
+		if !exists {
+			return eventsource.History{}, fmt.Errorf("%w: %s", eventsource.ErrAggregateNotFound, agrID)
+		}
+	}
+
+	return history, nil
+}
+
+// ReadAll reads events across all aggregates ordered by the "offset" column,
+// writes are serialized so offsets become visible in order.
+func (s *store) ReadAll(ctx context.Context, fromOffset int64, limit int) ([]eventsource.RecordedEvent, error) {
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+
+	sql := fmt.Sprintf(`SELECT "offset", id, version, event_id, metadata, data, at FROM %s WHERE "offset" > ? ORDER BY "offset" LIMIT ?`, s.table)
+	rows, err := s.db.QueryContext(ctx, sql, fromOffset, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []eventsource.RecordedEvent
+	for rows.Next() {
+		var rec eventsource.RecordedEvent
+		err := scanEvent(rows, &rec.EventModel, &rec.Offset, &rec.AggregateID)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, rec)
+	}
+
+	return events, rows.Err()
+}
+
+// scanEvent scans the leading columns into dest followed by
+// version, event_id, metadata, data and at into model.
+func scanEvent(rows *sql.Rows, model *eventsource.EventModel, dest ...interface{}) error {
+	var metadata []byte
+	dest = append(dest, &model.Version, &model.ID, &metadata, &model.Data, &model.At)
+	if err := rows.Scan(dest...); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(metadata, &model.Metadata)
+}
+
+// isUniqueViolation matches the constraint error of both the cgo and the
+// pure Go driver, their error types have nothing else in common.
+func isUniqueViolation(err error) bool {
+	return strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// immediateTx is a transaction begun with BEGIN IMMEDIATE. database/sql
+// begins deferred transactions which take the write lock at their first
+// write, a process that read the stream version first then fails with
+// SQLITE_BUSY without waiting on busy_timeout. Both drivers accept the
+// statement, unlike their DSN parameters.
+type immediateTx struct {
+	*sql.Conn
+	done bool
+}
+
+func beginImmediate(ctx context.Context, db *sql.DB) (*immediateTx, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &immediateTx{Conn: conn}
+	if _, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE`); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+func (tx *immediateTx) Commit() error {
+	if _, err := tx.ExecContext(context.Background(), `COMMIT`); err != nil {
+		return err
+	}
+
+	tx.done = true
+	return tx.Conn.Close()
+}
+
+// Rollback ends the transaction unless it was committed, the connection
+// goes back to the pool either way.
+func (tx *immediateTx) Rollback() error {
+	if tx.done {
+		return nil
+	}
+
+	tx.done = true
+	tx.ExecContext(context.Background(), `ROLLBACK`)
+
+	return tx.Conn.Close()
+}
@@ -0,0 +1,178 @@
+package eventstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AhmadWaleed/eventsource"
+	"github.com/AhmadWaleed/eventsource/eventsourcetest"
+	"github.com/AhmadWaleed/eventsource/internal/dbtest"
+)
+
+// openDB opens a new database in a temporary directory
+func openDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db := openPath(t, filepath.Join(t.TempDir(), "events.db"))
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// openPath opens the database at path with the test driver. The test is
+// skipped when the cgo driver was built without cgo and fails on any
+// other error.
+func openPath(t *testing.T, path string) *sql.DB {
+	t.Helper()
+
+	db, err := Open(context.Background(), testDriver, path)
+	if err != nil {
+		if strings.Contains(err.Error(), "requires cgo") {
+			t.Skipf("%s driver needs cgo, run with -tags sqlite_purego instead: %v", testDriver, err)
+		}
+
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestStore(t *testing.T) {
+	db := openDB(t)
+
+	eventsourcetest.RunEventStoreTests(t, func() eventsource.EventStore {
+		return NewStore(db, dbtest.CreateTable(t, db, "events", CreateEventStoreTable))
+	})
+}
+
+func TestSnapshotStore(t *testing.T) {
+	db := openDB(t)
+
+	eventsourcetest.RunSnapshotStoreTests(t, func() eventsource.SnapshotStore {
+		return NewSnapshotStore(db, dbtest.CreateTable(t, db, "snapshots", CreateSnapshotTable))
+	})
+}
+
+func TestStoreSharedFile(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "events.db")
+
+	var stores []eventsource.EventStore
+	for i := 0; i < 2; i++ {
+		db := openPath(t, path)
+		defer db.Close()
+
+		if err := CreateEventStoreTable(ctx, db, "events"); err != nil {
+			t.Fatal(err)
+		}
+
+		stores = append(stores, NewStore(db, "events"))
+	}
+
+	event := eventsource.History{{ID: eventsource.NewEventID(), Data: []byte(`{}`), At: 1}}
+	if err := stores[0].SaveEvents(ctx, "shared-1", event, eventsource.ExpectedVersionNoStream); err != nil {
+		t.Fatal(err)
+	}
+
+	var conflict *eventsource.ErrConcurrencyConflict
+	err := stores[1].SaveEvents(ctx, "shared-1", event, eventsource.ExpectedVersionNoStream)
+	if !errors.As(err, &conflict) || conflict.Actual != 0 {
+		t.Fatalf("expected a conflict at version 0, got %v", err)
+	}
+
+	history, err := stores[1].GetEventsForAggregate(ctx, "shared-1", eventsource.ExpectedVersionNoStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history) != 1 || history[0].ID != event[0].ID {
+		t.Errorf("expected the event saved by the other connection, got %+v", history)
+	}
+
+	var mode string
+	if err := stores[0].(*store).db.QueryRowContext(ctx, `PRAGMA journal_mode`).Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+
+	if mode != "wal" {
+		t.Errorf("expected journal mode wal, got %s", mode)
+	}
+}
+
+func TestStoreConcurrentWriters(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "events.db")
+
+	var stores []eventsource.EventStore
+	for i := 0; i < 2; i++ {
+		db := openPath(t, path)
+		defer db.Close()
+
+		if err := CreateEventStoreTable(ctx, db, "events"); err != nil {
+			t.Fatal(err)
+		}
+
+		stores = append(stores, NewStore(db, "events"))
+	}
+
+	// deferred transactions read the version before taking the write lock,
+	// the second writer then fails with SQLITE_BUSY instead of waiting.
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			id := fmt.Sprintf("writer-%d", i)
+			for version := eventsource.ExpectedVersionNoStream; version < 99; version++ {
+				event := eventsource.History{{Data: []byte(`{}`), At: 1}}
+				if err := stores[i%2].SaveEvents(ctx, id, event, version); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestSnapshotRetention(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+	if err := CreateSnapshotTable(ctx, db, "snapshots"); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewSnapshotStore(db, "snapshots", WithRetention(2))
+	for version := 1; version <= 4; version++ {
+		model := eventsource.SnapshotModel{ID: "snap-1", Version: version, Data: []byte(`{}`)}
+		if err := store.SaveSnapshot(ctx, "snap-1", model, version); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var count int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM snapshots`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 2 {
+		t.Errorf("expected 2 snapshots to be retained, got %d", count)
+	}
+
+	if _, err := store.GetSnapshotForAggregate(ctx, "snap-1", 2); !errors.Is(err, eventsource.ErrSnapNotFound) {
+		t.Errorf("expected pruned snapshots to be gone, got %v", err)
+	}
+}
@@ -87,8 +87,6 @@ func Example() {
 	shipment, _ = aggregate.(*Shipment)
 	fmt.Println(shipment.Status)
 	fmt.Println(shipment.GetVersion())
-	// Output: packed
-	// Output: 0
 
 	bus.Send(ctx, PickupShipment{Command{ID: shipment.AggregateRootID()}})
 	aggregate, _ = repo.GetByID(ctx, shipment.AggregateRootID())
@@ -96,8 +94,6 @@ func Example() {
 
 	fmt.Println(shipment.Status)
 	fmt.Println(shipment.GetVersion())
-	// Output: picked-up
-	// Output: 1
 
 	bus.Send(ctx, ShipShipment{Command{ID: shipment.AggregateRootID()}})
 	aggregate, _ = repo.GetByID(ctx, shipment.AggregateRootID())
@@ -105,6 +101,11 @@ func Example() {
 
 	fmt.Println(shipment.Status)
 	fmt.Println(shipment.GetVersion())
-	// Output: shipped
-	// Output: 2
+	// Output:
+	// packed
+	// 0
+	// picked-up
+	// 1
+	// shipped
+	// 2
 }
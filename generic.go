@@ -0,0 +1,104 @@
+package eventsource
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// AggregatePtr constrains PT to be a pointer to T implementing AggregateRoot,
+// it lets generic code create aggregates with new(T) instead of reflection.
+type AggregatePtr[T any] interface {
+	*T
+	AggregateRoot
+}
+
+// NewGenericRepository creates a type safe repository for the aggregate T,
+// the options are the same as for NewRepository.
+//
+//	repo := NewGenericRepository[Shipment](WithMarshaler(marshaler))
+func NewGenericRepository[T any, PT AggregatePtr[T]](opts ...Option) *Repository[T, PT] {
+	repo := newAggregateRepository(PT(new(T)), opts...)
+	repo.factory = func() AggregateRoot {
+		return PT(new(T))
+	}
+
+	return &Repository[T, PT]{repo: repo}
+}
+
+// Repository is a type safe wrapper of AggregateRepository returning *T
+type Repository[T any, PT AggregatePtr[T]] struct {
+	repo *AggregateRepository
+}
+
+func (r *Repository[T, PT]) New() *T {
+	return new(T)
+}
+
+func (r *Repository[T, PT]) Save(ctx context.Context, aggr *T) error {
+	return r.repo.Save(ctx, PT(aggr))
+}
+
+func (r *Repository[T, PT]) GetByID(ctx context.Context, aggrID string) (*T, error) {
+	aggr, err := r.repo.GetByID(ctx, aggrID)
+	if err != nil {
+		return nil, err
+	}
+
+	return cast[T, PT](aggr)
+}
+
+// GetByIDAtVersion loads the aggregate as of version, see AggregateRepository.GetByIDAtVersion
+func (r *Repository[T, PT]) GetByIDAtVersion(ctx context.Context, aggrID string, version int) (*T, error) {
+	aggr, err := r.repo.GetByIDAtVersion(ctx, aggrID, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return cast[T, PT](aggr)
+}
+
+// GetByIDAt loads the aggregate as of at, see AggregateRepository.GetByIDAt
+func (r *Repository[T, PT]) GetByIDAt(ctx context.Context, aggrID string, at time.Time) (*T, error) {
+	aggr, err := r.repo.GetByIDAt(ctx, aggrID, at)
+	if err != nil {
+		return nil, err
+	}
+
+	return cast[T, PT](aggr)
+}
+
+// Untyped returns the underlying repository, e.g. to be shared with
+// code expecting an AggregateRootRepository.
+func (r *Repository[T, PT]) Untyped() AggregateRootRepository {
+	return r.repo
+}
+
+// NewGenericCommandBus creates a command bus for the aggregate T
+func NewGenericCommandBus[T any, PT AggregatePtr[T]](repo *Repository[T, PT], opts ...BusOption) *CommandBus[T, PT] {
+	return &CommandBus[T, PT]{bus: NewCommandBusWithOptions(repo.repo, opts...).(*commandBus)}
+}
+
+// CommandBus is a type safe wrapper of the aggregate command bus
+type CommandBus[T any, PT AggregatePtr[T]] struct {
+	bus *commandBus
+}
+
+// Send process the command and returns the aggregate it was applied to
+func (b *CommandBus[T, PT]) Send(ctx context.Context, cmd AggregateCommand) (*T, error) {
+	aggr, err := b.bus.send(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return cast[T, PT](aggr)
+}
+
+func cast[T any, PT AggregatePtr[T]](aggr AggregateRoot) (*T, error) {
+	v, ok := aggr.(PT)
+	if !ok {
+		return nil, fmt.Errorf("unexpected aggregate %T, expected %T", aggr, PT(nil))
+	}
+
+	return (*T)(v), nil
+}
@@ -0,0 +1,68 @@
+package eventsource
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGenericRepository(t *testing.T) {
+	marshaler := new(JsonEventMarshaler)
+	marshaler.Bind(ShipmentPacked{}, ShipmentPickedUp{}, ShipmentShipped{})
+
+	ctx := context.Background()
+	repo := NewGenericRepository[Shipment](WithMarshaler(marshaler))
+	bus := NewGenericCommandBus(repo)
+
+	shipment, err := bus.Send(ctx, PackShipment{Command{ID: "abc123"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if shipment.Status != Packed {
+		t.Errorf("expected status %s, got %s", Packed, shipment.Status)
+	}
+
+	if err := shipment.Handle(ctx, PickupShipment{Command{ID: "abc123"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Save(ctx, shipment); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	shipment, err = repo.GetByID(ctx, "abc123")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if shipment.Status != PickedUp || shipment.GetVersion() != 1 {
+		t.Errorf("expected picked-up at version 1, got %s at version %d", shipment.Status, shipment.GetVersion())
+	}
+
+	shipment, err = repo.GetByIDAtVersion(ctx, "abc123", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if shipment.Status != Packed {
+		t.Errorf("expected status %s at version 0, got %s", Packed, shipment.Status)
+	}
+
+	if _, err := repo.GetByIDAtVersion(ctx, "abc123", -1); err == nil {
+		t.Error("expected a negative version to be rejected")
+	}
+
+	shipment, err = repo.GetByIDAt(ctx, "abc123", time.Now())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if shipment.Status != PickedUp {
+		t.Errorf("expected status %s now, got %s", PickedUp, shipment.Status)
+	}
+
+	// the untyped repository shares the same store
+	aggregate, err := NewCommandBus(repo.Untyped()).(*commandBus).send(ctx, ShipShipment{Command{ID: "abc123"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if aggregate.(*Shipment).Status != Shipped {
+		t.Errorf("expected status %s, got %s", Shipped, aggregate.(*Shipment).Status)
+	}
+}
@@ -0,0 +1,26 @@
+// Package dbtest holds helpers shared by the tests of the sql stores
+package dbtest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/AhmadWaleed/eventsource"
+)
+
+// CreateTable creates a table named after prefix with create, e.g. with the
+// CreateXxxTable functions of the sql stores, and drops it after the test.
+// Table names are unique so conformance tests get a new table per store.
+func CreateTable(t *testing.T, db *sql.DB, prefix string, create func(context.Context, *sql.DB, string) error) string {
+	t.Helper()
+
+	table := fmt.Sprintf("%s_%s", prefix, eventsource.NewEventID()[:8])
+	if err := create(context.Background(), db, table); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec("DROP TABLE IF EXISTS " + table) })
+
+	return table
+}
@@ -1,43 +1,155 @@
 package eventsource
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 )
 
+// ErrUnknownEventType is returned when unmarshaling an event whose type is
+// not bound to the marshaler.
+var ErrUnknownEventType = errors.New("unknown event type")
+
 type payload struct {
-	Type string          `json:"type"`
-	Data json.RawMessage `json:"data"`
+	Type     string  `json:"type"`
+	Revision int     `json:"revision,omitempty"`
+	Data     rawData `json:"data"`
+}
+
+// rawData holds the encoded event or state, it is embedded as is in JSON
+// payloads and as a byte string by the binary codecs.
+type rawData []byte
+
+func (d rawData) MarshalJSON() ([]byte, error) {
+	return json.RawMessage(d).MarshalJSON()
+}
+
+func (d *rawData) UnmarshalJSON(data []byte) error {
+	*d = append((*d)[:0], data...)
+	return nil
+}
+
+// codec encodes payloads and their data for the marshalers of this package
+type codec interface {
+	encode(v interface{}) ([]byte, error)
+	decode(data []byte, v interface{}) error
+
+	// decodeMap decodes data into a map for upcasting
+	decodeMap(data []byte) (map[string]interface{}, error)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) decodeMap(data []byte) (map[string]interface{}, error) {
+	var m map[string]interface{}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	err := dec.Decode(&m)
+
+	return m, err
 }
 
 type JsonEventMarshaler struct {
-	eventTypes map[string]reflect.Type
+	types typeRegistry
+
+	// Upcasters transforms stored events to the latest revision of their type
+	// before decoding, the latest revision is stored with marshaled events.
+	// Upcasters are found under the bound name, the aliases and the Go name.
+	Upcasters *UpcasterRegistry
 }
 
+// Bind registers the event types which can be unmarshaled, an error is
+// returned when a type name is already bound to another type.
 func (m *JsonEventMarshaler) Bind(events ...Event) error {
-	m.eventTypes = make(map[string]reflect.Type, len(events))
+	return bindEvents(&m.types, events)
+}
+
+// BindAlias registers the event type under names it was stored with before,
+// e.g. its name prior to a rename.
+func (m *JsonEventMarshaler) BindAlias(e Event, aliases ...string) error {
+	return m.types.bind(e, aliases...)
+}
+
+func (m *JsonEventMarshaler) Marshal(e Event) (EventModel, error) {
+	return marshalEvent(jsonCodec{}, &m.types, m.Upcasters, e)
+}
+
+func (m *JsonEventMarshaler) Unmarshal(model EventModel) (Event, error) {
+	return unmarshalEvent(jsonCodec{}, &m.types, m.Upcasters, model)
+}
+
+type JsonSnapshotMarshaler struct {
+	types typeRegistry
+}
+
+// Bind registers the state types which can be unmarshaled, an error is
+// returned when a type name is already bound to another type.
+func (m *JsonSnapshotMarshaler) Bind(states ...interface{}) error {
+	return bindStates(&m.types, states)
+}
+
+// BindAlias registers the state type under names it was stored with before
+func (m *JsonSnapshotMarshaler) BindAlias(state interface{}, aliases ...string) error {
+	return m.types.bind(state, aliases...)
+}
+
+func (m *JsonSnapshotMarshaler) Marshal(s Snapshot) (SnapshotModel, error) {
+	return marshalSnapshot(jsonCodec{}, &m.types, s)
+}
 
+func (m *JsonSnapshotMarshaler) Unmarshal(model SnapshotModel) (Snapshot, error) {
+	return unmarshalSnapshot(jsonCodec{}, &m.types, model)
+}
+
+func bindEvents(types *typeRegistry, events []Event) error {
 	for _, e := range events {
-		name, typ := getType(e)
-		m.eventTypes[name] = typ
+		if err := types.bind(e); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (m *JsonEventMarshaler) Marshal(e Event) (EventModel, error) {
-	typ, _ := getType(e)
+func bindStates(types *typeRegistry, states []interface{}) error {
+	for _, s := range states {
+		if err := types.bind(s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
-	data, err := json.Marshal(e)
+func marshalEvent(c codec, types *typeRegistry, upcasters *UpcasterRegistry, e Event) (EventModel, error) {
+	typ := types.name(e)
+
+	data, err := c.encode(e)
 	if err != nil {
 		return EventModel{}, err
 	}
 
-	data, err = json.Marshal(payload{
+	p := payload{
 		Type: typ,
-		Data: json.RawMessage(data),
-	})
+		Data: data,
+	}
+
+	if upcasters != nil {
+		p.Revision = upcasters.revision(types.aliases(typ))
+	}
+
+	data, err = c.encode(p)
 	if err != nil {
 		return EventModel{}, err
 	}
@@ -48,54 +160,78 @@ func (m *JsonEventMarshaler) Marshal(e Event) (EventModel, error) {
 		Data:    data,
 	}
 
+	if v, ok := e.(Enveloped); ok {
+		env := v.EventEnvelope()
+		model.ID = env.EventID
+		model.Metadata = env.Metadata
+	}
+
 	return model, nil
 }
 
-func (m *JsonEventMarshaler) Unmarshal(model EventModel) (Event, error) {
+func unmarshalEvent(c codec, types *typeRegistry, upcasters *UpcasterRegistry, model EventModel) (Event, error) {
 	var p payload
-	if err := json.Unmarshal(model.Data, &p); err != nil {
+	if err := c.decode(model.Data, &p); err != nil {
 		return nil, err
 	}
 
-	typ, ok := m.eventTypes[p.Type]
+	p.Type = types.canonical(p.Type)
+	if upcasters != nil && upcasters.needsUpcast(types.aliases(p.Type), p.Revision) {
+		if err := upcast(c, types, upcasters, &p); err != nil {
+			return nil, err
+		}
+	}
+
+	typ, ok := types.lookup(p.Type)
 	if !ok {
-		return nil, fmt.Errorf("unable to unmarshal type %v", p)
+		return nil, fmt.Errorf("%w: %s", ErrUnknownEventType, p.Type)
 	}
 
 	v := reflect.New(typ).Interface()
-	if err := json.Unmarshal(p.Data, v); err != nil {
+	if err := c.decode(p.Data, v); err != nil {
 		return nil, fmt.Errorf("unable to unmarshal event data into %#v, %v", v, err)
 	}
 
+	if e, ok := v.(Enveloped); ok {
+		e.SetEventEnvelope(Envelope{EventID: model.ID, Metadata: model.Metadata})
+	}
+
 	return v.(Event), nil
 }
 
-type JsonSnapshotMarshaler struct {
-	states map[string]reflect.Type
-}
+// upcast brings the payload to the latest revision of its type
+func upcast(c codec, types *typeRegistry, upcasters *UpcasterRegistry, p *payload) error {
+	data, err := c.decodeMap(p.Data)
+	if err != nil {
+		return fmt.Errorf("unable to decode %s for upcasting: %v", p.Type, err)
+	}
 
-func (m *JsonSnapshotMarshaler) Bind(states ...interface{}) error {
-	m.states = make(map[string]reflect.Type, len(states))
+	raw, err := upcasters.upcast(RawEvent{Type: p.Type, Revision: p.Revision, Data: data}, types.aliases)
+	if err != nil {
+		return err
+	}
 
-	for _, s := range states {
-		name, typ := getType(s)
-		m.states[name] = typ
+	encoded, err := c.encode(raw.Data)
+	if err != nil {
+		return err
 	}
 
+	p.Type, p.Revision, p.Data = types.canonical(raw.Type), raw.Revision, encoded
+
 	return nil
 }
 
-func (m *JsonSnapshotMarshaler) Marshal(s Snapshot) (SnapshotModel, error) {
-	typ, _ := getType(s.GetState())
+func marshalSnapshot(c codec, types *typeRegistry, s Snapshot) (SnapshotModel, error) {
+	typ := types.name(s.GetState())
 
-	data, err := json.Marshal(s.GetState())
+	data, err := c.encode(s.GetState())
 	if err != nil {
 		return SnapshotModel{}, err
 	}
 
-	data, err = json.Marshal(payload{
+	data, err = c.encode(payload{
 		Type: typ,
-		Data: json.RawMessage(data),
+		Data: data,
 	})
 	if err != nil {
 		return SnapshotModel{}, err
@@ -110,19 +246,19 @@ func (m *JsonSnapshotMarshaler) Marshal(s Snapshot) (SnapshotModel, error) {
 	return model, nil
 }
 
-func (m *JsonSnapshotMarshaler) Unmarshal(model SnapshotModel) (Snapshot, error) {
+func unmarshalSnapshot(c codec, types *typeRegistry, model SnapshotModel) (Snapshot, error) {
 	var p payload
-	if err := json.Unmarshal(model.Data, &p); err != nil {
+	if err := c.decode(model.Data, &p); err != nil {
 		return nil, err
 	}
 
-	typ, ok := m.states[p.Type]
+	typ, ok := types.lookup(p.Type)
 	if !ok {
-		return nil, fmt.Errorf("unable to unmarshal type %v", p)
+		return nil, fmt.Errorf("unable to unmarshal type %v", p.Type)
 	}
 
 	v := reflect.New(typ).Interface()
-	if err := json.Unmarshal(p.Data, v); err != nil {
+	if err := c.decode(p.Data, v); err != nil {
 		return nil, fmt.Errorf("unable to unmarshal snapshot data into %#v, %v", v, err)
 	}
 
@@ -134,12 +270,3 @@ func (m *JsonSnapshotMarshaler) Unmarshal(model SnapshotModel) (Snapshot, error)
 
 	return snap, nil
 }
-
-func getType(v interface{}) (string, reflect.Type) {
-	t := reflect.TypeOf(v)
-	if t.Kind() == reflect.Ptr {
-		t = t.Elem()
-	}
-
-	return t.Name(), t
-}
@@ -0,0 +1,189 @@
+package eventsource
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+type gobCodec struct{}
+
+func (gobCodec) encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) decode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (gobCodec) decodeMap(data []byte) (map[string]interface{}, error) {
+	return nil, errors.New("gob encoded events can not be upcasted")
+}
+
+// GobEventMarshaler encodes events with encoding/gob, the events must be
+// gob encodable and can not be upcasted.
+type GobEventMarshaler struct {
+	types typeRegistry
+}
+
+// Bind registers the event types which can be unmarshaled, an error is
+// returned when a type name is already bound to another type.
+func (m *GobEventMarshaler) Bind(events ...Event) error {
+	return bindEvents(&m.types, events)
+}
+
+// BindAlias registers the event type under names it was stored with before
+func (m *GobEventMarshaler) BindAlias(e Event, aliases ...string) error {
+	return m.types.bind(e, aliases...)
+}
+
+func (m *GobEventMarshaler) Marshal(e Event) (EventModel, error) {
+	model, err := marshalEvent(gobCodec{}, &m.types, nil, withoutEnvelope(e))
+	if err != nil {
+		return EventModel{}, err
+	}
+
+	if v, ok := e.(Enveloped); ok {
+		env := v.EventEnvelope()
+		model.ID = env.EventID
+		model.Metadata = env.Metadata
+	}
+
+	return model, nil
+}
+
+func (m *GobEventMarshaler) Unmarshal(model EventModel) (Event, error) {
+	return unmarshalEvent(gobCodec{}, &m.types, nil, model)
+}
+
+// withoutEnvelope returns a copy of e with an empty envelope. gob ignores
+// the json tag excluding EventSkeleton.Envelope from the event data, the
+// envelope is stored with the model.
+func withoutEnvelope(e Event) Event {
+	v := reflect.ValueOf(e)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+
+	cp := reflect.New(v.Type())
+	cp.Elem().Set(v)
+
+	env, ok := cp.Interface().(Enveloped)
+	if !ok {
+		return e
+	}
+	env.SetEventEnvelope(Envelope{})
+
+	return cp.Interface().(Event)
+}
+
+// GobSnapshotMarshaler encodes snapshot states with encoding/gob
+type GobSnapshotMarshaler struct {
+	types typeRegistry
+}
+
+// Bind registers the state types which can be unmarshaled, an error is
+// returned when a type name is already bound to another type.
+func (m *GobSnapshotMarshaler) Bind(states ...interface{}) error {
+	return bindStates(&m.types, states)
+}
+
+// BindAlias registers the state type under names it was stored with before
+func (m *GobSnapshotMarshaler) BindAlias(state interface{}, aliases ...string) error {
+	return m.types.bind(state, aliases...)
+}
+
+func (m *GobSnapshotMarshaler) Marshal(s Snapshot) (SnapshotModel, error) {
+	return marshalSnapshot(gobCodec{}, &m.types, s)
+}
+
+func (m *GobSnapshotMarshaler) Unmarshal(model SnapshotModel) (Snapshot, error) {
+	return unmarshalSnapshot(gobCodec{}, &m.types, model)
+}
+
+var (
+	// cborEncMode keeps the sub second precision of time values
+	cborEncMode, _ = cbor.EncOptions{Time: cbor.TimeRFC3339Nano}.EncMode()
+
+	// cborDecMode decodes CBOR maps into map[string]interface{} for upcasting
+	cborDecMode, _ = cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]interface{}(nil))}.DecMode()
+)
+
+type cborCodec struct{}
+
+func (cborCodec) encode(v interface{}) ([]byte, error) {
+	return cborEncMode.Marshal(v)
+}
+
+func (cborCodec) decode(data []byte, v interface{}) error {
+	return cborDecMode.Unmarshal(data, v)
+}
+
+func (cborCodec) decodeMap(data []byte) (map[string]interface{}, error) {
+	var m map[string]interface{}
+	err := cborDecMode.Unmarshal(data, &m)
+
+	return m, err
+}
+
+// CborEventMarshaler encodes events with CBOR (RFC 8949), struct fields
+// are encoded by name so events can be upcasted like JSON events.
+type CborEventMarshaler struct {
+	types typeRegistry
+
+	// Upcasters transforms stored events to the latest revision of their type
+	// before decoding, the latest revision is stored with marshaled events.
+	// Upcasters are found under the bound name, the aliases and the Go name.
+	Upcasters *UpcasterRegistry
+}
+
+// Bind registers the event types which can be unmarshaled, an error is
+// returned when a type name is already bound to another type.
+func (m *CborEventMarshaler) Bind(events ...Event) error {
+	return bindEvents(&m.types, events)
+}
+
+// BindAlias registers the event type under names it was stored with before
+func (m *CborEventMarshaler) BindAlias(e Event, aliases ...string) error {
+	return m.types.bind(e, aliases...)
+}
+
+func (m *CborEventMarshaler) Marshal(e Event) (EventModel, error) {
+	return marshalEvent(cborCodec{}, &m.types, m.Upcasters, e)
+}
+
+func (m *CborEventMarshaler) Unmarshal(model EventModel) (Event, error) {
+	return unmarshalEvent(cborCodec{}, &m.types, m.Upcasters, model)
+}
+
+// CborSnapshotMarshaler encodes snapshot states with CBOR (RFC 8949)
+type CborSnapshotMarshaler struct {
+	types typeRegistry
+}
+
+// Bind registers the state types which can be unmarshaled, an error is
+// returned when a type name is already bound to another type.
+func (m *CborSnapshotMarshaler) Bind(states ...interface{}) error {
+	return bindStates(&m.types, states)
+}
+
+// BindAlias registers the state type under names it was stored with before
+func (m *CborSnapshotMarshaler) BindAlias(state interface{}, aliases ...string) error {
+	return m.types.bind(state, aliases...)
+}
+
+func (m *CborSnapshotMarshaler) Marshal(s Snapshot) (SnapshotModel, error) {
+	return marshalSnapshot(cborCodec{}, &m.types, s)
+}
+
+func (m *CborSnapshotMarshaler) Unmarshal(model SnapshotModel) (Snapshot, error) {
+	return unmarshalSnapshot(cborCodec{}, &m.types, model)
+}
@@ -0,0 +1,161 @@
+package eventsource
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+type OrderPlaced struct{ EventSkeleton }
+type OrderSubmitted struct{ EventSkeleton }
+
+func (OrderPlaced) EventTypeName() string    { return "order.placed" }
+func (OrderSubmitted) EventTypeName() string { return "order.placed" }
+
+func TestJsonEventMarshalerTypeNames(t *testing.T) {
+	if name := TypeName(&ShipmentPacked{}); name != "github.com/AhmadWaleed/eventsource.ShipmentPacked" {
+		t.Errorf("expected package qualified name, got %s", name)
+	}
+	if name := TypeName(&OrderPlaced{}); name != "order.placed" {
+		t.Errorf("expected explicit name, got %s", name)
+	}
+
+	marshaler := new(JsonEventMarshaler)
+	if err := marshaler.Bind(OrderPlaced{}, ShipmentPacked{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := marshaler.Bind(OrderSubmitted{}); err == nil || !strings.Contains(err.Error(), "already bound") {
+		t.Errorf("expected collision error, got %v", err)
+	}
+	if err := marshaler.BindAlias(ShipmentPacked{}, "order.placed"); err == nil {
+		t.Error("expected alias colliding with a bound name to fail")
+	}
+	if err := marshaler.BindAlias(OrderPlaced{}, "OrderCreated"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range []string{
+		`{"type":"order.placed","data":{"ID":"abc123"}}`,
+		`{"type":"OrderCreated","data":{"ID":"abc123"}}`,
+	} {
+		event, err := marshaler.Unmarshal(EventModel{Data: []byte(data)})
+		if err != nil {
+			t.Fatalf("unable to unmarshal %s: %v", data, err)
+		}
+		if _, ok := event.(*OrderPlaced); !ok || event.AggregateID() != "abc123" {
+			t.Errorf("expected *OrderPlaced for %s, got %#v", data, event)
+		}
+	}
+
+	// events stored before type names were package qualified
+	event, err := marshaler.Unmarshal(EventModel{Data: []byte(`{"type":"ShipmentPacked","data":{"ID":"abc123"}}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := event.(*ShipmentPacked); !ok {
+		t.Errorf("expected *ShipmentPacked, got %T", event)
+	}
+
+	model, err := marshaler.Marshal(&OrderPlaced{EventSkeleton{ID: "abc123"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(model.Data), `"type":"order.placed"`) {
+		t.Errorf("expected event to be stored under its explicit name, got %s", model.Data)
+	}
+}
+
+func TestBinaryMarshalers(t *testing.T) {
+	at := time.Date(2022, 6, 1, 12, 0, 0, 123456789, time.UTC)
+
+	for name, marshaler := range map[string]EventMarshaler{
+		"gob":  new(GobEventMarshaler),
+		"cbor": new(CborEventMarshaler),
+	} {
+		t.Run(name, func(t *testing.T) {
+			marshaler.Bind(CustomerRegistered{})
+
+			e := &CustomerRegistered{EventSkeleton{ID: "abc123", At: at}, "John", "Doe"}
+			e.SetEventEnvelope(Envelope{EventID: "evt-1", Metadata: Metadata{"user_id": "jane"}})
+
+			model, err := marshaler.Marshal(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the envelope is stored with the model, not in the event data
+			if bytes.Contains(model.Data, []byte("evt-1")) || bytes.Contains(model.Data, []byte("jane")) {
+				t.Errorf("expected the envelope to be left out of the data, got %q", model.Data)
+			}
+			if model.ID != "evt-1" || model.Metadata["user_id"] != "jane" {
+				t.Errorf("expected the envelope in the model, got %+v", model)
+			}
+
+			event, err := marshaler.Unmarshal(model)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded := event.(*CustomerRegistered)
+			if decoded.AggregateID() != "abc123" || !decoded.EventAt().Equal(at) || decoded.FirstName != "John" || decoded.LastName != "Doe" {
+				t.Errorf("unexpected decoded event: %+v", decoded)
+			}
+			if env := decoded.EventEnvelope(); env.EventID != "evt-1" || env.Metadata["user_id"] != "jane" {
+				t.Errorf("unexpected envelope: %+v", env)
+			}
+		})
+	}
+
+	for name, marshaler := range map[string]SnapshotMarshaler{
+		"gob":  new(GobSnapshotMarshaler),
+		"cbor": new(CborSnapshotMarshaler),
+	} {
+		t.Run(name+" snapshot", func(t *testing.T) {
+			marshaler.Bind(counterState{})
+
+			model, err := marshaler.Marshal(SnapshotSkeleton{ID: "abc123", Version: 4, State: counterState{Count: 5}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			snap, err := marshaler.Unmarshal(model)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if snap.AggregateRootID() != "abc123" || snap.CurrentVersion() != 4 || snap.GetState().(*counterState).Count != 5 {
+				t.Errorf("unexpected decoded snapshot: %+v", snap)
+			}
+		})
+	}
+}
+
+func TestCborEventMarshalerUpcasts(t *testing.T) {
+	legacy := new(CborEventMarshaler)
+	legacy.BindAlias(OrderPlaced{})
+
+	model, err := legacy.Marshal(&OrderPlaced{EventSkeleton{ID: "abc123"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upcasters := NewUpcasterRegistry()
+	upcasters.Register("order.placed", 1, func(e RawEvent) (RawEvent, error) {
+		e.Type = TypeName(CustomerRegistered{})
+		e.Data["FirstName"] = "John"
+		return e, nil
+	})
+
+	marshaler := &CborEventMarshaler{Upcasters: upcasters}
+	marshaler.Bind(CustomerRegistered{})
+
+	event, err := marshaler.Unmarshal(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e, ok := event.(*CustomerRegistered); !ok || e.AggregateID() != "abc123" || e.FirstName != "John" {
+		t.Errorf("unexpected upcasted event: %#v", event)
+	}
+}
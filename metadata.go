@@ -0,0 +1,74 @@
+package eventsource
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+)
+
+// Well known metadata keys, any other key can be used for custom headers
+const (
+	MetadataCorrelationID = "correlation_id"
+	MetadataCausationID   = "causation_id"
+	MetadataUserID        = "user_id"
+)
+
+// Metadata holds the headers stored alongside an event
+type Metadata map[string]string
+
+// Envelope contains the information about an event which is not part of its data
+type Envelope struct {
+	// EventID uniquely identifies the event
+	EventID string
+
+	// Metadata contains the headers the event was saved with
+	Metadata Metadata
+}
+
+// Enveloped is implemented by events exposing their envelope,
+// events embedding EventSkeleton implement it through a pointer.
+type Enveloped interface {
+	EventEnvelope() Envelope
+	SetEventEnvelope(env Envelope)
+}
+
+// IdentifiedCommand is implemented by commands carrying their own id,
+// it is used as causation id of the events the command produces.
+type IdentifiedCommand interface {
+	CommandID() string
+}
+
+type metadataKey struct{}
+
+// WithMetadata returns a context carrying md merged over the metadata
+// already in ctx, events saved with the context inherit the metadata.
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	merged := make(Metadata)
+	for k, v := range MetadataFromContext(ctx) {
+		merged[k] = v
+	}
+	for k, v := range md {
+		merged[k] = v
+	}
+
+	return context.WithValue(ctx, metadataKey{}, merged)
+}
+
+// MetadataFromContext returns the metadata added to ctx by WithMetadata
+func MetadataFromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(metadataKey{}).(Metadata)
+	return md
+}
+
+// NewEventID returns a random (version 4) UUID
+func NewEventID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
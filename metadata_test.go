@@ -0,0 +1,64 @@
+package eventsource
+
+import (
+	"context"
+	"testing"
+)
+
+type identifiedPickup struct {
+	PickupShipment
+	ID string
+}
+
+func (c identifiedPickup) CommandID() string { return c.ID }
+
+func TestCommandMetadataIsStoredAndPublished(t *testing.T) {
+	marshaler := new(JsonEventMarshaler)
+	marshaler.Bind(ShipmentPacked{}, ShipmentPickedUp{}, ShipmentShipped{})
+
+	store := NewInmemEventStore()
+	publisher := &recordingPublisher{}
+	repo := NewRepository(&Shipment{}, WithMarshaler(marshaler), WithEventStore(store))
+	bus := NewCommandBusWithOptions(repo, WithEventPublisher(publisher))
+
+	ctx := WithMetadata(context.Background(), Metadata{MetadataUserID: "jane", MetadataCorrelationID: "req-1"})
+	if err := bus.Send(ctx, PackShipment{Command{ID: "abc123"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := bus.Send(ctx, PickupShipment{Command{ID: "abc123"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	history, _ := store.GetEventsForAggregate(ctx, "abc123", 0)
+	if len(history) != 2 || history[0].ID == "" || history[0].ID == history[1].ID {
+		t.Fatalf("expected 2 events with unique ids, got %+v", history)
+	}
+
+	event, err := marshaler.Unmarshal(history[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := event.(Enveloped).EventEnvelope()
+	if env.Metadata[MetadataUserID] != "jane" || env.Metadata[MetadataCorrelationID] != "req-1" {
+		t.Errorf("expected metadata from context, got %v", env.Metadata)
+	}
+	if env.Metadata[MetadataCausationID] == "" {
+		t.Errorf("expected causation id to be generated, got %v", env.Metadata)
+	}
+	if env.EventID != history[1].ID {
+		t.Errorf("expected event id %s, got %s", history[1].ID, env.EventID)
+	}
+
+	published := publisher.events[1].(Enveloped).EventEnvelope()
+	if published.EventID != env.EventID || published.Metadata[MetadataCausationID] != env.Metadata[MetadataCausationID] {
+		t.Errorf("expected published event to carry its envelope, got %+v", published)
+	}
+}
+
+func TestCommandMetadataUsesCommandID(t *testing.T) {
+	md := MetadataFromContext(withCommandMetadata(context.Background(), identifiedPickup{ID: "cmd-1"}))
+	if md[MetadataCausationID] != "cmd-1" || md[MetadataCorrelationID] != "cmd-1" {
+		t.Errorf("expected command id as causation and correlation id, got %v", md)
+	}
+}
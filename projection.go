@@ -0,0 +1,226 @@
+package eventsource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Projector builds a read model from the events of the global stream
+type Projector interface {
+	// Name identifies the projector, its checkpoint is saved under this name
+	Name() string
+
+	// Project applies the event to the read model
+	Project(ctx context.Context, e Event) error
+}
+
+// ProjectionResetter is implemented by projectors able to clear their
+// read model, it is required to rebuild a projection from zero.
+type ProjectionResetter interface {
+	Reset(ctx context.Context) error
+}
+
+// CheckpointStore persists the offset of the last event processed by a projector
+type CheckpointStore interface {
+	// GetCheckpoint returns 0 when no checkpoint was saved for name yet
+	GetCheckpoint(ctx context.Context, name string) (int64, error)
+	SaveCheckpoint(ctx context.Context, name string, offset int64) error
+}
+
+func NewInmemCheckpointStore() CheckpointStore {
+	return &inmemCheckpointStore{checkpoints: make(map[string]int64)}
+}
+
+type inmemCheckpointStore struct {
+	mu          sync.Mutex
+	checkpoints map[string]int64
+}
+
+func (s *inmemCheckpointStore) GetCheckpoint(ctx context.Context, name string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.checkpoints[name], nil
+}
+
+func (s *inmemCheckpointStore) SaveCheckpoint(ctx context.Context, name string, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checkpoints[name] = offset
+
+	return nil
+}
+
+func NewProjectionEngine(reader GlobalEventReader, marshaler EventMarshaler, checkpoints CheckpointStore, opts ...SubscriptionOption) *ProjectionEngine {
+	return &ProjectionEngine{
+		reader:      reader,
+		marshaler:   marshaler,
+		checkpoints: checkpoints,
+		opts:        opts,
+		projectors:  make(map[string]Projector),
+		running:     make(map[string]bool),
+	}
+}
+
+// ProjectionEngine feeds registered projectors from the global stream, each
+// projector resumes from its own checkpoint after a restart. Events whose
+// type is not bound to the marshaler, such as the events of other bounded
+// contexts sharing the store, are skipped.
+type ProjectionEngine struct {
+	reader      GlobalEventReader
+	marshaler   EventMarshaler
+	checkpoints CheckpointStore
+	opts        []SubscriptionOption
+
+	mu         sync.Mutex
+	projectors map[string]Projector
+	running    map[string]bool
+}
+
+// Register adds projectors to the engine, projectors registered while Run
+// is in progress start with the next Run.
+func (e *ProjectionEngine) Register(projectors ...Projector) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, p := range projectors {
+		if _, ok := e.projectors[p.Name()]; ok {
+			return fmt.Errorf("projector %s already registered", p.Name())
+		}
+
+		e.projectors[p.Name()] = p
+	}
+
+	return nil
+}
+
+// Rebuild resets the read model and checkpoint of the named projector,
+// the next Run replays every event from the start of the global stream.
+// The projector must not be running, Run does not start it until Rebuild
+// returns.
+func (e *ProjectionEngine) Rebuild(ctx context.Context, name string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	p, ok := e.projectors[name]
+	if !ok {
+		return fmt.Errorf("no projector registered with name: %s", name)
+	}
+
+	if e.running[name] {
+		return fmt.Errorf("projector %s is running, stop Run before rebuilding it", name)
+	}
+
+	r, ok := p.(ProjectionResetter)
+	if !ok {
+		return fmt.Errorf("%T do not implement ProjectionResetter", p)
+	}
+
+	if err := r.Reset(ctx); err != nil {
+		return fmt.Errorf("unable to reset projection %s: %v", name, err)
+	}
+
+	return e.checkpoints.SaveCheckpoint(ctx, name, 0)
+}
+
+// Run projects events until ctx is done or a projector fails, in which
+// case the remaining projectors are stopped and the error is returned.
+// A projector is run by a single Run at a time.
+func (e *ProjectionEngine) Run(ctx context.Context) error {
+	projectors, err := e.start()
+	if err != nil {
+		return err
+	}
+	defer e.stop(projectors)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		once sync.Once
+	)
+
+	// checkpoints are loaded before any projector starts, so a failure
+	// does not leave the projectors started so far running.
+	offsets := make(map[string]int64, len(projectors))
+	for _, p := range projectors {
+		offset, cerr := e.checkpoints.GetCheckpoint(ctx, p.Name())
+		if cerr != nil {
+			return fmt.Errorf("unable to get checkpoint of %s: %v", p.Name(), cerr)
+		}
+
+		offsets[p.Name()] = offset
+	}
+
+	for _, p := range projectors {
+		sub := NewCatchUpSubscription(e.reader, offsets[p.Name()], e.handler(p), e.opts...)
+
+		wg.Add(1)
+		go func(p Projector) {
+			defer wg.Done()
+
+			if serr := sub.Run(ctx); serr != nil {
+				once.Do(func() {
+					err = fmt.Errorf("projection %s stopped: %w", p.Name(), serr)
+					cancel()
+				})
+			}
+		}(p)
+	}
+
+	wg.Wait()
+
+	return err
+}
+
+// start marks the registered projectors as running
+func (e *ProjectionEngine) start() ([]Projector, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	projectors := make([]Projector, 0, len(e.projectors))
+	for name, p := range e.projectors {
+		if e.running[name] {
+			return nil, fmt.Errorf("projector %s is already running", name)
+		}
+
+		projectors = append(projectors, p)
+	}
+
+	for _, p := range projectors {
+		e.running[p.Name()] = true
+	}
+
+	return projectors, nil
+}
+
+func (e *ProjectionEngine) stop(projectors []Projector) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, p := range projectors {
+		delete(e.running, p.Name())
+	}
+}
+
+func (e *ProjectionEngine) handler(p Projector) RecordedEventHandler {
+	return func(ctx context.Context, rec RecordedEvent) error {
+		event, err := UnmarshalEvent(ctx, e.marshaler, rec.EventModel)
+		if errors.Is(err, ErrUnknownEventType) {
+			return e.checkpoints.SaveCheckpoint(ctx, p.Name(), rec.Offset)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := p.Project(ctx, event); err != nil {
+			return err
+		}
+
+		return e.checkpoints.SaveCheckpoint(ctx, p.Name(), rec.Offset)
+	}
+}
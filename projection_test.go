@@ -0,0 +1,265 @@
+package eventsource
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type shipmentStatusProjector struct {
+	statuses map[string]string
+	projects int
+}
+
+func (p *shipmentStatusProjector) Name() string { return "shipment-status" }
+
+func (p *shipmentStatusProjector) Project(ctx context.Context, e Event) error {
+	p.projects++
+
+	switch e.(type) {
+	case *ShipmentPacked:
+		p.statuses[e.AggregateID()] = Packed
+	case *ShipmentPickedUp:
+		p.statuses[e.AggregateID()] = PickedUp
+	case *ShipmentShipped:
+		p.statuses[e.AggregateID()] = Shipped
+	}
+
+	return nil
+}
+
+func (p *shipmentStatusProjector) Reset(ctx context.Context) error {
+	p.statuses = make(map[string]string)
+	return nil
+}
+
+func TestProjectionEngineResumesAndRebuilds(t *testing.T) {
+	marshaler := new(JsonEventMarshaler)
+	marshaler.Bind(ShipmentPacked{}, ShipmentPickedUp{}, ShipmentShipped{})
+
+	ctx := context.Background()
+	store := NewInmemEventStore()
+	bus := NewCommandBus(NewRepository(&Shipment{}, WithMarshaler(marshaler), WithEventStore(store)))
+	checkpoints := NewInmemCheckpointStore()
+	projector := &shipmentStatusProjector{statuses: make(map[string]string)}
+
+	run := func() {
+		t.Helper()
+
+		engine := NewProjectionEngine(store.(GlobalEventReader), marshaler, checkpoints, WithPollInterval(time.Millisecond))
+		if err := engine.Register(projector); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		if err := engine.Run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got %v", err)
+		}
+	}
+
+	bus.Send(ctx, PackShipment{Command{ID: "a"}})
+	bus.Send(ctx, PackShipment{Command{ID: "b"}})
+	bus.Send(ctx, PickupShipment{Command{ID: "a"}})
+	run()
+
+	bus.Send(ctx, ShipShipment{Command{ID: "a"}})
+	run()
+
+	if projector.projects != 4 {
+		t.Errorf("expected 4 projected events after restart, got %d", projector.projects)
+	}
+	if projector.statuses["a"] != Shipped || projector.statuses["b"] != Packed {
+		t.Errorf("unexpected read model: %v", projector.statuses)
+	}
+
+	engine := NewProjectionEngine(store.(GlobalEventReader), marshaler, checkpoints)
+	engine.Register(projector)
+	if err := engine.Rebuild(ctx, projector.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if len(projector.statuses) != 0 {
+		t.Errorf("expected read model to be reset, got %v", projector.statuses)
+	}
+
+	run()
+
+	if projector.projects != 8 {
+		t.Errorf("expected every event to be replayed, got %d projected events", projector.projects)
+	}
+	if projector.statuses["a"] != Shipped || projector.statuses["b"] != Packed {
+		t.Errorf("unexpected read model after rebuild: %v", projector.statuses)
+	}
+}
+
+type failingCheckpointStore struct {
+	CheckpointStore
+	failOn string
+}
+
+func (s failingCheckpointStore) GetCheckpoint(ctx context.Context, name string) (int64, error) {
+	if name == s.failOn {
+		return 0, errors.New("checkpoint unavailable")
+	}
+
+	return s.CheckpointStore.GetCheckpoint(ctx, name)
+}
+
+type namedProjector struct {
+	shipmentStatusProjector
+	name string
+}
+
+func (p *namedProjector) Name() string { return p.name }
+
+func TestProjectionEngineCheckpointError(t *testing.T) {
+	marshaler := new(JsonEventMarshaler)
+	marshaler.Bind(ShipmentPacked{})
+
+	ctx := context.Background()
+	store := NewInmemEventStore()
+	NewCommandBus(NewRepository(&Shipment{}, WithMarshaler(marshaler), WithEventStore(store))).Send(ctx, PackShipment{Command{ID: "a"}})
+
+	first := &namedProjector{shipmentStatusProjector{statuses: make(map[string]string)}, "first"}
+	second := &namedProjector{shipmentStatusProjector{statuses: make(map[string]string)}, "second"}
+
+	checkpoints := failingCheckpointStore{NewInmemCheckpointStore(), "second"}
+	engine := NewProjectionEngine(store.(GlobalEventReader), marshaler, checkpoints, WithPollInterval(time.Millisecond))
+	if err := engine.Register(first, second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := engine.Run(ctx); err == nil {
+		t.Fatal("expected the checkpoint error")
+	}
+
+	// no projector may keep running once Run returned
+	time.Sleep(20 * time.Millisecond)
+	if first.projects != 0 || second.projects != 0 {
+		t.Errorf("expected no projected events, got %d and %d", first.projects, second.projects)
+	}
+}
+
+type invoiceIssued struct{ EventSkeleton }
+
+func TestProjectionEngineSkipsUnknownEvents(t *testing.T) {
+	marshaler := new(JsonEventMarshaler)
+	marshaler.Bind(ShipmentPacked{}, ShipmentPickedUp{}, ShipmentShipped{})
+
+	ctx := context.Background()
+	store := NewInmemEventStore()
+	bus := NewCommandBus(NewRepository(&Shipment{}, WithMarshaler(marshaler), WithEventStore(store)))
+	bus.Send(ctx, PackShipment{Command{ID: "a"}})
+
+	// an event of another bounded context sharing the store
+	billing := new(JsonEventMarshaler)
+	billing.Bind(invoiceIssued{})
+	model, err := billing.Marshal(&invoiceIssued{EventSkeleton{ID: "invoice-1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveEvents(ctx, "invoice-1", History{model}, ExpectedVersionNoStream); err != nil {
+		t.Fatal(err)
+	}
+
+	bus.Send(ctx, PickupShipment{Command{ID: "a"}})
+
+	checkpoints := NewInmemCheckpointStore()
+	projector := &shipmentStatusProjector{statuses: make(map[string]string)}
+	engine := NewProjectionEngine(store.(GlobalEventReader), marshaler, checkpoints, WithPollInterval(time.Millisecond))
+	engine.Register(projector)
+
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	if err := engine.Run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	if projector.projects != 2 || projector.statuses["a"] != PickedUp {
+		t.Errorf("expected the shipment events to be projected, got %d events and %v", projector.projects, projector.statuses)
+	}
+
+	if offset, _ := checkpoints.GetCheckpoint(ctx, projector.Name()); offset != 3 {
+		t.Errorf("expected checkpoint 3, got %d", offset)
+	}
+}
+
+func TestProjectionEngineRebuildWhileRunning(t *testing.T) {
+	marshaler := new(JsonEventMarshaler)
+	marshaler.Bind(ShipmentPacked{})
+
+	store := NewInmemEventStore()
+	projector := &shipmentStatusProjector{statuses: make(map[string]string)}
+	engine := NewProjectionEngine(store.(GlobalEventReader), marshaler, NewInmemCheckpointStore(), WithPollInterval(time.Millisecond))
+	engine.Register(projector)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- engine.Run(ctx) }()
+
+	// Run marks its projectors as running before it starts them
+	deadline := time.Now().Add(time.Second)
+	for engine.Rebuild(context.Background(), projector.Name()) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expected Rebuild to fail while the projector is running")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := engine.Run(context.Background()); err == nil {
+		t.Error("expected a second Run to fail while the projector is running")
+	}
+
+	cancel()
+	<-done
+
+	if err := engine.Rebuild(context.Background(), projector.Name()); err != nil {
+		t.Errorf("unexpected error once Run returned: %v", err)
+	}
+}
+
+func TestInmemCheckpointStore(t *testing.T) {
+	testCheckpointStore(t, NewInmemCheckpointStore)
+}
+
+// testCheckpointStore verifies the checkpoint store contract against the stores
+// returned by factory, each test gets a new store.
+func testCheckpointStore(t *testing.T, factory func() CheckpointStore) {
+	t.Run("SaveAndGet", func(t *testing.T) {
+		ctx := context.Background()
+		store := factory()
+
+		offset, err := store.GetCheckpoint(ctx, "projector-1")
+		if err != nil || offset != 0 {
+			t.Fatalf("expected checkpoint 0 before any save, got %d, %v", offset, err)
+		}
+
+		for _, want := range []int64{5, 12, 0} {
+			if err := store.SaveCheckpoint(ctx, "projector-1", want); err != nil {
+				t.Fatalf("unable to save checkpoint: %v", err)
+			}
+
+			offset, err := store.GetCheckpoint(ctx, "projector-1")
+			if err != nil || offset != want {
+				t.Errorf("expected checkpoint %d, got %d, %v", want, offset, err)
+			}
+		}
+	})
+
+	t.Run("Isolation", func(t *testing.T) {
+		ctx := context.Background()
+		store := factory()
+
+		if err := store.SaveCheckpoint(ctx, "projector-1", 7); err != nil {
+			t.Fatalf("unable to save checkpoint: %v", err)
+		}
+
+		offset, err := store.GetCheckpoint(ctx, "projector-2")
+		if err != nil || offset != 0 {
+			t.Errorf("expected checkpoints to be kept per name, got %d, %v", offset, err)
+		}
+	})
+}
@@ -0,0 +1,150 @@
+package eventsource
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// TypeNamer is implemented by events, or snapshot states, choosing the
+// name they are stored under instead of their package qualified Go name.
+type TypeNamer interface {
+	EventTypeName() string
+}
+
+// TypeName returns the name v is stored under by the marshalers of this package
+func TypeName(v interface{}) string {
+	if n, ok := v.(TypeNamer); ok {
+		return n.EventTypeName()
+	}
+
+	t := elem(reflect.TypeOf(v))
+	if n, ok := reflect.New(t).Interface().(TypeNamer); ok {
+		return n.EventTypeName()
+	}
+
+	return t.PkgPath() + "." + t.Name()
+}
+
+// typeRegistry maps stored type names to Go types, it is shared by the marshalers
+type typeRegistry struct {
+	mu     sync.RWMutex
+	types  map[string]reflect.Type
+	names  map[reflect.Type]string
+	legacy map[string][]reflect.Type
+}
+
+// bind registers v under its TypeName and the given aliases
+func (r *typeRegistry) bind(v interface{}, aliases ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.types == nil {
+		r.types = make(map[string]reflect.Type)
+		r.names = make(map[reflect.Type]string)
+		r.legacy = make(map[string][]reflect.Type)
+	}
+
+	t := elem(reflect.TypeOf(v))
+	name := TypeName(v)
+
+	if bound, ok := r.names[t]; ok && bound != name {
+		return fmt.Errorf("%v already bound as %s", t, bound)
+	}
+
+	for _, n := range append([]string{name}, aliases...) {
+		if bound, ok := r.types[n]; ok && bound != t {
+			return fmt.Errorf("type name %s of %v already bound to %v", n, t, bound)
+		}
+	}
+
+	if _, ok := r.names[t]; !ok {
+		r.legacy[t.Name()] = append(r.legacy[t.Name()], t)
+	}
+
+	r.names[t] = name
+	for _, n := range append([]string{name}, aliases...) {
+		r.types[n] = t
+	}
+
+	return nil
+}
+
+// name returns the name v is marshaled with
+func (r *typeRegistry) name(v interface{}) string {
+	r.mu.RLock()
+	name, ok := r.names[elem(reflect.TypeOf(v))]
+	r.mu.RUnlock()
+
+	if ok {
+		return name
+	}
+
+	return TypeName(v)
+}
+
+// lookup returns the type bound to name, names stored before types were
+// package qualified resolve to the only bound type with that Go name.
+func (r *typeRegistry) lookup(name string) (reflect.Type, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if t, ok := r.types[name]; ok {
+		return t, true
+	}
+
+	if types := r.legacy[name]; len(types) == 1 {
+		return types[0], true
+	}
+
+	return nil, false
+}
+
+// canonical returns the name a stored type name is bound under
+func (r *typeRegistry) canonical(name string) string {
+	t, ok := r.lookup(name)
+	if !ok {
+		return name
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.names[t]
+}
+
+// aliases returns the names the type bound to name is known by, its
+// canonical name first followed by its aliases and its unqualified Go name.
+// Names no type is bound to are returned alone.
+func (r *typeRegistry) aliases(name string) []string {
+	t, ok := r.lookup(name)
+	if !ok {
+		return []string{name}
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var aliases []string
+	for n, bound := range r.types {
+		if bound == t && n != r.names[t] {
+			aliases = append(aliases, n)
+		}
+	}
+
+	if _, ok := r.types[t.Name()]; !ok && len(r.legacy[t.Name()]) == 1 {
+		aliases = append(aliases, t.Name())
+	}
+	sort.Strings(aliases)
+
+	return append([]string{r.names[t]}, aliases...)
+}
+
+func elem(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+
+	return t
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
 	"math"
 	"reflect"
+	"time"
 )
 
 type Option func(r *AggregateRepository)
@@ -40,7 +42,23 @@ func WithDefaultSnapRepository(states ...interface{}) Option {
 	}
 }
 
+// WithSnapshotErrorHandler sets the function called when a snapshot could
+// not be saved. Snapshots are an optimisation, the events are saved at that
+// point and Save succeeds, errors are logged by default.
+func WithSnapshotErrorHandler(h func(ctx context.Context, aggrID string, err error)) Option {
+	return func(r *AggregateRepository) {
+		r.onSnapshotError = h
+	}
+}
+
+// NewRepository returns a repository of aggr keeping its events in memory
+// unless another store is set with WithEventStore. A snapshot which could
+// not be saved does not fail Save, it is logged, see WithSnapshotErrorHandler.
 func NewRepository(aggr AggregateRoot, opts ...Option) AggregateRootRepository {
+	return newAggregateRepository(aggr, opts...)
+}
+
+func newAggregateRepository(aggr AggregateRoot, opts ...Option) *AggregateRepository {
 	typ := reflect.TypeOf(aggr)
 	if typ.Kind() == reflect.Ptr {
 		typ = typ.Elem()
@@ -50,6 +68,8 @@ func NewRepository(aggr AggregateRoot, opts ...Option) AggregateRootRepository {
 		aggregate: typ,
 		store:     NewInmemEventStore(),
 		Marshaler: &JsonEventMarshaler{},
+
+		onSnapshotError: logSnapshotError,
 	}
 
 	for _, opt := range opts {
@@ -66,12 +86,19 @@ func NewRepository(aggr AggregateRoot, opts ...Option) AggregateRootRepository {
 
 type AggregateRepository struct {
 	aggregate reflect.Type
+	factory   func() AggregateRoot
 	store     EventStore
 	Marshaler EventMarshaler
 	snaprepo  AggregateRootSnapshotRepository
+
+	onSnapshotError func(ctx context.Context, aggrID string, err error)
 }
 
 func (r *AggregateRepository) New() interface{} {
+	if r.factory != nil {
+		return r.factory()
+	}
+
 	return reflect.New(r.aggregate).Interface()
 }
 
@@ -86,21 +113,37 @@ func (r *AggregateRepository) Save(ctx context.Context, aggr AggregateRoot) erro
 		return nil
 	}
 
+	md := MetadataFromContext(ctx)
+
 	var history History
 	for _, e := range events {
-		model, err := r.Marshaler.Marshal(e)
+		env := Envelope{EventID: NewEventID(), Metadata: md}
+		if v, ok := e.(Enveloped); ok {
+			v.SetEventEnvelope(env)
+		}
+
+		model, err := MarshalEvent(ctx, r.Marshaler, e)
 		if err != nil {
 			return err
 		}
 
+		model.ID = env.EventID
+		model.Metadata = env.Metadata
 		history = append(history, model)
 	}
 
-	err := r.store.SaveEvents(ctx, aggr.AggregateRootID(), history, aggr.GetVersion())
+	expected := expectedVersion(aggr, events)
+	err := r.store.SaveEvents(ctx, aggr.AggregateRootID(), history, expected)
 	if err != nil {
 		return err
 	}
 
+	// Apply does not count Constructor events, the version is set to the
+	// one of the saved stream.
+	if v, ok := aggr.(versioned); ok {
+		v.setVersion(expected + len(events))
+	}
+
 	if v, ok := aggr.(SnapshottingBehaviour); ok {
 		if v.StreamSize()%v.SnapshotInterval() == 0 {
 			snap := SnapshotSkeleton{
@@ -110,7 +153,7 @@ func (r *AggregateRepository) Save(ctx context.Context, aggr AggregateRoot) erro
 			}
 
 			if err := r.snaprepo.Save(ctx, snap); err != nil {
-				return err
+				r.onSnapshotError(ctx, snap.ID, err)
 			}
 		}
 	}
@@ -118,80 +161,152 @@ func (r *AggregateRepository) Save(ctx context.Context, aggr AggregateRoot) erro
 	return nil
 }
 
+func logSnapshotError(ctx context.Context, aggrID string, err error) {
+	log.Printf("unable to save snapshot of aggregate %s: %v", aggrID, err)
+}
+
+// expectedVersion returns the stream version the aggregate was loaded at,
+// an aggregate which was neither loaded nor saved has no stream yet.
+func expectedVersion(aggr AggregateRoot, events []Event) int {
+	if v, ok := aggr.(versioned); ok && !v.stored() {
+		return ExpectedVersionNoStream
+	}
+
+	if version := aggr.GetVersion() - len(events); version >= 0 {
+		return version
+	}
+
+	return ExpectedVersionNoStream
+}
+
 func (r *AggregateRepository) GetByID(ctx context.Context, aggrID string) (AggregateRoot, error) {
-	aggregate, err := r.LoadFromSnap(ctx, aggrID)
+	return r.GetByIDAtVersion(ctx, aggrID, math.MaxInt32)
+}
+
+// GetByIDAtVersion loads the aggregate state as of the given event version,
+// starting from the nearest snapshot at or below that version when available.
+// Versions start at 0, a negative version is rejected.
+func (r *AggregateRepository) GetByIDAtVersion(ctx context.Context, aggrID string, version int) (AggregateRoot, error) {
+	if version < 0 {
+		return nil, fmt.Errorf("invalid version %d of aggregate %s", version, aggrID)
+	}
+
+	aggr, from, err := r.restore(ctx, aggrID, version)
 	if err != nil {
 		return nil, err
 	}
 
-	if aggregate != nil {
-		return aggregate, nil
+	history, err := r.store.GetEventsForAggregate(ctx, aggrID, from)
+	if err != nil {
+		return nil, err
 	}
 
-	history, err := r.store.GetEventsForAggregate(ctx, aggrID, 0)
+	if err := r.replay(ctx, aggr, history, from, version); err != nil {
+		return nil, err
+	}
+
+	return aggr, nil
+}
+
+// GetByIDAt loads the aggregate state as of the given time, it includes
+// every event which happened at or before at.
+func (r *AggregateRepository) GetByIDAt(ctx context.Context, aggrID string, at time.Time) (AggregateRoot, error) {
+	history, err := r.store.GetEventsForAggregate(ctx, aggrID, ExpectedVersionNoStream)
 	if err != nil {
 		return nil, err
 	}
 
-	var events []Event
+	version := ExpectedVersionNoStream
 	for _, model := range history {
-		event, err := r.Marshaler.Unmarshal(model)
-		if err != nil {
-			return nil, err
+		if model.At.Time().After(at) {
+			break
 		}
 
-		events = append(events, event)
+		version = model.Version
 	}
 
-	aggr, _ := r.New().(AggregateRoot)
-	if err := aggr.LoadFromHistory(aggr, events); err != nil {
-		return nil, err
+	if version == ExpectedVersionNoStream {
+		return nil, fmt.Errorf("aggregate %s did not exist at %v", aggrID, at)
 	}
 
-	return aggr, nil
+	return r.GetByIDAtVersion(ctx, aggrID, version)
 }
 
 func (r *AggregateRepository) LoadFromSnap(ctx context.Context, aggrID string) (SnapshottingBehaviour, error) {
-	if aggr, ok := r.New().(SnapshottingBehaviour); ok {
-		if !ok || !aggr.SnapshottingEnable() {
-			return nil, nil
-		}
+	aggr, from, err := r.restore(ctx, aggrID, math.MaxInt32)
+	if err != nil || from == ExpectedVersionNoStream {
+		return nil, err
+	}
 
-		snap, err := r.snaprepo.GetByID(ctx, aggr.AggregateRootID(), 0)
-		if err != nil {
-			if errors.Is(err, ErrSnapNotFound) {
-				return nil, nil
-			}
+	history, err := r.store.GetEventsForAggregate(ctx, aggrID, from)
+	if err != nil {
+		return nil, err
+	}
 
-			return nil, err
-		}
+	if err := r.replay(ctx, aggr, history, from, math.MaxInt32); err != nil {
+		return nil, err
+	}
 
-		version := snap.CurrentVersion()
-		aggr.ApplyState(snap)
+	return aggr.(SnapshottingBehaviour), nil
+}
 
-		history, err := r.store.GetEventsForAggregate(ctx, aggrID, version)
-		if err != nil {
-			return nil, err
+// restore creates the aggregate from its newest snapshot at or below version
+// and returns the snapshot version, a fresh aggregate is returned along with
+// ExpectedVersionNoStream when there is no such snapshot.
+func (r *AggregateRepository) restore(ctx context.Context, aggrID string, version int) (AggregateRoot, int, error) {
+	aggr, ok := r.New().(SnapshottingBehaviour)
+	if !ok || !aggr.SnapshottingEnable() || version <= 0 {
+		return r.New().(AggregateRoot), ExpectedVersionNoStream, nil
+	}
+
+	snap, err := r.snaprepo.GetByID(ctx, aggrID, version)
+	if err != nil {
+		if errors.Is(err, ErrSnapNotFound) {
+			return aggr, ExpectedVersionNoStream, nil
 		}
 
-		var events []Event
-		for _, model := range history {
-			event, err := r.Marshaler.Unmarshal(model)
-			if err != nil {
-				return nil, err
-			}
+		return nil, 0, err
+	}
 
-			events = append(events, event)
+	aggr.ApplyState(snap)
+
+	return aggr, snap.CurrentVersion(), nil
+}
+
+// replay applies the events of history up to version on top of
+// the aggregate state at version from.
+func (r *AggregateRepository) replay(ctx context.Context, aggr AggregateRoot, history History, from, version int) error {
+	var events []Event
+	for _, model := range history {
+		// stores return the whole stream when from is 0
+		if model.Version <= from {
+			continue
 		}
 
-		if err := aggr.LoadFromHistory(aggr, events); err != nil {
-			return nil, err
+		if model.Version > version {
+			break
 		}
 
-		return aggr, nil
+		event, err := UnmarshalEvent(ctx, r.Marshaler, model)
+		if err != nil {
+			return err
+		}
+
+		events = append(events, event)
+		from = model.Version
 	}
 
-	return nil, nil
+	if err := aggr.LoadFromHistory(aggr, events); err != nil {
+		return err
+	}
+
+	// LoadFromHistory counts the replayed events only, which misses the
+	// events folded into a snapshot.
+	if v, ok := aggr.(versioned); ok {
+		v.setVersion(from)
+	}
+
+	return nil
 }
 
 func NewSnapRepository(store SnapshotStore, marshaler SnapshotMarshaler) AggregateRootSnapshotRepository {
@@ -207,14 +322,12 @@ type SnapshotRepository struct {
 }
 
 func (r *SnapshotRepository) Save(ctx context.Context, snap Snapshot) error {
-	model, err := r.marshaler.Marshal(snap)
+	model, err := marshalSnapshotContext(ctx, r.marshaler, snap)
 	if err != nil {
 		return fmt.Errorf("unable to marshal snapshot: %v", err)
 	}
 
-	r.store.SaveSnapshot(ctx, snap.AggregateRootID(), model, snap.CurrentVersion())
-
-	return nil
+	return r.store.SaveSnapshot(ctx, snap.AggregateRootID(), model, snap.CurrentVersion())
 }
 
 func (r *SnapshotRepository) GetByID(ctx context.Context, agrID string, version int) (Snapshot, error) {
@@ -227,7 +340,7 @@ func (r *SnapshotRepository) GetByID(ctx context.Context, agrID string, version
 		return nil, err
 	}
 
-	snap, err := r.marshaler.Unmarshal(model)
+	snap, err := unmarshalSnapshotContext(ctx, r.marshaler, model)
 	if err != nil {
 		return nil, err
 	}
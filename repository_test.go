@@ -0,0 +1,195 @@
+package eventsource
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type CounterStarted struct{ EventSkeleton }
+type CounterIncremented struct{ EventSkeleton }
+
+func (CounterStarted) New() bool { return true }
+
+type counterState struct{ Count int }
+
+// counter takes a snapshot after every second event
+type counter struct {
+	AggregateRootBase
+	state counterState
+}
+
+func (c *counter) On(e Event) error {
+	c.ID = e.AggregateID()
+	c.state.Count++
+	return nil
+}
+
+func (c *counter) SnapshotInterval() int    { return 2 }
+func (c *counter) GetState() interface{}    { return c.state }
+func (c *counter) SnapshottingEnable() bool { return true }
+
+func (c *counter) ApplyState(s Snapshot) {
+	c.ID = s.AggregateRootID()
+	c.state = *s.GetState().(*counterState)
+}
+
+func TestRepositoryGetByIDAtVersionAndTime(t *testing.T) {
+	marshaler := new(JsonEventMarshaler)
+	marshaler.Bind(ShipmentPacked{}, ShipmentPickedUp{}, ShipmentShipped{})
+
+	ctx := context.Background()
+	repo := NewRepository(&Shipment{}, WithMarshaler(marshaler)).(*AggregateRepository)
+
+	t0 := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	shipment := &Shipment{}
+	shipment.Apply(shipment, &ShipmentPacked{EventSkeleton{ID: "abc123", At: t0}}, true)
+	shipment.Apply(shipment, &ShipmentPickedUp{EventSkeleton{ID: "abc123", At: t0.Add(time.Hour)}}, true)
+	shipment.Apply(shipment, &ShipmentShipped{EventSkeleton{ID: "abc123", At: t0.Add(2 * time.Hour)}}, true)
+	if err := repo.Save(ctx, shipment); err != nil {
+		t.Fatal(err)
+	}
+
+	aggregate, err := repo.GetByIDAtVersion(ctx, "abc123", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := aggregate.(*Shipment); s.Status != PickedUp || s.GetVersion() != 1 {
+		t.Errorf("expected picked-up at version 1, got %s at version %d", s.Status, s.GetVersion())
+	}
+
+	aggregate, err = repo.GetByIDAt(ctx, "abc123", t0.Add(90*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := aggregate.(*Shipment); s.Status != PickedUp || s.GetVersion() != 1 {
+		t.Errorf("expected picked-up at version 1, got %s at version %d", s.Status, s.GetVersion())
+	}
+
+	aggregate, err = repo.GetByIDAt(ctx, "abc123", t0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := aggregate.(*Shipment); s.Status != Packed || s.GetVersion() != 0 {
+		t.Errorf("expected packed at version 0, got %s at version %d", s.Status, s.GetVersion())
+	}
+
+	if _, err := repo.GetByIDAt(ctx, "abc123", t0.Add(-time.Second)); err == nil {
+		t.Error("expected error loading aggregate before it existed")
+	}
+}
+
+func TestRepositoryLoadsFromNearestSnapshot(t *testing.T) {
+	marshaler := new(JsonEventMarshaler)
+	marshaler.Bind(CounterStarted{}, CounterIncremented{})
+
+	ctx := context.Background()
+	snapshots := NewInmemSnapStore()
+	repo := NewRepository(&counter{}, WithMarshaler(marshaler), WithSnapRepository(snapshots, new(JsonSnapshotMarshaler))).(*AggregateRepository)
+	repo.snaprepo.(*SnapshotRepository).marshaler.Bind(counterState{})
+
+	c := &counter{}
+	for i := 0; i < 5; i++ {
+		var e Event = &CounterIncremented{EventSkeleton{ID: "abc123"}}
+		if i == 0 {
+			e = &CounterStarted{EventSkeleton{ID: "abc123"}}
+		}
+
+		c.Apply(c, e, true)
+		if err := repo.Save(ctx, c); err != nil {
+			t.Fatal(err)
+		}
+
+		aggregate, err := repo.GetByID(ctx, "abc123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c = aggregate.(*counter)
+	}
+
+	for version := 0; version < 5; version++ {
+		aggregate, err := repo.GetByIDAtVersion(ctx, "abc123", version)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := aggregate.(*counter)
+		if c.state.Count != version+1 || c.GetVersion() != version {
+			t.Errorf("expected count %d at version %d, got count %d at version %d", version+1, version, c.state.Count, c.GetVersion())
+		}
+	}
+
+	if _, err := snapshots.GetSnapshotForAggregate(ctx, "abc123", 2); err != nil {
+		t.Errorf("expected a snapshot at or below version 2, got %v", err)
+	}
+}
+
+type failingSnapStore struct {
+	SnapshotStore
+}
+
+func (failingSnapStore) SaveSnapshot(ctx context.Context, agrID string, model SnapshotModel, version int) error {
+	return errors.New("snapshot store unavailable")
+}
+
+func TestRepositorySaveIgnoresSnapshotErrors(t *testing.T) {
+	marshaler := new(JsonEventMarshaler)
+	marshaler.Bind(CounterStarted{}, CounterIncremented{})
+
+	ctx := context.Background()
+	snapshots := new(JsonSnapshotMarshaler)
+	snapshots.Bind(counterState{})
+
+	var reported error
+	repo := NewRepository(&counter{},
+		WithMarshaler(marshaler),
+		WithSnapRepository(failingSnapStore{NewInmemSnapStore()}, snapshots),
+		WithSnapshotErrorHandler(func(ctx context.Context, aggrID string, err error) { reported = err }),
+	)
+
+	c := &counter{}
+	c.Apply(c, &CounterStarted{EventSkeleton{ID: "abc123"}}, true)
+	c.Apply(c, &CounterIncremented{EventSkeleton{ID: "abc123"}}, true)
+	if err := repo.Save(ctx, c); err != nil {
+		t.Fatalf("expected the snapshot error to be ignored, got %v", err)
+	}
+
+	if reported == nil {
+		t.Error("expected the snapshot error to be reported")
+	}
+
+	aggregate, err := repo.GetByID(ctx, "abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if aggregate.(*counter).state.Count != 2 {
+		t.Errorf("expected the events to be saved, got count %d", aggregate.(*counter).state.Count)
+	}
+}
+
+func TestRepositoryLogsSnapshotErrors(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	snapshots := new(JsonSnapshotMarshaler)
+	snapshots.Bind(counterState{})
+	repo := NewRepository(&counter{}, WithSnapRepository(failingSnapStore{NewInmemSnapStore()}, snapshots))
+
+	c := &counter{}
+	c.Apply(c, &CounterStarted{EventSkeleton{ID: "abc123"}}, true)
+	c.Apply(c, &CounterIncremented{EventSkeleton{ID: "abc123"}}, true)
+	if err := repo.Save(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "snapshot store unavailable") {
+		t.Errorf("expected the snapshot error to be logged, got %q", buf.String())
+	}
+}
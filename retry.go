@@ -0,0 +1,68 @@
+package eventsource
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// DefaultRetryPolicy is a sensible policy for aggregates with moderate contention
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     time.Second,
+	Jitter:         0.2,
+}
+
+// RetryPolicy controls how often and how fast a conflicting command is retried.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts including the first one
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry, doubled on each attempt
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between two attempts, zero means no cap
+	MaxBackoff time.Duration
+
+	// Jitter is the fraction [0, 1] of the delay which is randomized
+	Jitter float64
+}
+
+// Backoff returns the delay to wait after the given failed attempt
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+	}
+
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 {
+		d -= time.Duration(rand.Float64() * p.Jitter * float64(d))
+	}
+
+	return d
+}
+
+// do runs fn until it succeeds, fails with an error retryable does not accept
+// or MaxAttempts is reached, waiting Backoff between two attempts.
+func (p RetryPolicy) do(ctx context.Context, fn func() error, retryable func(error) bool) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxAttempts || !retryable(err) {
+			return err
+		}
+
+		select {
+		case <-time.After(p.Backoff(attempt)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,578 @@
+package eventsource
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AhmadWaleed/eventsource/command"
+)
+
+// ErrSagaNotFound is returned by SagaStore when no saga instance is stored for a key
+var ErrSagaNotFound = errors.New("saga not found")
+
+// Saga coordinates a workflow across aggregates by reacting to their events
+// with commands. An instance is kept per correlation key, sagas embed SagaBase
+// and their exported fields are persisted as JSON between events, or the
+// events they handled are when the manager is WithSagaEventStore.
+type Saga interface {
+	// Correlate returns the key of the instance handling e, false when the saga ignores e
+	Correlate(e Event) (string, bool)
+
+	// Handle reacts to e by updating the saga state, the returned commands
+	// are sent once the event is handled. Event-sourced instances are loaded
+	// by handling their events again, Handle should only update the state.
+	Handle(ctx context.Context, e Event) ([]interface{}, error)
+
+	base() *SagaBase
+}
+
+// SagaStarter is implemented by sagas which are started only by some events,
+// events of instances which are not started yet are ignored otherwise.
+type SagaStarter interface {
+	Starts(e Event) bool
+}
+
+// SagaTimeoutHandler is implemented by sagas reacting when their deadline
+// expires, the saga is completed afterwards.
+type SagaTimeoutHandler interface {
+	Timeout(ctx context.Context) ([]interface{}, error)
+}
+
+// SagaBase holds the bookkeeping of a saga instance, Processed holds the ids
+// of the last events handled by the instance to ignore their redelivery.
+type SagaBase struct {
+	Key       string    `json:"key"`
+	Processed []string  `json:"processed,omitempty"`
+	Done      bool      `json:"done,omitempty"`
+	Deadline  time.Time `json:"deadline"`
+
+	version int
+
+	// index is the stored model of event-sourced instances, nil until saved
+	index *SagaModel
+}
+
+func (s *SagaBase) base() *SagaBase {
+	return s
+}
+
+// Complete ends the saga, its instance ignores further events
+func (s *SagaBase) Complete() {
+	s.Done = true
+}
+
+// ExpireAt sets the deadline of the saga, see SagaManager.ExpireTimeouts
+func (s *SagaBase) ExpireAt(deadline time.Time) {
+	s.Deadline = deadline
+}
+
+// SagaVersion returns the version of the instance, -1 until it is saved
+func (s *SagaBase) SagaVersion() int {
+	return s.version
+}
+
+func (s *SagaBase) processed(eventID string) bool {
+	for _, id := range s.Processed {
+		if id == eventID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// markProcessed adds eventID to Processed keeping the last limit ids
+func (s *SagaBase) markProcessed(eventID string, limit int) {
+	s.Processed = append(s.Processed, eventID)
+	if len(s.Processed) > limit {
+		s.Processed = append([]string(nil), s.Processed[len(s.Processed)-limit:]...)
+	}
+}
+
+// SagaModel is the stored form of a saga instance
+type SagaModel struct {
+	Name      string
+	Key       string
+	Version   int
+	Data      []byte
+	Completed bool
+	Deadline  time.Time
+}
+
+// SagaStore persists saga instances, SaveSaga fails with ErrConcurrencyConflict
+// when the stored version is not expectedVersion, ExpectedVersionNoStream for
+// new instances.
+type SagaStore interface {
+	GetSaga(ctx context.Context, name, key string) (SagaModel, error)
+	SaveSaga(ctx context.Context, model SagaModel, expectedVersion int) error
+
+	// ExpiredSagas returns the instances of name which are not completed and
+	// whose deadline is at or before now.
+	ExpiredSagas(ctx context.Context, name string, now time.Time) ([]SagaModel, error)
+}
+
+func NewInmemSagaStore() SagaStore {
+	return &inmemSagaStore{sagas: make(map[string]SagaModel)}
+}
+
+type inmemSagaStore struct {
+	mu    sync.Mutex
+	sagas map[string]SagaModel
+}
+
+func (s *inmemSagaStore) GetSaga(ctx context.Context, name, key string) (SagaModel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	model, ok := s.sagas[name+"/"+key]
+	if !ok {
+		return SagaModel{}, fmt.Errorf("%w: %s %s", ErrSagaNotFound, name, key)
+	}
+
+	return model, nil
+}
+
+func (s *inmemSagaStore) SaveSaga(ctx context.Context, model SagaModel, expectedVersion int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := model.Name + "/" + model.Key
+
+	actual := ExpectedVersionNoStream
+	if stored, ok := s.sagas[id]; ok {
+		actual = stored.Version
+	}
+
+	if actual != expectedVersion {
+		return &ErrConcurrencyConflict{AggregateID: id, Expected: expectedVersion, Actual: actual}
+	}
+
+	model.Version = actual + 1
+	s.sagas[id] = model
+
+	return nil
+}
+
+func (s *inmemSagaStore) ExpiredSagas(ctx context.Context, name string, now time.Time) ([]SagaModel, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []SagaModel
+	for _, model := range s.sagas {
+		if model.Name == name && !model.Completed && !model.Deadline.IsZero() && !model.Deadline.After(now) {
+			expired = append(expired, model)
+		}
+	}
+
+	sort.Slice(expired, func(i, j int) bool { return expired[i].Deadline.Before(expired[j].Deadline) })
+
+	return expired, nil
+}
+
+type SagaOption func(m *SagaManager)
+
+// WithSagaEventStore makes the saga instances event-sourced, the events they
+// handle are appended to a stream per instance in events and their state is
+// rebuilt by handling them again. The saga store only keeps the deadline
+// and completion of the instances to find their timeouts.
+func WithSagaEventStore(events EventStore, marshaler EventMarshaler) SagaOption {
+	return func(m *SagaManager) {
+		m.events = events
+		m.marshaler = marshaler
+	}
+}
+
+// WithSagaErrorHandler sets the handler of the errors expiring timeouts in
+// Run, they are ignored by default.
+func WithSagaErrorHandler(h func(err error)) SagaOption {
+	return func(m *SagaManager) {
+		m.onError = h
+	}
+}
+
+// WithSagaProcessedLimit sets the number of event ids kept per instance to
+// ignore redelivered events, 100 by default. Events redelivered after n
+// other events were handled by the instance are handled again.
+func WithSagaProcessedLimit(n int) SagaOption {
+	return func(m *SagaManager) {
+		m.processedLimit = n
+	}
+}
+
+// NewSagaManager runs the sagas returned by factory, they are stored under
+// the TypeName of the saga and their commands are sent with sender.
+func NewSagaManager(factory func() Saga, store SagaStore, sender command.CommandSender, opts ...SagaOption) *SagaManager {
+	m := &SagaManager{
+		name:           TypeName(factory()),
+		factory:        factory,
+		store:          store,
+		sender:         sender,
+		processedLimit: 100,
+		onError:        func(err error) {},
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
+}
+
+// SagaManager delivers events to the saga instances they correlate to. An
+// event is handled once per instance, its commands are sent before the
+// instance is saved so they may be sent again when saving fails and the
+// event is redelivered. Events are identified by their envelope id, or by
+// their type, aggregate and version when they are not Enveloped.
+type SagaManager struct {
+	name           string
+	factory        func() Saga
+	store          SagaStore
+	sender         command.CommandSender
+	events         EventStore
+	marshaler      EventMarshaler
+	processedLimit int
+	onError        func(err error)
+}
+
+// sagaTimeoutMetadata marks the timeouts in the streams of event-sourced instances
+const sagaTimeoutMetadata = "saga_timeout"
+
+// Handle implements command.Handler so the manager can be bound to the events
+// of a bus, ErrConcurrencyConflict is returned when the instance was changed
+// concurrently and the event should be redelivered.
+func (m *SagaManager) Handle(ctx context.Context, v interface{}) error {
+	e, ok := v.(Event)
+	if !ok {
+		return fmt.Errorf("saga %s can not handle %T, it is not an Event", m.name, v)
+	}
+
+	saga := m.factory()
+	key, ok := saga.Correlate(e)
+	if !ok {
+		return nil
+	}
+
+	saga, err := m.load(ctx, key)
+	if errors.Is(err, ErrSagaNotFound) {
+		if s, ok := saga.(SagaStarter); ok && !s.Starts(e) {
+			return nil
+		}
+	} else if err != nil {
+		return err
+	}
+
+	var eventID string
+	if v, ok := e.(Enveloped); ok {
+		eventID = v.EventEnvelope().EventID
+	}
+
+	id := eventID
+	if id == "" {
+		id = fmt.Sprintf("%s/%s@%d", TypeName(e), e.AggregateID(), e.EventVersion())
+	}
+
+	base := saga.base()
+	if base.Done || base.processed(id) {
+		// the event may be redelivered because the index was not saved
+		return m.index(ctx, saga)
+	}
+
+	ctx = withEventMetadata(ctx, e, eventID)
+
+	cmds, err := saga.Handle(ctx, e)
+	if err != nil {
+		return fmt.Errorf("saga %s %s could not handle %T: %w", m.name, key, e, err)
+	}
+
+	if err := m.send(ctx, cmds); err != nil {
+		return err
+	}
+
+	base.markProcessed(id, m.processedLimit)
+
+	var model EventModel
+	if m.events != nil {
+		if model, err = MarshalEvent(ctx, m.marshaler, e); err != nil {
+			return fmt.Errorf("unable to marshal %T for saga %s %s: %v", e, m.name, key, err)
+		}
+
+		model.ID = NewEventID()
+		model.Metadata = Metadata{MetadataCausationID: id}
+	}
+
+	return m.save(ctx, saga, model)
+}
+
+// ExpireTimeouts times out the instances whose deadline is at or before now,
+// instances failing to time out do not keep the others from timing out.
+func (m *SagaManager) ExpireTimeouts(ctx context.Context, now time.Time) error {
+	expired, err := m.store.ExpiredSagas(ctx, m.name, now)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, model := range expired {
+		if err := m.expire(ctx, model, now); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (m *SagaManager) expire(ctx context.Context, model SagaModel, now time.Time) error {
+	var saga Saga
+	var err error
+	if m.events != nil {
+		saga, err = m.load(ctx, model.Key)
+		if err != nil {
+			return err
+		}
+
+		// the index lags behind the instance when saving it failed
+		if base := saga.base(); base.Done || base.Deadline.IsZero() || base.Deadline.After(now) {
+			return m.index(ctx, saga)
+		}
+	} else if saga, err = m.decode(model); err != nil {
+		return err
+	}
+
+	if h, ok := saga.(SagaTimeoutHandler); ok {
+		cmds, err := h.Timeout(ctx)
+		if err != nil {
+			return fmt.Errorf("saga %s %s could not handle its timeout: %w", m.name, model.Key, err)
+		}
+
+		if err := m.send(ctx, cmds); err != nil {
+			return err
+		}
+	}
+
+	saga.base().Complete()
+
+	return m.save(ctx, saga, EventModel{
+		ID:       NewEventID(),
+		Data:     []byte(`{}`),
+		At:       Time(now),
+		Metadata: Metadata{sagaTimeoutMetadata: "true"},
+	})
+}
+
+// Run expires timeouts every interval until ctx is done, errors are passed
+// to the handler set WithSagaErrorHandler and expiring goes on.
+func (m *SagaManager) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			if err := m.ExpireTimeouts(ctx, now); err != nil {
+				m.onError(fmt.Errorf("saga %s could not expire timeouts: %w", m.name, err))
+			}
+		}
+	}
+}
+
+// load returns the stored instance of key, or a new one along with ErrSagaNotFound
+func (m *SagaManager) load(ctx context.Context, key string) (Saga, error) {
+	if m.events != nil {
+		return m.replay(ctx, key)
+	}
+
+	model, err := m.store.GetSaga(ctx, m.name, key)
+	if errors.Is(err, ErrSagaNotFound) {
+		saga := m.factory()
+		saga.base().Key = key
+		saga.base().version = ExpectedVersionNoStream
+
+		return saga, err
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return m.decode(model)
+}
+
+// replay loads an event-sourced instance by handling its events again, the
+// commands they return were sent when the events were first handled.
+func (m *SagaManager) replay(ctx context.Context, key string) (Saga, error) {
+	saga := m.factory()
+	base := saga.base()
+	base.Key = key
+	base.version = ExpectedVersionNoStream
+
+	model, err := m.store.GetSaga(ctx, m.name, key)
+	if err == nil {
+		base.index = &model
+	} else if !errors.Is(err, ErrSagaNotFound) {
+		return nil, err
+	}
+
+	history, err := m.events.GetEventsForAggregate(ctx, m.stream(key), ExpectedVersionNoStream)
+	if errors.Is(err, ErrAggregateNotFound) {
+		return saga, fmt.Errorf("%w: %s %s", ErrSagaNotFound, m.name, key)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, model := range history {
+		if model.Metadata[sagaTimeoutMetadata] != "" {
+			if h, ok := saga.(SagaTimeoutHandler); ok {
+				if _, err := h.Timeout(ctx); err != nil {
+					return nil, fmt.Errorf("saga %s %s could not replay its timeout: %w", m.name, key, err)
+				}
+			}
+
+			base.Complete()
+		} else {
+			e, err := UnmarshalEvent(ctx, m.marshaler, model)
+			if err != nil {
+				return nil, fmt.Errorf("unable to unmarshal event of saga %s %s: %v", m.name, key, err)
+			}
+
+			if _, err := saga.Handle(ctx, e); err != nil {
+				return nil, fmt.Errorf("saga %s %s could not replay %T: %w", m.name, key, e, err)
+			}
+
+			base.markProcessed(model.Metadata[MetadataCausationID], m.processedLimit)
+		}
+
+		base.version = model.Version
+	}
+
+	return saga, nil
+}
+
+// stream returns the id of the event stream of an event-sourced instance
+func (m *SagaManager) stream(key string) string {
+	return m.name + "/" + key
+}
+
+func (m *SagaManager) decode(model SagaModel) (Saga, error) {
+	saga := m.factory()
+	if err := json.Unmarshal(model.Data, saga); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal saga %s %s: %v", m.name, model.Key, err)
+	}
+
+	saga.base().version = model.Version
+
+	return saga, nil
+}
+
+// save stores the instance, event is appended to the stream of event-sourced
+// instances while the others are stored as JSON.
+func (m *SagaManager) save(ctx context.Context, saga Saga, event EventModel) error {
+	base := saga.base()
+
+	if m.events != nil {
+		if err := m.events.SaveEvents(ctx, m.stream(base.Key), History{event}, base.version); err != nil {
+			return fmt.Errorf("could not save saga %s %s: %w", m.name, base.Key, err)
+		}
+
+		base.version++
+
+		return m.index(ctx, saga)
+	}
+
+	data, err := json.Marshal(saga)
+	if err != nil {
+		return fmt.Errorf("unable to marshal saga %s %s: %v", m.name, base.Key, err)
+	}
+
+	model := SagaModel{
+		Name:      m.name,
+		Key:       base.Key,
+		Data:      data,
+		Completed: base.Done,
+		Deadline:  base.Deadline,
+	}
+
+	if err := m.store.SaveSaga(ctx, model, base.version); err != nil {
+		return fmt.Errorf("could not save saga %s %s: %w", m.name, base.Key, err)
+	}
+
+	base.version++
+
+	return nil
+}
+
+// index saves the deadline and completion of an event-sourced instance to
+// the saga store when they changed, it is kept by the stream otherwise.
+func (m *SagaManager) index(ctx context.Context, saga Saga) error {
+	base := saga.base()
+	if m.events == nil || base.version == ExpectedVersionNoStream {
+		return nil
+	}
+
+	expected := ExpectedVersionNoStream
+	if base.index != nil {
+		if base.index.Completed == base.Done && base.index.Deadline.Equal(base.Deadline) {
+			return nil
+		}
+
+		expected = base.index.Version
+	}
+
+	model := SagaModel{
+		Name:      m.name,
+		Key:       base.Key,
+		Data:      []byte(`{}`),
+		Completed: base.Done,
+		Deadline:  base.Deadline,
+	}
+
+	if err := m.store.SaveSaga(ctx, model, expected); err != nil {
+		return fmt.Errorf("could not index saga %s %s: %w", m.name, base.Key, err)
+	}
+
+	model.Version = expected + 1
+	base.index = &model
+
+	return nil
+}
+
+func (m *SagaManager) send(ctx context.Context, cmds []interface{}) error {
+	for _, cmd := range cmds {
+		if err := m.sender.Send(ctx, cmd); err != nil {
+			return fmt.Errorf("saga %s could not send %T: %w", m.name, cmd, err)
+		}
+	}
+
+	return nil
+}
+
+// withEventMetadata sets the event as causation of the commands sent in
+// reaction to it, the correlation id is inherited from the event.
+func withEventMetadata(ctx context.Context, e Event, eventID string) context.Context {
+	if eventID == "" {
+		return ctx
+	}
+
+	var metadata Metadata
+	if v, ok := e.(Enveloped); ok {
+		metadata = v.EventEnvelope().Metadata
+	}
+
+	correlationID := metadata[MetadataCorrelationID]
+	if correlationID == "" {
+		correlationID = eventID
+	}
+
+	return WithMetadata(ctx, Metadata{
+		MetadataCausationID:   eventID,
+		MetadataCorrelationID: correlationID,
+	})
+}
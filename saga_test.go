@@ -0,0 +1,388 @@
+package eventsource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type ReserveCourier struct{ Command }
+type CancelShipment struct{ Command }
+
+type CourierReserved struct {
+	EventSkeleton
+	Courier string
+}
+
+// shippingSaga reserves a courier once a shipment is packed, then requests its pickup
+type shippingSaga struct {
+	SagaBase
+	Courier string
+}
+
+func (s *shippingSaga) Correlate(e Event) (string, bool) {
+	switch e.(type) {
+	case *ShipmentPacked, *CourierReserved:
+		return e.AggregateID(), true
+	}
+
+	return "", false
+}
+
+func (s *shippingSaga) Starts(e Event) bool {
+	_, ok := e.(*ShipmentPacked)
+	return ok
+}
+
+func (s *shippingSaga) Handle(ctx context.Context, e Event) ([]interface{}, error) {
+	switch e := e.(type) {
+	case *ShipmentPacked:
+		s.ExpireAt(e.EventAt().Add(time.Hour))
+		return []interface{}{ReserveCourier{Command{ID: e.AggregateID()}}}, nil
+	case *CourierReserved:
+		s.Courier = e.Courier
+		s.Complete()
+		return []interface{}{PickupShipment{Command{ID: e.AggregateID()}}}, nil
+	}
+
+	return nil, nil
+}
+
+func (s *shippingSaga) Timeout(ctx context.Context) ([]interface{}, error) {
+	return []interface{}{CancelShipment{Command{ID: s.Key}}}, nil
+}
+
+type recordingSender struct {
+	cmds     []interface{}
+	metadata []Metadata
+}
+
+func (s *recordingSender) Send(ctx context.Context, cmd interface{}) error {
+	s.cmds = append(s.cmds, cmd)
+	s.metadata = append(s.metadata, MetadataFromContext(ctx))
+	return nil
+}
+
+func TestSagaManager(t *testing.T) {
+	ctx := context.Background()
+	store := NewInmemSagaStore()
+	sender := &recordingSender{}
+	manager := NewSagaManager(func() Saga { return new(shippingSaga) }, store, sender)
+
+	at := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	packed := &ShipmentPacked{EventSkeleton{ID: "abc123", At: at}}
+	packed.SetEventEnvelope(Envelope{EventID: "evt-1", Metadata: Metadata{MetadataCorrelationID: "corr-1"}})
+
+	reserved := &CourierReserved{EventSkeleton{ID: "abc123"}, "fast-couriers"}
+	reserved.SetEventEnvelope(Envelope{EventID: "evt-2"})
+
+	// events of instances which are not started are ignored
+	if err := manager.Handle(ctx, reserved); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range []Event{packed, packed, reserved, reserved} {
+		if err := manager.Handle(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(sender.cmds) != 2 {
+		t.Fatalf("expected each event to be handled once, got %#v", sender.cmds)
+	}
+	if _, ok := sender.cmds[0].(ReserveCourier); !ok {
+		t.Errorf("expected ReserveCourier, got %T", sender.cmds[0])
+	}
+	if _, ok := sender.cmds[1].(PickupShipment); !ok {
+		t.Errorf("expected PickupShipment, got %T", sender.cmds[1])
+	}
+	if md := sender.metadata[0]; md[MetadataCausationID] != "evt-1" || md[MetadataCorrelationID] != "corr-1" {
+		t.Errorf("expected commands to be caused by the event, got %v", md)
+	}
+
+	model, err := store.GetSaga(ctx, TypeName(&shippingSaga{}), "abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model.Version != 1 || !model.Completed {
+		t.Errorf("expected completed saga at version 1, got %+v", model)
+	}
+
+	if err := manager.ExpireTimeouts(ctx, at.Add(2*time.Hour)); err != nil || len(sender.cmds) != 2 {
+		t.Errorf("expected completed sagas not to time out, got %v, %#v", err, sender.cmds)
+	}
+}
+
+func TestSagaManagerTimeouts(t *testing.T) {
+	ctx := context.Background()
+	store := NewInmemSagaStore()
+	sender := &recordingSender{}
+	manager := NewSagaManager(func() Saga { return new(shippingSaga) }, store, sender)
+
+	at := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := manager.Handle(ctx, &ShipmentPacked{EventSkeleton{ID: "abc123", At: at}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := manager.ExpireTimeouts(ctx, at.Add(time.Minute)); err != nil || len(sender.cmds) != 1 {
+		t.Fatalf("expected saga not to time out before its deadline, got %v, %#v", err, sender.cmds)
+	}
+
+	if err := manager.ExpireTimeouts(ctx, at.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(sender.cmds) != 2 {
+		t.Fatalf("expected timeout command, got %#v", sender.cmds)
+	}
+	if _, ok := sender.cmds[1].(CancelShipment); !ok {
+		t.Errorf("expected CancelShipment, got %T", sender.cmds[1])
+	}
+
+	if err := manager.Handle(ctx, &CourierReserved{EventSkeleton{ID: "abc123"}, "late"}); err != nil || len(sender.cmds) != 2 {
+		t.Errorf("expected timed out saga to ignore events, got %v, %#v", err, sender.cmds)
+	}
+
+	// a concurrent change of the instance is reported as a conflict
+	stale := NewSagaManager(func() Saga { return new(shippingSaga) }, &staleSagaStore{store}, sender)
+	var conflict *ErrConcurrencyConflict
+	if err := stale.Handle(ctx, &ShipmentPacked{EventSkeleton{ID: "def456", At: at}}); !errors.As(err, &conflict) {
+		t.Errorf("expected concurrency conflict, got %v", err)
+	}
+}
+
+// staleSagaStore saves a competing instance right before each save
+type staleSagaStore struct{ SagaStore }
+
+func (s *staleSagaStore) SaveSaga(ctx context.Context, model SagaModel, expectedVersion int) error {
+	s.SagaStore.SaveSaga(ctx, model, expectedVersion)
+	return s.SagaStore.SaveSaga(ctx, model, expectedVersion)
+}
+
+func TestEventSourcedSagaManager(t *testing.T) {
+	ctx := context.Background()
+	store := NewInmemSagaStore()
+	events := NewInmemEventStore()
+	sender := &recordingSender{}
+
+	marshaler := new(JsonEventMarshaler)
+	marshaler.Bind(ShipmentPacked{}, CourierReserved{})
+
+	newManager := func() *SagaManager {
+		return NewSagaManager(func() Saga { return new(shippingSaga) }, store, sender, WithSagaEventStore(events, marshaler))
+	}
+	manager := newManager()
+
+	at := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	packed := &ShipmentPacked{EventSkeleton{ID: "abc123", Version: 3, At: at}}
+
+	// events without envelope are recognized by their aggregate and version
+	for _, e := range []Event{packed, packed} {
+		if err := manager.Handle(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a new manager rebuilds the instance from its stream
+	manager = newManager()
+	if err := manager.Handle(ctx, packed); err != nil {
+		t.Fatal(err)
+	}
+	if len(sender.cmds) != 1 {
+		t.Fatalf("expected the event to be handled once, got %#v", sender.cmds)
+	}
+
+	history, err := events.GetEventsForAggregate(ctx, TypeName(&shippingSaga{})+"/abc123", ExpectedVersionNoStream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Metadata[MetadataCausationID] == "" {
+		t.Fatalf("expected the handled event to be stored, got %+v", history)
+	}
+
+	model, err := store.GetSaga(ctx, TypeName(&shippingSaga{}), "abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(model.Data) != `{}` || !model.Deadline.Equal(at.Add(time.Hour)) {
+		t.Errorf("expected only the deadline to be stored, got %+v", model)
+	}
+
+	if err := manager.Handle(ctx, &CourierReserved{EventSkeleton{ID: "abc123", Version: 4}, "fast-couriers"}); err != nil {
+		t.Fatal(err)
+	}
+
+	saga, err := newManager().load(ctx, "abc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := saga.(*shippingSaga); s.Courier != "fast-couriers" || !s.Done || s.SagaVersion() != 1 {
+		t.Errorf("expected the completed instance to be replayed, got %+v", s)
+	}
+
+	if err := manager.Handle(ctx, &ShipmentPacked{EventSkeleton{ID: "def456", At: at}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.ExpireTimeouts(ctx, at.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(sender.cmds) != 4 {
+		t.Fatalf("expected only def456 to time out, got %#v", sender.cmds)
+	}
+	if _, ok := sender.cmds[3].(CancelShipment); !ok {
+		t.Errorf("expected CancelShipment, got %T", sender.cmds[3])
+	}
+
+	saga, err = newManager().load(ctx, "def456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saga.base().Done {
+		t.Errorf("expected the timeout to be replayed, got %+v", saga)
+	}
+}
+
+func TestSagaProcessedLimit(t *testing.T) {
+	var base SagaBase
+	for _, id := range []string{"evt-1", "evt-2", "evt-3"} {
+		base.markProcessed(id, 2)
+	}
+
+	if base.processed("evt-1") || !base.processed("evt-2") || !base.processed("evt-3") {
+		t.Errorf("expected the last 2 event ids to be kept, got %v", base.Processed)
+	}
+}
+
+// failingSagaStore fails to list the expired instances
+type failingSagaStore struct{ SagaStore }
+
+func (s failingSagaStore) ExpiredSagas(ctx context.Context, name string, now time.Time) ([]SagaModel, error) {
+	return nil, errors.New("store unavailable")
+}
+
+func TestSagaManagerRunReportsErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make(chan error, 1)
+	manager := NewSagaManager(func() Saga { return new(shippingSaga) }, failingSagaStore{NewInmemSagaStore()}, &recordingSender{}, WithSagaErrorHandler(func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}))
+
+	done := make(chan error)
+	go func() { done <- manager.Run(ctx, time.Millisecond) }()
+
+	// Run keeps ticking after the errors
+	for i := 0; i < 3; i++ {
+		select {
+		case <-errs:
+		case err := <-done:
+			t.Fatalf("expected Run to keep ticking, returned %v", err)
+		case <-time.After(time.Second):
+			t.Fatal("expected the error to be reported")
+		}
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Run to return once ctx is done, got %v", err)
+	}
+}
+
+func TestInmemSagaStore(t *testing.T) {
+	testSagaStore(t, NewInmemSagaStore)
+}
+
+// testSagaStore verifies the saga store contract against the stores returned
+// by factory, each test gets a new store.
+func testSagaStore(t *testing.T, factory func() SagaStore) {
+	t.Run("Versioning", func(t *testing.T) {
+		ctx := context.Background()
+		store := factory()
+
+		if _, err := store.GetSaga(ctx, "saga", "key-1"); !errors.Is(err, ErrSagaNotFound) {
+			t.Errorf("expected ErrSagaNotFound, got %v", err)
+		}
+
+		model := SagaModel{Name: "saga", Key: "key-1", Data: sagaData(0)}
+		if err := store.SaveSaga(ctx, model, ExpectedVersionNoStream); err != nil {
+			t.Fatalf("unable to save saga: %v", err)
+		}
+
+		model.Data = sagaData(1)
+		if err := store.SaveSaga(ctx, model, 0); err != nil {
+			t.Fatalf("unable to save saga at version 0: %v", err)
+		}
+
+		for _, version := range []int{ExpectedVersionNoStream, 0} {
+			var conflict *ErrConcurrencyConflict
+			if err := store.SaveSaga(ctx, model, version); !errors.As(err, &conflict) || conflict.Actual != 1 {
+				t.Errorf("expected concurrency conflict saving at version %d, got %v", version, err)
+			}
+		}
+
+		stored, err := store.GetSaga(ctx, "saga", "key-1")
+		if err != nil {
+			t.Fatalf("unable to get saga: %v", err)
+		}
+
+		if stored.Name != "saga" || stored.Key != "key-1" || stored.Version != 1 || string(stored.Data) != string(sagaData(1)) {
+			t.Errorf("saga was not stored as saved, got %+v", stored)
+		}
+
+		if _, err := store.GetSaga(ctx, "other", "key-1"); !errors.Is(err, ErrSagaNotFound) {
+			t.Errorf("expected sagas to be scoped by name, got %v", err)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		ctx := context.Background()
+		store := factory()
+		now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+
+		for i, s := range []struct {
+			name      string
+			deadline  time.Time
+			completed bool
+		}{
+			{"saga", now.Add(-time.Minute), false},
+			{"saga", now.Add(-time.Hour), false},
+			{"saga", now, false},
+			{"saga", now.Add(time.Minute), false},
+			{"saga", now.Add(-time.Minute), true},
+			{"saga", time.Time{}, false},
+			{"other", now.Add(-time.Minute), false},
+		} {
+			model := SagaModel{Name: s.name, Key: fmt.Sprintf("key-%d", i), Data: sagaData(i), Completed: s.completed, Deadline: s.deadline}
+			if err := store.SaveSaga(ctx, model, ExpectedVersionNoStream); err != nil {
+				t.Fatalf("unable to save saga: %v", err)
+			}
+		}
+
+		expired, err := store.ExpiredSagas(ctx, "saga", now)
+		if err != nil {
+			t.Fatalf("unable to get expired sagas: %v", err)
+		}
+
+		var keys []string
+		for _, model := range expired {
+			keys = append(keys, model.Key)
+		}
+
+		if fmt.Sprint(keys) != "[key-1 key-0 key-2]" {
+			t.Errorf("expected the sagas past their deadline by deadline, got %v", keys)
+		}
+
+		if len(expired) > 0 && !expired[0].Deadline.Equal(now.Add(-time.Hour)) {
+			t.Errorf("expected the deadline to be stored, got %v", expired[0].Deadline)
+		}
+	})
+}
+
+func sagaData(n int) []byte {
+	return []byte(fmt.Sprintf(`{"n":%d}`, n))
+}
@@ -0,0 +1,412 @@
+package eventsource
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AhmadWaleed/eventsource/command"
+)
+
+var (
+	// ErrScheduleNotFound is returned when cancelling a command which is not scheduled
+	ErrScheduleNotFound = errors.New("scheduled command not found")
+
+	// ErrAlreadyScheduled is returned when scheduling a command whose id is scheduled
+	ErrAlreadyScheduled = errors.New("command already scheduled")
+)
+
+// Clock tells the time to the scheduler, tests can use a manual clock
+// such as eventsourcetest.ManualClock to advance time deterministically.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is the Clock of the time package
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// ScheduledCommand is the stored form of a command to dispatch at DueAt
+type ScheduledCommand struct {
+	ID    string
+	DueAt time.Time
+
+	// Type is the name the command type is bound with, Data its JSON encoding
+	Type string
+	Data []byte
+
+	// Metadata is the context metadata the command was scheduled with
+	Metadata Metadata
+
+	// Attempts is the number of failed dispatches, LastError the last failure
+	Attempts  int
+	LastError string
+}
+
+// ScheduleStore persists scheduled commands until they are dispatched
+type ScheduleStore interface {
+	// Schedule stores cmd, ErrAlreadyScheduled is returned when its ID is
+	// scheduled already.
+	Schedule(ctx context.Context, cmd ScheduledCommand) error
+
+	// Cancel removes a pending command, ErrScheduleNotFound is returned
+	// when it is not scheduled.
+	Cancel(ctx context.Context, id string) error
+
+	// Claim returns up to limit commands due at now in due order, they are
+	// not claimed again before now+lease unless they are completed.
+	Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]ScheduledCommand, error)
+
+	// Complete removes a dispatched command
+	Complete(ctx context.Context, id string) error
+
+	// Fail records a failed dispatch of a claimed command, it is claimed
+	// again once its lease expired unless deadLetter is set. Dead-lettered
+	// commands are returned by Failed until they are cancelled.
+	Fail(ctx context.Context, id, reason string, deadLetter bool) error
+
+	// Failed returns the dead-lettered commands
+	Failed(ctx context.Context) ([]ScheduledCommand, error)
+}
+
+func NewInmemScheduleStore() ScheduleStore {
+	return &inmemScheduleStore{commands: make(map[string]*inmemScheduled)}
+}
+
+type inmemScheduled struct {
+	ScheduledCommand
+	lockedUntil time.Time
+	failed      bool
+}
+
+type inmemScheduleStore struct {
+	mu       sync.Mutex
+	commands map[string]*inmemScheduled
+}
+
+func (s *inmemScheduleStore) Schedule(ctx context.Context, cmd ScheduledCommand) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.commands[cmd.ID]; ok {
+		return fmt.Errorf("%w: %s", ErrAlreadyScheduled, cmd.ID)
+	}
+
+	s.commands[cmd.ID] = &inmemScheduled{ScheduledCommand: cmd}
+
+	return nil
+}
+
+func (s *inmemScheduleStore) Cancel(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.commands[id]; !ok {
+		return fmt.Errorf("%w: %s", ErrScheduleNotFound, id)
+	}
+
+	delete(s.commands, id)
+
+	return nil
+}
+
+func (s *inmemScheduleStore) Claim(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]ScheduledCommand, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []*inmemScheduled
+	for _, cmd := range s.commands {
+		if !cmd.failed && !cmd.DueAt.After(now) && !cmd.lockedUntil.After(now) {
+			due = append(due, cmd)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool { return due[i].DueAt.Before(due[j].DueAt) })
+
+	if limit > 0 && len(due) > limit {
+		due = due[:limit]
+	}
+
+	claimed := make([]ScheduledCommand, len(due))
+	for i, cmd := range due {
+		cmd.lockedUntil = now.Add(lease)
+		claimed[i] = cmd.ScheduledCommand
+	}
+
+	return claimed, nil
+}
+
+func (s *inmemScheduleStore) Complete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.commands, id)
+
+	return nil
+}
+
+func (s *inmemScheduleStore) Fail(ctx context.Context, id, reason string, deadLetter bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cmd, ok := s.commands[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrScheduleNotFound, id)
+	}
+
+	cmd.Attempts++
+	cmd.LastError = reason
+	cmd.failed = deadLetter
+
+	return nil
+}
+
+func (s *inmemScheduleStore) Failed(ctx context.Context) ([]ScheduledCommand, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var failed []ScheduledCommand
+	for _, cmd := range s.commands {
+		if cmd.failed {
+			failed = append(failed, cmd.ScheduledCommand)
+		}
+	}
+
+	sort.Slice(failed, func(i, j int) bool { return failed[i].DueAt.Before(failed[j].DueAt) })
+
+	return failed, nil
+}
+
+type SchedulerOption func(s *Scheduler)
+
+// WithClock sets the clock of the scheduler, SystemClock by default
+func WithClock(c Clock) SchedulerOption {
+	return func(s *Scheduler) {
+		s.clock = c
+	}
+}
+
+// WithSchedulePollInterval sets how often Run looks for due commands
+func WithSchedulePollInterval(d time.Duration) SchedulerOption {
+	return func(s *Scheduler) {
+		s.pollInterval = d
+	}
+}
+
+// WithScheduleBatchSize sets how many due commands are claimed at once
+func WithScheduleBatchSize(n int) SchedulerOption {
+	return func(s *Scheduler) {
+		s.batchSize = n
+	}
+}
+
+// WithScheduleLease sets how long a claimed command is hidden from other
+// schedulers, a command which failed to dispatch is retried afterwards.
+func WithScheduleLease(d time.Duration) SchedulerOption {
+	return func(s *Scheduler) {
+		s.lease = d
+	}
+}
+
+// WithScheduleMaxAttempts sets how many times a command is dispatched before
+// it is dead-lettered, 5 by default. Commands which can not be decoded are
+// dead-lettered at once, 0 retries the others forever.
+func WithScheduleMaxAttempts(n int) SchedulerOption {
+	return func(s *Scheduler) {
+		s.maxAttempts = n
+	}
+}
+
+// WithScheduleErrorHandler sets the function called by Run when due commands
+// could not be dispatched, errors are dropped by default.
+func WithScheduleErrorHandler(fn func(err error)) SchedulerOption {
+	return func(s *Scheduler) {
+		s.onError = fn
+	}
+}
+
+func NewScheduler(store ScheduleStore, sender command.CommandSender, opts ...SchedulerOption) *Scheduler {
+	s := &Scheduler{
+		store:        store,
+		sender:       sender,
+		clock:        SystemClock,
+		pollInterval: time.Second,
+		batchSize:    100,
+		lease:        time.Minute,
+		maxAttempts:  5,
+		onError:      func(err error) {},
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Scheduler dispatches commands to sender once they are due, commands are
+// persisted in the store so they survive restarts. A command is dispatched
+// at least once, it may be sent again when the scheduler stops before the
+// command is completed.
+type Scheduler struct {
+	store        ScheduleStore
+	sender       command.CommandSender
+	types        typeRegistry
+	clock        Clock
+	pollInterval time.Duration
+	batchSize    int
+	lease        time.Duration
+	maxAttempts  int
+	onError      func(err error)
+}
+
+// Bind registers the command types which can be scheduled
+func (s *Scheduler) Bind(cmds ...interface{}) error {
+	for _, cmd := range cmds {
+		if err := s.types.bind(cmd); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Schedule stores cmd to be dispatched at dueAt and returns its id, the
+// CommandID of an IdentifiedCommand or a new id. Commands are dispatched
+// as values of their bound type.
+func (s *Scheduler) Schedule(ctx context.Context, cmd interface{}, dueAt time.Time) (string, error) {
+	name := s.types.name(cmd)
+	if _, ok := s.types.lookup(name); !ok {
+		return "", fmt.Errorf("command %T is not bound to the scheduler", cmd)
+	}
+
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	var id string
+	if v, ok := cmd.(IdentifiedCommand); ok {
+		id = v.CommandID()
+	}
+	if id == "" {
+		id = NewEventID()
+	}
+
+	err = s.store.Schedule(ctx, ScheduledCommand{
+		ID:       id,
+		DueAt:    dueAt,
+		Type:     name,
+		Data:     data,
+		Metadata: MetadataFromContext(ctx),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// ScheduleAfter schedules cmd to be dispatched once d elapsed on the clock
+func (s *Scheduler) ScheduleAfter(ctx context.Context, cmd interface{}, d time.Duration) (string, error) {
+	return s.Schedule(ctx, cmd, s.clock.Now().Add(d))
+}
+
+// Cancel removes the scheduled command id
+func (s *Scheduler) Cancel(ctx context.Context, id string) error {
+	return s.store.Cancel(ctx, id)
+}
+
+// DispatchDue sends the commands due on the clock and returns how many were
+// sent. Failed commands are retried once their lease expired until they are
+// dead-lettered, the first error is returned after the other commands were
+// dispatched.
+func (s *Scheduler) DispatchDue(ctx context.Context) (int, error) {
+	var (
+		sent     int
+		firstErr error
+	)
+
+	for {
+		due, err := s.store.Claim(ctx, s.clock.Now(), s.lease, s.batchSize)
+		if err != nil {
+			return sent, err
+		}
+
+		for _, cmd := range due {
+			err := s.dispatch(ctx, cmd)
+			if err == nil {
+				sent++
+			} else if firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		if len(due) < s.batchSize || s.batchSize <= 0 {
+			return sent, firstErr
+		}
+	}
+}
+
+// Run dispatches due commands every poll interval until ctx is done,
+// dispatch errors are passed to the WithScheduleErrorHandler function.
+func (s *Scheduler) Run(ctx context.Context) error {
+	for {
+		if _, err := s.DispatchDue(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			s.onError(fmt.Errorf("could not dispatch scheduled commands: %w", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.clock.After(s.pollInterval):
+		}
+	}
+}
+
+func (s *Scheduler) dispatch(ctx context.Context, cmd ScheduledCommand) error {
+	typ, ok := s.types.lookup(cmd.Type)
+	if !ok {
+		return s.fail(ctx, cmd, fmt.Errorf("unable to dispatch scheduled command %s of unbound type %s", cmd.ID, cmd.Type), true)
+	}
+
+	v := reflect.New(typ)
+	if err := json.Unmarshal(cmd.Data, v.Interface()); err != nil {
+		return s.fail(ctx, cmd, fmt.Errorf("unable to unmarshal scheduled command %s into %v: %v", cmd.ID, typ, err), true)
+	}
+
+	if err := s.sender.Send(WithMetadata(ctx, cmd.Metadata), v.Elem().Interface()); err != nil {
+		deadLetter := s.maxAttempts > 0 && cmd.Attempts+1 >= s.maxAttempts
+		return s.fail(ctx, cmd, fmt.Errorf("could not dispatch scheduled command %s: %w", cmd.ID, err), deadLetter)
+	}
+
+	return s.store.Complete(ctx, cmd.ID)
+}
+
+// fail records the failed dispatch of cmd and returns err
+func (s *Scheduler) fail(ctx context.Context, cmd ScheduledCommand, err error, deadLetter bool) error {
+	if ferr := s.store.Fail(ctx, cmd.ID, err.Error(), deadLetter); ferr != nil {
+		return errors.Join(err, ferr)
+	}
+
+	return err
+}
@@ -8,57 +8,144 @@ import (
 	"sync"
 )
 
-var ErrSnapNotFound = errors.New("snapshot not found")
+var (
+	ErrSnapNotFound      = errors.New("snapshot not found")
+	ErrAggregateNotFound = errors.New("aggregate not found")
+)
 
 func NewInmemEventStore() EventStore {
-	return &inmemEventStore{persistence: make(map[string]History)}
+	return &inmemEventStore{
+		persistence: make(map[string]History),
+		listeners:   make(map[chan struct{}]struct{}),
+	}
 }
 
-// inmemEventStore is an implementation of eventsource.EventStore
+// inmemEventStore is an implementation of eventsource.EventStore,
+// eventsource.GlobalEventReader and eventsource.EventNotifier
 // can be useful for testing or examples.
 type inmemEventStore struct {
 	mu          sync.Mutex
 	persistence map[string]History
+	log         []RecordedEvent
+	listeners   map[chan struct{}]struct{}
 }
 
 func (s *inmemEventStore) SaveEvents(ctx context.Context, agrID string, models History, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	i := version
+	history := s.persistence[agrID]
 
-	var history History
+	actual := ExpectedVersionNoStream
+	if len(history) > 0 {
+		actual = history[len(history)-1].Version
+	}
+
+	if version != ExpectedVersionAny && version != actual {
+		return &ErrConcurrencyConflict{AggregateID: agrID, Expected: version, Actual: actual}
+	}
+
+	i := actual + 1
 	for _, m := range models {
 		m.Version = i
-		history = append(s.persistence[agrID], m)
+		if m.ID == "" {
+			m.ID = NewEventID()
+		}
+
+		history = append(history, m)
+		s.log = append(s.log, RecordedEvent{
+			EventModel:  m,
+			Offset:      int64(len(s.log) + 1),
+			AggregateID: agrID,
+		})
 		i++
 	}
 
-	sort.Slice(history, func(i, j int) bool { return history[i].Version < history[j].Version })
-
 	s.persistence[agrID] = history
 
+	for ch := range s.listeners {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+
 	return nil
 }
 
+func (s *inmemEventStore) ReadAll(ctx context.Context, fromOffset int64, limit int) ([]RecordedEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fromOffset < 0 {
+		fromOffset = 0
+	}
+
+	if fromOffset >= int64(len(s.log)) {
+		return nil, nil
+	}
+
+	// offsets are 1-based positions in the log
+	events := s.log[fromOffset:]
+	if limit > 0 && len(events) > limit {
+		events = events[:limit]
+	}
+
+	return append([]RecordedEvent(nil), events...), nil
+}
+
+func (s *inmemEventStore) Notifications(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+
+	s.mu.Lock()
+	s.listeners[ch] = struct{}{}
+	s.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		s.mu.Lock()
+		delete(s.listeners, ch)
+		s.mu.Unlock()
+	}()
+
+	return ch
+}
+
 func (s *inmemEventStore) GetEventsForAggregate(ctx context.Context, agrID string, version int) (History, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	history, ok := s.persistence[agrID]
 	if !ok {
-		return nil, fmt.Errorf("no aggregate found with id: %s", agrID)
+		return nil, fmt.Errorf("%w: %s", ErrAggregateNotFound, agrID)
 	}
 
-	if version != 0 {
-		var h History
-		for _, m := range history {
-			if m.Version > version {
-				h = append(h, m)
-			}
-		}
+	// 0 returns the whole stream, see EventStore
+	if version == 0 {
+		version = ExpectedVersionNoStream
+	}
 
-		return h, nil
+	var h History
+	for _, m := range history {
+		if m.Version > version {
+			h = append(h, m)
+		}
 	}
 
-	return history, nil
+	return h, nil
 }
 
 func NewInmemSnapStore() SnapshotStore {
@@ -71,27 +158,47 @@ type inmemSnapStore struct {
 }
 
 func (r *inmemSnapStore) SaveSnapshot(ctx context.Context, agrID string, model SnapshotModel, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	history := append(r.persistence[model.ID], model)
-	sort.Slice(history, func(i, j int) bool { return history[i].Version < history[j].Version })
+	// the parameters win over the model like in the other stores
+	model.ID = agrID
+	model.Version = version
+
+	history := r.persistence[agrID]
+	i := sort.Search(len(history), func(i int) bool { return history[i].Version >= version })
+	if i < len(history) && history[i].Version == version {
+		history[i] = model
+	} else {
+		history = append(history, SnapshotModel{})
+		copy(history[i+1:], history[i:])
+		history[i] = model
+	}
 
-	r.persistence[model.ID] = history
+	r.persistence[agrID] = history
 
 	return nil
 }
 
+// GetSnapshotForAggregate returns the newest snapshot at or below version
 func (s *inmemSnapStore) GetSnapshotForAggregate(ctx context.Context, agrID string, version int) (SnapshotModel, error) {
-
-	history, ok := s.persistence[agrID]
-	if !ok {
-		return SnapshotModel{}, ErrSnapNotFound
+	if err := ctx.Err(); err != nil {
+		return SnapshotModel{}, err
 	}
 
-	if len(history) == 0 {
-		return SnapshotModel{}, ErrSnapNotFound
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	history := s.persistence[agrID]
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Version <= version {
+			return history[i], nil
+		}
 	}
 
-	return history[len(history)-1], nil
+	return SnapshotModel{}, ErrSnapNotFound
 }
@@ -0,0 +1,105 @@
+package eventsource
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestInmemEventStoreConcurrencyConflict(t *testing.T) {
+	ctx := context.Background()
+	store := NewInmemEventStore()
+
+	if err := store.SaveEvents(ctx, "abc123", History{{}}, ExpectedVersionNoStream); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err := store.SaveEvents(ctx, "abc123", History{{}}, ExpectedVersionNoStream)
+	var conflict *ErrConcurrencyConflict
+	if !errors.As(err, &conflict) {
+		t.Fatalf("expected concurrency conflict, got %v", err)
+	}
+	if conflict.Expected != ExpectedVersionNoStream || conflict.Actual != 0 {
+		t.Errorf("unexpected conflict versions: %+v", conflict)
+	}
+
+	if err := store.SaveEvents(ctx, "abc123", History{{}, {}}, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := store.SaveEvents(ctx, "abc123", History{{}}, ExpectedVersionAny); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	history, err := store.GetEventsForAggregate(ctx, "abc123", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, m := range history {
+		if m.Version != i {
+			t.Errorf("expected event %d to have version %d, got %d", i, i, m.Version)
+		}
+	}
+}
+
+func TestRepositoryRejectsStaleAggregate(t *testing.T) {
+	marshaler := new(JsonEventMarshaler)
+	marshaler.Bind(ShipmentPacked{}, ShipmentPickedUp{}, ShipmentShipped{})
+
+	ctx := context.Background()
+	repo := NewRepository(&Shipment{}, WithMarshaler(marshaler))
+	bus := NewCommandBus(repo)
+
+	if err := bus.Send(ctx, PackShipment{Command{ID: "abc123"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var conflict *ErrConcurrencyConflict
+	if err := bus.Send(ctx, PackShipment{Command{ID: "abc123"}}); !errors.As(err, &conflict) {
+		t.Fatalf("expected constructor to conflict with existing stream, got %v", err)
+	}
+
+	first, _ := repo.GetByID(ctx, "abc123")
+	second, _ := repo.GetByID(ctx, "abc123")
+
+	first.(*Shipment).Handle(ctx, PickupShipment{Command{ID: "abc123"}})
+	second.(*Shipment).Handle(ctx, PickupShipment{Command{ID: "abc123"}})
+
+	if err := repo.Save(ctx, first); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := repo.Save(ctx, second); !errors.As(err, &conflict) {
+		t.Fatalf("expected concurrency conflict, got %v", err)
+	}
+}
+
+func TestRepositorySavesNewAggregate(t *testing.T) {
+	marshaler := new(JsonEventMarshaler)
+	marshaler.Bind(ShipmentPacked{}, ShipmentPickedUp{}, ShipmentShipped{})
+
+	ctx := context.Background()
+	repo := NewRepository(&Shipment{}, WithMarshaler(marshaler))
+
+	// the creation event is not a Constructor, the stream must not exist yet
+	shipment := &Shipment{}
+	shipment.Handle(ctx, PackShipment{Command{ID: "abc123"}})
+	if err := repo.Save(ctx, shipment); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	shipment.Handle(ctx, PickupShipment{Command{ID: "abc123"}})
+	if err := repo.Save(ctx, shipment); err != nil {
+		t.Fatalf("unexpected error saving the aggregate again: %v", err)
+	}
+
+	aggregate, err := repo.GetByID(ctx, "abc123")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if v := aggregate.GetVersion(); v != 1 || shipment.GetVersion() != 1 {
+		t.Errorf("expected version 1, got %d and %d", v, shipment.GetVersion())
+	}
+}
@@ -0,0 +1,115 @@
+package eventsource
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RecordedEventHandler handles events delivered by a subscription
+type RecordedEventHandler func(ctx context.Context, e RecordedEvent) error
+
+type SubscriptionOption func(s *CatchUpSubscription)
+
+// WithBatchSize sets how many events are read from the store at once
+func WithBatchSize(n int) SubscriptionOption {
+	return func(s *CatchUpSubscription) {
+		s.batchSize = n
+	}
+}
+
+// WithPollInterval sets how often the store is polled for new events once
+// the subscription is live, stores implementing EventNotifier wake it up sooner.
+func WithPollInterval(d time.Duration) SubscriptionOption {
+	return func(s *CatchUpSubscription) {
+		s.pollInterval = d
+	}
+}
+
+// NewCatchUpSubscription creates a subscription delivering every event after
+// the checkpoint offset from to handler, first from history and then live.
+func NewCatchUpSubscription(reader GlobalEventReader, from int64, handler RecordedEventHandler, opts ...SubscriptionOption) *CatchUpSubscription {
+	s := &CatchUpSubscription{
+		reader:       reader,
+		handler:      handler,
+		position:     from,
+		batchSize:    100,
+		pollInterval: time.Second,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// CatchUpSubscription reads the global stream of a store from a checkpoint
+// and keeps delivering new events once it caught up with the history.
+type CatchUpSubscription struct {
+	reader       GlobalEventReader
+	handler      RecordedEventHandler
+	batchSize    int
+	pollInterval time.Duration
+
+	mu       sync.Mutex
+	position int64
+	live     bool
+}
+
+// Run delivers events until ctx is done or the handler returns an error,
+// events are delivered one at a time in global order.
+func (s *CatchUpSubscription) Run(ctx context.Context) error {
+	var notify <-chan struct{}
+	if n, ok := s.reader.(EventNotifier); ok {
+		notify = n.Notifications(ctx)
+	}
+
+	for {
+		events, err := s.reader.ReadAll(ctx, s.Position(), s.batchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range events {
+			if err := s.handler(ctx, e); err != nil {
+				return err
+			}
+
+			s.mu.Lock()
+			s.position = e.Offset
+			s.mu.Unlock()
+		}
+
+		if s.batchSize > 0 && len(events) == s.batchSize {
+			continue
+		}
+
+		s.mu.Lock()
+		s.live = true
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-notify:
+		case <-time.After(s.pollInterval):
+		}
+	}
+}
+
+// Position returns the offset of the last delivered event
+func (s *CatchUpSubscription) Position() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.position
+}
+
+// Live reports whether the subscription caught up with the history
+func (s *CatchUpSubscription) Live() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.live
+}
@@ -0,0 +1,57 @@
+package eventsource
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCatchUpSubscription(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := NewInmemEventStore()
+	store.SaveEvents(ctx, "a", History{{}, {}}, ExpectedVersionNoStream)
+	store.SaveEvents(ctx, "b", History{{}}, ExpectedVersionNoStream)
+	store.SaveEvents(ctx, "a", History{{}}, 1)
+
+	received := make(chan RecordedEvent)
+	sub := NewCatchUpSubscription(store.(GlobalEventReader), 1, func(ctx context.Context, e RecordedEvent) error {
+		received <- e
+		return nil
+	}, WithBatchSize(2), WithPollInterval(time.Hour))
+
+	done := make(chan error)
+	go func() { done <- sub.Run(ctx) }()
+
+	expect := func(offset int64, aggrID string, version int) {
+		t.Helper()
+		select {
+		case e := <-received:
+			if e.Offset != offset || e.AggregateID != aggrID || e.Version != version {
+				t.Fatalf("expected %s@%d at offset %d, got %s@%d at offset %d", aggrID, version, offset, e.AggregateID, e.Version, e.Offset)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for offset %d", offset)
+		}
+	}
+
+	expect(2, "a", 1)
+	expect(3, "b", 0)
+	expect(4, "a", 2)
+
+	// the poll interval is an hour, live delivery relies on store notifications
+	store.SaveEvents(ctx, "b", History{{}}, 0)
+	expect(5, "b", 1)
+
+	// the position is stored once the handler returned, Run is done with it
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got %v", err)
+	}
+
+	if !sub.Live() || sub.Position() != 5 {
+		t.Errorf("expected live subscription at position 5, got live=%v position=%d", sub.Live(), sub.Position())
+	}
+}
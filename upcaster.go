@@ -0,0 +1,206 @@
+package eventsource
+
+import (
+	"fmt"
+	"sync"
+)
+
+// RawEvent is the stored form of an event before it is decoded into its type
+type RawEvent struct {
+	// Type is the name the event type is bound with
+	Type string
+
+	// Revision is the schema revision of Data, events start at revision 1
+	Revision int
+
+	// Data contains the event fields as decoded from JSON
+	Data map[string]interface{}
+}
+
+// Upcaster transforms an event from its revision to the next one,
+// it may also rename the event type.
+type Upcaster func(e RawEvent) (RawEvent, error)
+
+func NewUpcasterRegistry() *UpcasterRegistry {
+	return &UpcasterRegistry{
+		upcasters: make(map[string]map[int]Upcaster),
+		renames:   make(map[string]map[int]string),
+	}
+}
+
+// UpcasterRegistry holds the upcasters of each event type and revision
+type UpcasterRegistry struct {
+	mu        sync.RWMutex
+	upcasters map[string]map[int]Upcaster
+	renames   map[string]map[int]string
+}
+
+// Register adds the upcaster transforming typ from revision to revision+1.
+// Upcasters renaming the type should be registered with RegisterRename, so
+// rename cycles are detected here rather than when events are loaded.
+func (r *UpcasterRegistry) Register(typ string, revision int, u Upcaster) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.register(typ, revision, "", u)
+}
+
+// RegisterRename adds an upcaster renaming typ at revision to the type to,
+// the event continues at the same revision of to. It fails when the rename
+// closes a cycle with the upcasters registered so far.
+func (r *UpcasterRegistry) RegisterRename(typ string, revision int, to string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.register(typ, revision, to, func(e RawEvent) (RawEvent, error) {
+		e.Type = to
+		return e, nil
+	})
+}
+
+func (r *UpcasterRegistry) register(typ string, revision int, to string, u Upcaster) error {
+	if revision < 1 {
+		return fmt.Errorf("invalid revision %d for %s, revisions start at 1", revision, typ)
+	}
+
+	if _, ok := r.upcasters[typ][revision]; ok {
+		return fmt.Errorf("upcaster already registered for %s revision %d", typ, revision)
+	}
+
+	if r.upcasters[typ] == nil {
+		r.upcasters[typ] = make(map[int]Upcaster)
+		r.renames[typ] = make(map[int]string)
+	}
+	r.upcasters[typ][revision] = u
+	if to != "" {
+		r.renames[typ][revision] = to
+	}
+
+	if cycle := r.cycle(typ, revision); cycle != "" {
+		delete(r.upcasters[typ], revision)
+		delete(r.renames[typ], revision)
+		return fmt.Errorf("upcaster for %s revision %d closes the cycle %s", typ, revision, cycle)
+	}
+
+	return nil
+}
+
+// cycle follows the upcasters from typ at revision and returns the path
+// when it leads back to where it started, or "" when it ends.
+func (r *UpcasterRegistry) cycle(typ string, revision int) string {
+	path := fmt.Sprintf("%s@%d", typ, revision)
+
+	t, rev := typ, revision
+	for {
+		if _, ok := r.upcasters[t][rev]; !ok {
+			return ""
+		}
+
+		if to, ok := r.renames[t][rev]; ok {
+			t = to
+		} else {
+			rev++
+		}
+
+		path += fmt.Sprintf(" -> %s@%d", t, rev)
+		if t == typ && rev == revision {
+			return path
+		}
+	}
+}
+
+// Revision returns the latest revision of typ
+func (r *UpcasterRegistry) Revision(typ string) int {
+	return r.revision([]string{typ})
+}
+
+// revision returns the latest revision of the type known by names
+func (r *UpcasterRegistry) revision(names []string) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	latest := 1
+	for _, typ := range names {
+		for revision := range r.upcasters[typ] {
+			if revision+1 > latest {
+				latest = revision + 1
+			}
+		}
+	}
+
+	return latest
+}
+
+// find returns the upcaster registered at revision under the first of names
+func (r *UpcasterRegistry) find(names []string, revision int) (Upcaster, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, typ := range names {
+		if u, ok := r.upcasters[typ][revision]; ok {
+			return u, true
+		}
+	}
+
+	return nil, false
+}
+
+// Upcast applies the upcasters of e one revision at a time until there is
+// none left for its type and revision.
+func (r *UpcasterRegistry) Upcast(e RawEvent) (RawEvent, error) {
+	return r.upcast(e, func(typ string) []string { return []string{typ} })
+}
+
+// upcast is Upcast looking up the upcasters of a type under all the names
+// returned by aliases, so the marshalers find upcasters registered under
+// the unqualified name of a type as well as under its bound name.
+func (r *UpcasterRegistry) upcast(e RawEvent, aliases func(typ string) []string) (RawEvent, error) {
+	if e.Revision < 1 {
+		e.Revision = 1
+	}
+
+	// upcasters registered with Register may rename the type as well,
+	// cycles through them are only noticed here
+	seen := make(map[string]map[int]bool)
+
+	for {
+		names := aliases(e.Type)
+		u, ok := r.find(names, e.Revision)
+		if !ok {
+			return e, nil
+		}
+
+		if seen[names[0]][e.Revision] {
+			return RawEvent{}, fmt.Errorf("unable to upcast %s, revision %d was reached twice", e.Type, e.Revision)
+		}
+		if seen[names[0]] == nil {
+			seen[names[0]] = make(map[int]bool)
+		}
+		seen[names[0]][e.Revision] = true
+
+		from := e
+		next, err := u(e)
+		if err != nil {
+			return RawEvent{}, fmt.Errorf("unable to upcast %s from revision %d: %v", from.Type, from.Revision, err)
+		}
+
+		// a renamed type continues from the revision set by the upcaster
+		if next.Type == from.Type && next.Revision <= from.Revision {
+			next.Revision = from.Revision + 1
+		} else if next.Revision < 1 {
+			next.Revision = 1
+		}
+
+		e = next
+	}
+}
+
+// needsUpcast reports whether an upcaster is registered at revision under one of names
+func (r *UpcasterRegistry) needsUpcast(names []string, revision int) bool {
+	if revision < 1 {
+		revision = 1
+	}
+
+	_, ok := r.find(names, revision)
+	return ok
+}
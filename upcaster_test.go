@@ -0,0 +1,109 @@
+package eventsource
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type CustomerRegistered struct {
+	EventSkeleton
+	FirstName string
+	LastName  string
+}
+
+func TestJsonEventMarshalerUpcastsStoredEvents(t *testing.T) {
+	upcasters := NewUpcasterRegistry()
+
+	// revision 1 was stored as CustomerSignedUp with a single Name field
+	upcasters.RegisterRename("CustomerSignedUp", 1, "CustomerRegistered")
+	upcasters.Register("CustomerRegistered", 1, func(e RawEvent) (RawEvent, error) {
+		e.Data["FullName"] = e.Data["Name"]
+		delete(e.Data, "Name")
+		return e, nil
+	})
+	upcasters.Register("CustomerRegistered", 2, func(e RawEvent) (RawEvent, error) {
+		name, _ := e.Data["FullName"].(string)
+		first, last, _ := strings.Cut(name, " ")
+		e.Data["FirstName"], e.Data["LastName"] = first, last
+		delete(e.Data, "FullName")
+		return e, nil
+	})
+
+	marshaler := &JsonEventMarshaler{Upcasters: upcasters}
+	marshaler.Bind(CustomerRegistered{})
+
+	legacy := EventModel{Data: []byte(`{"type":"CustomerSignedUp","data":{"ID":"abc123","Version":0,"Name":"Jane Roe"}}`)}
+	event, err := marshaler.Unmarshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registered := event.(*CustomerRegistered)
+	if registered.AggregateID() != "abc123" || registered.FirstName != "Jane" || registered.LastName != "Roe" {
+		t.Errorf("unexpected upcasted event: %+v", registered)
+	}
+
+	model, err := marshaler.Marshal(registered)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var p payload
+	if err := json.Unmarshal(model.Data, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Revision != 3 {
+		t.Errorf("expected latest revision 3 to be stored, got %d", p.Revision)
+	}
+
+	event, err = marshaler.Unmarshal(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded := event.(*CustomerRegistered); decoded.FirstName != "Jane" || decoded.LastName != "Roe" {
+		t.Errorf("expected latest revision to decode unchanged, got %+v", event)
+	}
+}
+
+func TestUpcasterRegistryRejectsCycles(t *testing.T) {
+	upcasters := NewUpcasterRegistry()
+
+	if err := upcasters.RegisterRename("A", 1, "B"); err != nil {
+		t.Fatal(err)
+	}
+	if err := upcasters.RegisterRename("B", 1, "A"); err == nil {
+		t.Fatal("expected the rename back to A to be rejected")
+	}
+	if err := upcasters.RegisterRename("B", 1, "C"); err != nil {
+		t.Fatalf("expected the rejected rename to be dropped: %v", err)
+	}
+	if err := upcasters.RegisterRename("C", 1, "A"); err == nil {
+		t.Fatal("expected the rename from C to A to be rejected")
+	}
+
+	raw, err := upcasters.Upcast(RawEvent{Type: "A", Revision: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.Type != "C" || raw.Revision != 1 {
+		t.Errorf("expected C at revision 1, got %s at %d", raw.Type, raw.Revision)
+	}
+}
+
+func TestUpcasterRegistryStopsOnUnregisteredCycles(t *testing.T) {
+	upcasters := NewUpcasterRegistry()
+
+	rename := func(to string) Upcaster {
+		return func(e RawEvent) (RawEvent, error) {
+			e.Type = to
+			return e, nil
+		}
+	}
+	upcasters.Register("A", 1, rename("B"))
+	upcasters.Register("B", 1, rename("A"))
+
+	if _, err := upcasters.Upcast(RawEvent{Type: "A", Revision: 1}); err == nil {
+		t.Error("expected the cycle to be reported")
+	}
+}